@@ -1,27 +1,101 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"github.com/rmarchant/intel-gpu-exporter/internal/collector"
+	"github.com/rmarchant/intel-gpu-exporter/internal/history"
+	"github.com/rmarchant/intel-gpu-exporter/internal/influx"
+	"github.com/rmarchant/intel-gpu-exporter/internal/mqtt"
+	"github.com/rmarchant/intel-gpu-exporter/internal/otlp"
+	"github.com/rmarchant/intel-gpu-exporter/internal/ui"
+	"github.com/rmarchant/intel-gpu-exporter/internal/web"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
 	"log/slog"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
 
 var (
-	debug    = flag.Bool("debug", false, "Enable debug logging")
-	addr     = flag.String("addr", ":9090", "Prometheus metrics listener address")
-	interval = flag.Duration("interval", time.Second, "Interval to collect statistics")
+	debug       = flag.Bool("debug", false, "Enable debug logging")
+	addr        = flag.String("addr", ":9090", "Prometheus metrics listener address")
+	interval    = flag.Duration("interval", time.Second, "Interval to collect statistics")
+	raw         = flag.Bool("raw", false, "Export all values reported by intel_gpu_top as gpumon_raw")
+	validate    = flag.String("validation", string(collector.ValidationDrop), "What to do with invalid samples (drop|clamp)")
+	lazy        = flag.Bool("lazy", false, "Only run intel_gpu_top while the exporter is being scraped")
+	idleTimeout = flag.Duration("idle-timeout", 5*time.Minute, "Stop intel_gpu_top after this time without scrapes (requires -lazy, must be positive)")
+	syncMode    = flag.Bool("sync", false, "Run intel_gpu_top for one sampling window on each scrape")
+	timeout     = flag.Duration("timeout", 15*time.Second, "Restart intel_gpu_top if it sends no data for this long")
+	checkEvery  = flag.Duration("check-interval", time.Second, "Interval at which the watchdog checks intel_gpu_top")
+	frozen      = flag.Int("frozen-records", 0, "Restart intel_gpu_top after this many identical records while clients are present (0 disables)")
+	device      = flag.String("device", "sriov", "Device filter for intel_gpu_top (-d). Leave empty to let intel_gpu_top select the device")
+	binary      = flag.String("command", "intel_gpu_top", "Path of the intel_gpu_top binary")
+	wrapper     = flag.String("command-wrapper", "", `Command that runs intel_gpu_top, e.g. "sudo" or "ssh ubuntu@nuc1 sudo"`)
+	extraArgs   = flag.String("command-args", "", "Additional arguments for intel_gpu_top")
+	workDir     = flag.String("command-dir", "", "Working directory of intel_gpu_top")
+	nice        = flag.Int("nice", 0, "Scheduling niceness of intel_gpu_top (-20 to 19)")
+	cpus        = flag.String("cpus", "", `CPUs intel_gpu_top may run on, e.g. "0,2-3"`)
+	cgroup      = flag.String("cgroup", "", "cgroup v2 directory to run intel_gpu_top in, e.g. /sys/fs/cgroup/gpumon")
+	cgroupCPU   = flag.Float64("cgroup-cpu-max", 0, "Maximum CPUs intel_gpu_top's cgroup may use, e.g. 0.5 (requires -cgroup)")
+	cgroupMem   = flag.Int64("cgroup-memory-max", 0, "Maximum memory (in bytes) intel_gpu_top's cgroup may use (requires -cgroup)")
+	sshUser     = flag.String("ssh-user", os.Getenv("USER"), "SSH user for targets that don't specify one")
+	sshKey      = flag.String("ssh-key", "~/.ssh/id_ed25519", "Private key to authenticate with SSH targets")
+	knownHosts  = flag.String("ssh-known-hosts", "~/.ssh/known_hosts", "known_hosts file to verify the SSH targets' host keys")
+	readyMaxAge = flag.Duration("ready-max-age", time.Minute, "/readyz fails if a source sent no data for this long")
+	webConfig   = flag.String("web-config", "", "Path of the web configuration file (TLS, mTLS and basic auth). Reloaded on change")
+	debugAddr   = flag.String("debug-addr", "", `Listener address for pprof and expvar, e.g. ":6060" (loopback only, unless a host is given). Disabled if empty`)
+	historyDir  = flag.String("history-dir", "", "Directory to keep the history of GPU usage in, served by /api/v1/history. Disabled if empty")
+	historyKeep = flag.String("history-retention", "1s=1h,1m=168h,1h=8760h", "Retention of each history tier (1s, 1m, 1h). 0 disables a tier")
+	otlpURL     = flag.String("otlp-endpoint", "", "URL of the OTLP receiver to push metrics to, e.g. http://otel-collector:4317. Disabled if empty")
+	otlpProto   = flag.String("otlp-protocol", string(otlp.ProtocolGRPC), "OTLP protocol (grpc|http/protobuf)")
+	otlpEvery   = flag.Duration("otlp-interval", 15*time.Second, "Interval at which metrics are pushed over OTLP, at most 5m")
+	otlpHeaders = flag.String("otlp-headers", "", `Headers sent with each OTLP export, e.g. "Authorization=Bearer token"`)
+	otlpAttrs   = flag.String("otlp-resource-attributes", "", `Resource attributes of the OTLP metrics, e.g. "deployment.environment=prod"`)
+	influxURL   = flag.String("influx-url", "", "URL of InfluxDB to write line protocol to, e.g. http://influxdb:8086. Disabled if empty")
+	influxOrg   = flag.String("influx-org", "", "InfluxDB organization (required with -influx-url)")
+	influxBkt   = flag.String("influx-bucket", "", "InfluxDB bucket (required with -influx-url)")
+	influxToken = flag.String("influx-token", "", "InfluxDB API token. Defaults to $INFLUX_TOKEN")
+	influxBatch = flag.Int("influx-batch-size", 5000, "Maximum number of lines per InfluxDB write")
+	influxOut   = flag.Bool("influx-stdout", false, "Write line protocol to stdout, e.g. for Telegraf's execd input")
+	influxEvery = flag.Duration("influx-interval", 10*time.Second, "Interval at which line protocol is written, at most 5m")
+	mqttBroker  = flag.String("mqtt-broker", "", "URL of the MQTT broker to publish to, e.g. tcp://mosquitto:1883. Disabled if empty")
+	mqttUser    = flag.String("mqtt-username", "", "MQTT username")
+	mqttPass    = flag.String("mqtt-password", "", "MQTT password. Defaults to $MQTT_PASSWORD")
+	mqttClient  = flag.String("mqtt-client-id", "", "MQTT client ID. Defaults to intel-gpu-exporter-<node>")
+	mqttNode    = flag.String("mqtt-node", hostname(), "Name of this exporter in MQTT topics and Home Assistant")
+	mqttPrefix  = flag.String("mqtt-topic-prefix", "gpumon", "Prefix of the MQTT topics")
+	mqttHA      = flag.String("mqtt-discovery-prefix", "homeassistant", "Home Assistant MQTT discovery prefix. Discovery is disabled if empty")
+	mqttEvery   = flag.Duration("mqtt-interval", 10*time.Second, "Interval at which statistics are published over MQTT, at most 5m")
+	env         []string
+	targets     []collector.Target
 )
 
+func init() {
+	flag.Func("command-env", "Environment variable for intel_gpu_top (KEY=VALUE). Can be repeated", func(s string) error {
+		env = append(env, s)
+		return nil
+	})
+	flag.Func("ssh-target", "Remote host to monitor over SSH ([name=][user@]host[:port]). Can be repeated", func(s string) error {
+		target, err := collector.ParseTarget(s)
+		if err == nil {
+			targets = append(targets, target)
+		}
+		return err
+	})
+}
+
 func main() {
 	flag.Parse()
 
@@ -31,19 +105,324 @@ func main() {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stderr, &handlerOpts))
 
-	http.Handle("/metrics", promhttp.Handler())
+	validation, err := collector.ParseValidationPolicy(*validate)
+	if err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	command := collector.Command{
+		Binary:  *binary,
+		Wrapper: strings.Fields(*wrapper),
+		Args:    strings.Fields(*extraArgs),
+		Env:     env,
+		Dir:     *workDir,
+		Device:  *device,
+	}
+	if err = command.Validate(); err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	// with SSH targets, the command runs on the targets
+	if len(targets) == 0 {
+		if command, err = command.Resolve(); err != nil {
+			logger.Error("invalid configuration", "err", err)
+			os.Exit(1)
+		}
+	}
+	cpuList, err := collector.ParseCPUList(*cpus)
+	if err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	resources := collector.Resources{Nice: *nice, CPUs: cpuList, Cgroup: *cgroup, CPUMax: *cgroupCPU, MemoryMax: *cgroupMem}
+	if err = resources.Validate(); err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	var sshConfig collector.SSHConfig
+	if len(targets) > 0 {
+		if sshConfig, err = loadSSHConfig(*sshUser, *sshKey, *knownHosts); err != nil {
+			logger.Error("invalid configuration", "err", err)
+			os.Exit(1)
+		}
+	}
+	if *lazy && *syncMode {
+		logger.Error("invalid configuration", "err", "-lazy and -sync are mutually exclusive")
+		os.Exit(1)
+	}
+	if *timeout <= 0 || *checkEvery <= 0 {
+		logger.Error("invalid configuration", "err", "-timeout and -check-interval must be positive")
+		os.Exit(1)
+	}
+	if *frozen < 0 {
+		logger.Error("invalid configuration", "err", "-frozen-records can't be negative")
+		os.Exit(1)
+	}
+	if *lazy && *idleTimeout <= 0 {
+		logger.Error("invalid configuration", "err", "-idle-timeout must be positive with -lazy")
+		os.Exit(1)
+	}
+	if (*influxURL != "" || *influxOut) && (*influxEvery <= 0 || *influxEvery > collector.MaxStatsWindow) {
+		logger.Error("invalid configuration", "err", fmt.Sprintf("-influx-interval must be between 0 and %s", collector.MaxStatsWindow))
+		os.Exit(1)
+	}
+	var otlpConfig otlp.Config
+	if *otlpURL != "" {
+		if otlpConfig, err = loadOTLPConfig(); err != nil {
+			logger.Error("invalid configuration", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var influxClient *influx.Client
+	if *influxURL != "" {
+		influxClient, err = influx.NewClient(influx.Config{
+			URL:       *influxURL,
+			Org:       *influxOrg,
+			Bucket:    *influxBkt,
+			Token:     cmp.Or(*influxToken, os.Getenv("INFLUX_TOKEN")),
+			BatchSize: *influxBatch,
+		}, logger)
+		if err != nil {
+			logger.Error("invalid configuration", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var store *history.Store
+	if *historyDir != "" {
+		tiers, err := history.ParseRetention(*historyKeep)
+		if err != nil {
+			logger.Error("invalid configuration", "err", err)
+			os.Exit(1)
+		}
+		if store, err = history.Open(*historyDir, tiers, logger); err != nil {
+			logger.Error("failed to open history", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	health := collector.NewHealth(*readyMaxAge)
+	api := collector.NewAPI()
+
+	var publisher *mqtt.Publisher
+	if *mqttBroker != "" {
+		publisher, err = mqtt.New(mqtt.Config{
+			Broker:          *mqttBroker,
+			ClientID:        *mqttClient,
+			Username:        *mqttUser,
+			Password:        cmp.Or(*mqttPass, os.Getenv("MQTT_PASSWORD")),
+			Node:            *mqttNode,
+			TopicPrefix:     *mqttPrefix,
+			DiscoveryPrefix: *mqttHA,
+			Interval:        *mqttEvery,
+		}, api, logger)
+		if err != nil {
+			logger.Error("invalid configuration", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz)
+	mux.HandleFunc("GET /api/v1/stats", api.Stats)
+	mux.HandleFunc("GET /api/v1/stream", api.Stream)
+	if store != nil {
+		mux.HandleFunc("GET /api/v1/history", store.History)
+	}
+	mux.Handle("/", ui.Handler())
+	server, err := web.NewServer(*addr, mux, *webConfig, logger)
+	if err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	// streams never end by themselves: close them so the server can shut down
+	server.RegisterOnShutdown(api.Close)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var exporter *otlp.Exporter
+	if *otlpURL != "" {
+		if exporter, err = otlp.New(ctx, otlpConfig, api, logger); err != nil {
+			logger.Error("failed to start OTLP exporter", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var lineWriters []io.Writer
+	if *influxOut {
+		lineWriters = append(lineWriters, os.Stdout)
+	}
+	if influxClient != nil {
+		lineWriters = append(lineWriters, influxClient)
+	}
+	influxDone := make(chan struct{})
+	if len(lineWriters) > 0 {
+		// the client stops once the last lines were generated, so its final flush sends them
+		clientCtx, stopClient := context.WithCancel(context.Background())
+		clientDone := make(chan struct{})
+		if influxClient != nil {
+			go func() {
+				influxClient.Run(clientCtx)
+				close(clientDone)
+			}()
+		} else {
+			close(clientDone)
+		}
+		go func() {
+			if err := influx.Run(ctx, api, *influxEvery, io.MultiWriter(lineWriters...)); err != nil {
+				logger.Error("failed to write line protocol", "err", err)
+			}
+			stopClient()
+			<-clientDone
+			close(influxDone)
+		}()
+	} else {
+		close(influxDone)
+	}
+
+	mqttDone := make(chan struct{})
+	if publisher != nil {
+		go func() {
+			publisher.Run(ctx)
+			close(mqttDone)
+		}()
+	} else {
+		close(mqttDone)
+	}
+
+	go server.Watch(ctx, 5*time.Second)
 	go func() {
-		if err := http.ListenAndServe(*addr, nil); !errors.Is(err, http.ErrServerClosed) {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 			logger.Error("failed to start metrics server", "err", err)
 			os.Exit(1)
 		}
 	}()
+	servers := []*http.Server{server.Server}
+	if *debugAddr != "" {
+		debugServer := &http.Server{Addr: web.DebugAddr(*debugAddr), Handler: web.DebugHandler(), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := debugServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("failed to start debug server", "err", err)
+				os.Exit(1)
+			}
+		}()
+		logger.Info("debug server started", "addr", debugServer.Addr)
+		servers = append(servers, debugServer)
+	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = collector.Run(ctx, prometheus.DefaultRegisterer, collector.Config{
+		Interval:      *interval,
+		Command:       command,
+		Resources:     resources,
+		Timeout:       *timeout,
+		CheckInterval: *checkEvery,
+		FrozenRecords: *frozen,
+		Raw:           *raw,
+		Validation:    validation,
+		Lazy:          *lazy,
+		IdleTimeout:   *idleTimeout,
+		Sync:          *syncMode,
+		Targets:       targets,
+		SSH:           sshConfig,
+		Health:        health,
+		API:           api,
+		History:       store,
+	}, logger)
+	shutdown(servers, logger)
+	if exporter != nil {
+		// send the last statistics
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := exporter.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("failed to shut down OTLP exporter", "err", err)
+		}
+		cancelShutdown()
+	}
+	// wait for the last lines to be written to InfluxDB, and the exporter to be marked offline in MQTT
+	<-influxDone
+	<-mqttDone
+	if store != nil {
+		// write the buckets that are still being filled
+		if err := store.Close(); err != nil {
+			logger.Warn("failed to close history", "err", err)
+		}
+	}
+	if err != nil {
+		logger.Error("collector failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// hostname returns the hostname, or "localhost" if it can't be determined.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return name
+}
+
+// shutdownTimeout is the time in-flight requests get to complete when the exporter stops.
+const shutdownTimeout = 5 * time.Second
+
+// shutdown gracefully shuts down the servers. Requests that don't complete within shutdownTimeout are aborted.
+func shutdown(servers []*http.Server, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("graceful shutdown failed", "addr", server.Addr, "err", err)
+			_ = server.Close()
+		}
+	}
+}
 
-	if err := collector.Run(ctx, prometheus.DefaultRegisterer, *interval, logger); err != nil {
-		logger.Error("collector failed to start", "err", err)
-		os.Exit(1)
+// loadOTLPConfig returns the configuration of the OTLP exporter.
+func loadOTLPConfig() (otlp.Config, error) {
+	protocol, err := otlp.ParseProtocol(*otlpProto)
+	if err != nil {
+		return otlp.Config{}, err
+	}
+	headers, err := otlp.ParseAttributes(*otlpHeaders)
+	if err != nil {
+		return otlp.Config{}, fmt.Errorf("-otlp-headers: %w", err)
+	}
+	attributes, err := otlp.ParseAttributes(*otlpAttrs)
+	if err != nil {
+		return otlp.Config{}, fmt.Errorf("-otlp-resource-attributes: %w", err)
+	}
+	return otlp.Config{Endpoint: *otlpURL, Protocol: protocol, Interval: *otlpEvery, Headers: headers, Resource: attributes}, nil
+}
+
+// loadSSHConfig returns the SSH configuration to connect to the targets, using the private key and known_hosts files.
+func loadSSHConfig(user, keyFile, knownHostsFile string) (collector.SSHConfig, error) {
+	key, err := os.ReadFile(expandHome(keyFile))
+	if err != nil {
+		return collector.SSHConfig{}, fmt.Errorf("ssh key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return collector.SSHConfig{}, fmt.Errorf("ssh key: %w", err)
+	}
+	hostKeyCallback, err := knownhosts.New(expandHome(knownHostsFile))
+	if err != nil {
+		return collector.SSHConfig{}, fmt.Errorf("ssh known hosts: %w", err)
+	}
+	return collector.SSHConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
 	}
+	return path
 }
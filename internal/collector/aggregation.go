@@ -0,0 +1,63 @@
+package collector
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Aggregation determines how the samples received by an Aggregator are consolidated into one value.
+type Aggregation string
+
+const (
+	// AggregationMedian reports the median of the samples. This is how samples are aggregated for Prometheus.
+	AggregationMedian Aggregation = "median"
+	// AggregationMean reports the average of the samples.
+	AggregationMean Aggregation = "mean"
+	// AggregationMin reports the lowest value.
+	AggregationMin Aggregation = "min"
+	// AggregationMax reports the highest value.
+	AggregationMax Aggregation = "max"
+	// AggregationLast reports the most recent value.
+	AggregationLast Aggregation = "last"
+)
+
+// ParseAggregation returns the Aggregation for s.
+func ParseAggregation(s string) (Aggregation, error) {
+	switch aggregation := Aggregation(s); aggregation {
+	case AggregationMedian, AggregationMean, AggregationMin, AggregationMax, AggregationLast:
+		return aggregation, nil
+	default:
+		return "", fmt.Errorf("invalid aggregation %q", s)
+	}
+}
+
+// aggregateFunc consolidates the values returned by f for each entry. An empty Aggregation calculates the median.
+func aggregateFunc[T any](aggregation Aggregation, entries []T, f func(T) float64) float64 {
+	if len(entries) == 0 {
+		return 0
+	}
+	switch aggregation {
+	case AggregationMean:
+		var total float64
+		for _, entry := range entries {
+			total += f(entry)
+		}
+		return total / float64(len(entries))
+	case AggregationMin:
+		values := make([]float64, len(entries))
+		for i, entry := range entries {
+			values[i] = f(entry)
+		}
+		return slices.Min(values)
+	case AggregationMax:
+		values := make([]float64, len(entries))
+		for i, entry := range entries {
+			values[i] = f(entry)
+		}
+		return slices.Max(values)
+	case AggregationLast:
+		return f(entries[len(entries)-1])
+	default:
+		return medianFunc(entries, f)
+	}
+}
@@ -0,0 +1,37 @@
+package collector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseAggregation(t *testing.T) {
+	aggregation, err := ParseAggregation("mean")
+	assert.NoError(t, err)
+	assert.Equal(t, AggregationMean, aggregation)
+
+	_, err = ParseAggregation("p99")
+	assert.Error(t, err)
+}
+
+func Test_aggregateFunc(t *testing.T) {
+	values := []float64{3, 1, 4, 2}
+	identity := func(f float64) float64 { return f }
+	tests := []struct {
+		aggregation Aggregation
+		want        float64
+	}{
+		{aggregation: "", want: 2.5},
+		{aggregation: AggregationMedian, want: 2.5},
+		{aggregation: AggregationMean, want: 2.5},
+		{aggregation: AggregationMin, want: 1},
+		{aggregation: AggregationMax, want: 4},
+		{aggregation: AggregationLast, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.aggregation), func(t *testing.T) {
+			assert.Equal(t, tt.want, aggregateFunc(tt.aggregation, values, identity))
+			assert.Zero(t, aggregateFunc(tt.aggregation, nil, identity))
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package collector
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
 	"github.com/prometheus/client_golang/prometheus"
@@ -8,6 +10,7 @@ import (
 	"log/slog"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,9 +19,15 @@ import (
 
 var (
 	engineMetric = prometheus.NewDesc(
-		prometheus.BuildFQName("gpumon", "engine", "usage"),
-		"Usage statistics for the different GPU engines",
-		[]string{"engine", "attrib"},
+		prometheus.BuildFQName("gpumon", "engine", "usage_ratio"),
+		"Usage statistics for the different GPU engines, as a ratio (0-1)",
+		[]string{"engine", "engine_class", "engine_instance", "attrib"},
+		nil,
+	)
+	engineClassMetric = prometheus.NewDesc(
+		prometheus.BuildFQName("gpumon", "engine_class", "usage_ratio"),
+		"Average usage statistics of all GPU engines in a class, as a ratio (0-1)",
+		[]string{"engine_class", "attrib"},
 		nil,
 	)
 	powerMetric = prometheus.NewDesc(
@@ -33,32 +42,157 @@ var (
 		nil,
 		nil,
 	)
+	rawMetric = prometheus.NewDesc(
+		prometheus.BuildFQName("gpumon", "", "raw"),
+		"Raw values reported by intel_gpu_top",
+		[]string{"path", "unit"},
+		nil,
+	)
 )
 
 // An Aggregator collects the GPUStats received from intel_gpu_top and produces a consolidated sample to be reported to Prometheus.
-// Consolidation is done by calculating the median of each attribute.
+// Consolidation is done by calculating the median of each attribute (or as set by aggregation).
+//
+// Independently of Prometheus, the Aggregator keeps the samples received during the retention period, so Window can
+// report on recent samples, even after Reset.
+//
+// In raw mode, the Aggregator also keeps all numeric values found in the records, including the ones GPUStats doesn't model.
 type Aggregator struct {
 	lastUpdate atomic.Value
 	logger     *slog.Logger
 	stats      []igt.GPUStats
-	lock       sync.RWMutex
+	rawStats   [][]igt.RawValue
+	unknown    map[string]struct{}
+	dropped    map[string]struct{} // problems with units, already logged
+	validator  *validator
+	raw        bool
+	frozen     int // number of identical records after which the output is considered frozen. Zero disables detection.
+	// aggregation consolidates the samples. Defaults to the median.
+	aggregation Aggregation
+	// retention is how long samples are kept for Window. Zero disables Window.
+	retention time.Duration
+	recent    []timedStats
+	// stream, if set, receives each sample that is added
+	stream *broadcaster
+	lock   sync.RWMutex
+}
+
+// timedStats is a sample, with the time it was received.
+type timedStats struct {
+	time  time.Time
+	stats igt.GPUStats
 }
 
 // Read reads in all GPU stats from an io.Reader and adds them to the Aggregator.
-func (a *Aggregator) Read(r io.Reader) error {
+//
+// Read stops when ctx is canceled: once ctx is done, no further stats are added, even if r still holds buffered data.
+func (a *Aggregator) Read(ctx context.Context, r io.Reader) error {
 	a.logger.Debug("reading from new stream")
 	defer a.logger.Debug("stream closed")
+	if a.raw {
+		return a.readRaw(ctx, r)
+	}
+	frozen := frozenDetector{threshold: a.frozen}
 	for stat, err := range igt.ReadGPUStats(r) {
-		if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, igt.ErrFieldsDropped) {
+			a.reportDroppedFields(err)
+		} else if err != nil {
 			return fmt.Errorf("error while reading stats: %w", err)
 		}
+		if !a.validate(&stat) {
+			continue
+		}
+		if frozen.check(&stat) {
+			return fmt.Errorf("%w: %d identical records", errFrozen, frozen.count)
+		}
 		a.add(stat)
+		a.publish(stat)
 		a.lastUpdate.Store(time.Now())
 		//a.logger.Debug("found stats", "stat", stat)
 	}
 	return nil
 }
 
+func (a *Aggregator) readRaw(ctx context.Context, r io.Reader) error {
+	dec := igt.NewDecoder(r)
+	frozen := frozenDetector{threshold: a.frozen}
+	for {
+		var stat igt.GPUStats
+		raw, err := dec.DecodeRaw(&stat)
+		if ctx.Err() != nil {
+			return nil
+		}
+		switch {
+		case errors.Is(err, igt.ErrFieldsDropped):
+			a.reportDroppedFields(err)
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return fmt.Errorf("error while reading stats: %w", err)
+		}
+		a.reportUnknownSections(raw.UnknownSections())
+		if !a.validate(&stat) {
+			continue
+		}
+		if frozen.check(&stat) {
+			return fmt.Errorf("%w: %d identical records", errFrozen, frozen.count)
+		}
+		values := raw.Values()
+		if a.validator != nil {
+			a.validator.clampRaw(values)
+		}
+		a.addRaw(stat, values)
+		a.publish(stat)
+		a.lastUpdate.Store(time.Now())
+	}
+}
+
+// validate checks the sample before it's added. Returns false if the sample should be dropped.
+func (a *Aggregator) validate(stats *igt.GPUStats) bool {
+	return a.validator == nil || a.validator.validate(stats)
+}
+
+// publish sends the sample to the stream's subscribers.
+func (a *Aggregator) publish(stats igt.GPUStats) {
+	if a.stream != nil {
+		a.stream.publish(stats)
+	}
+}
+
+// reportUnknownSections logs any sections that intel_gpu_top reports, but that we don't model. Each section is only reported once.
+func (a *Aggregator) reportUnknownSections(sections []string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, section := range sections {
+		if _, ok := a.unknown[section]; ok {
+			continue
+		}
+		if a.unknown == nil {
+			a.unknown = make(map[string]struct{})
+		}
+		a.unknown[section] = struct{}{}
+		a.logger.Info("intel_gpu_top reports unknown section", "section", section)
+	}
+}
+
+// reportDroppedFields logs that intel_gpu_top reported values in an unknown or unexpected unit, which were dropped.
+// Each problem is only reported once.
+func (a *Aggregator) reportDroppedFields(err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.dropped[err.Error()]; ok {
+		return
+	}
+	if a.dropped == nil {
+		a.dropped = make(map[string]struct{})
+	}
+	a.dropped[err.Error()] = struct{}{}
+	a.logger.Warn("intel_gpu_top reports values in an unexpected unit: values dropped", "err", err)
+}
+
 // LastUpdate returns the timestamp when data was last received. Returns false if no data has been received yet.
 func (a *Aggregator) LastUpdate() (time.Time, bool) {
 	last := a.lastUpdate.Load()
@@ -71,8 +205,60 @@ func (a *Aggregator) LastUpdate() (time.Time, bool) {
 func (a *Aggregator) add(stats igt.GPUStats) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
-	// TODO: if no one is collecting, this will grow until OOM.  should we clear a certain number of measurements?
 	a.stats = append(a.stats, stats)
+	a.keepRecent(stats)
+}
+
+func (a *Aggregator) addRaw(stats igt.GPUStats, values []igt.RawValue) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.stats = append(a.stats, stats)
+	a.rawStats = append(a.rawStats, values)
+	a.keepRecent(stats)
+}
+
+// keepRecent adds the sample to the recent samples and drops the ones older than the retention period.
+// Must be called with the lock held.
+//
+// Without Prometheus scrapes (e.g. when only the history or a push exporter is used), stats is never reset. The samples
+// older than the retention period are dropped from stats as well, so it doesn't grow until OOM.
+func (a *Aggregator) keepRecent(stats igt.GPUStats) {
+	if a.retention == 0 {
+		return
+	}
+	now := time.Now()
+	expired, _ := slices.BinarySearchFunc(a.recent, now.Add(-a.retention), func(s timedStats, t time.Time) int {
+		return s.time.Compare(t)
+	})
+	a.recent = append(slices.Delete(a.recent, 0, expired), timedStats{time: now, stats: stats})
+	// stats holds the last samples received, so the ones beyond the recent samples have expired
+	if excess := len(a.stats) - len(a.recent); excess > 0 {
+		a.stats = slices.Delete(a.stats, 0, excess)
+	}
+	if excess := len(a.rawStats) - len(a.recent); excess > 0 {
+		a.rawStats = slices.Delete(a.rawStats, 0, excess)
+	}
+}
+
+// Window returns an Aggregator holding the samples received during the last window. Its accessors consolidate these
+// samples using aggregation. window can't exceed the Aggregator's retention period.
+func (a *Aggregator) Window(window time.Duration, aggregation Aggregation) *Aggregator {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	from, _ := slices.BinarySearchFunc(a.recent, time.Now().Add(-window), func(s timedStats, t time.Time) int {
+		return s.time.Compare(t)
+	})
+	w := Aggregator{logger: a.logger, aggregation: aggregation}
+	if w.logger == nil {
+		w.logger = slog.New(slog.DiscardHandler)
+	}
+	for _, sample := range a.recent[from:] {
+		w.stats = append(w.stats, sample.stats)
+	}
+	if len(w.stats) > 0 {
+		w.lastUpdate.Store(a.recent[len(a.recent)-1].time)
+	}
+	return &w
 }
 
 func (a *Aggregator) len() int {
@@ -88,14 +274,40 @@ func (a *Aggregator) Reset() {
 	if len(a.stats) > 0 {
 		a.stats = a.stats[:0]
 	}
+	if len(a.rawStats) > 0 {
+		a.rawStats = a.rawStats[:0]
+	}
+}
+
+// keepLast drops all GPU stats, except the last one.
+func (a *Aggregator) keepLast() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.stats) > 1 {
+		a.stats = a.stats[len(a.stats)-1:]
+	}
+	if len(a.rawStats) > 1 {
+		a.rawStats = a.rawStats[len(a.rawStats)-1:]
+	}
+	if len(a.recent) > 1 {
+		a.recent = a.recent[len(a.recent)-1:]
+	}
 }
 
 // PowerStats returns the median Power Stats for GPU & Package
 func (a *Aggregator) PowerStats() (float64, float64) {
 	a.lock.RLock()
 	defer a.lock.RUnlock()
-	return medianFunc(a.stats, func(stats igt.GPUStats) float64 { return stats.Power.GPU }),
-		medianFunc(a.stats, func(stats igt.GPUStats) float64 { return stats.Power.Package })
+	return aggregateFunc(a.aggregation, a.stats, func(stats igt.GPUStats) float64 { return stats.Power.GPU }),
+		aggregateFunc(a.aggregation, a.stats, func(stats igt.GPUStats) float64 { return stats.Power.Package })
+}
+
+// FrequencyStats returns the median requested & actual GPU frequency.
+func (a *Aggregator) FrequencyStats() (float64, float64) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return aggregateFunc(a.aggregation, a.stats, func(stats igt.GPUStats) float64 { return stats.Frequency.Requested }),
+		aggregateFunc(a.aggregation, a.stats, func(stats igt.GPUStats) float64 { return stats.Frequency.Actual })
 }
 
 // EngineStats returns the median GPU Stats for each of the GPU's engines.
@@ -120,9 +332,9 @@ func (a *Aggregator) EngineStats() EngineStats {
 	engineStats := make(EngineStats, len(statsByEngine))
 	for engine, stats := range statsByEngine {
 		engineStats[engine] = igt.EngineStats{
-			Busy: medianFunc(stats, func(stats igt.EngineStats) float64 { return stats.Busy }),
-			Sema: medianFunc(stats, func(stats igt.EngineStats) float64 { return stats.Sema }),
-			Wait: medianFunc(stats, func(stats igt.EngineStats) float64 { return stats.Wait }),
+			Busy: aggregateFunc(a.aggregation, stats, func(stats igt.EngineStats) float64 { return stats.Busy }),
+			Sema: aggregateFunc(a.aggregation, stats, func(stats igt.EngineStats) float64 { return stats.Sema }),
+			Wait: aggregateFunc(a.aggregation, stats, func(stats igt.EngineStats) float64 { return stats.Wait }),
 			Unit: stats[0].Unit,
 		}
 	}
@@ -136,34 +348,135 @@ func (a *Aggregator) EngineStats() EngineStats {
 func (a *Aggregator) ClientStats() float64 {
 	a.lock.RLock()
 	defer a.lock.RUnlock()
-	return medianFunc(a.stats, func(stats igt.GPUStats) float64 { return float64(len(stats.Clients)) })
+	return aggregateFunc(a.aggregation, a.stats, func(stats igt.GPUStats) float64 { return float64(len(stats.Clients)) })
+}
+
+// Clients returns the clients using the GPU in the last sample.
+func (a *Aggregator) Clients() map[string]igt.ClientStats {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if len(a.stats) == 0 {
+		return nil
+	}
+	return a.stats[len(a.stats)-1].Clients
+}
+
+// RawStats returns the median of each raw value, grouped by path and unit. Only available in raw mode.
+func (a *Aggregator) RawStats() []igt.RawValue {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	// group values by path & unit
+	type rawKey struct {
+		path string
+		unit igt.Unit
+	}
+	valuesByKey := make(map[rawKey][]float64)
+	for _, values := range a.rawStats {
+		for _, value := range values {
+			key := rawKey{path: value.Path, unit: value.Unit}
+			valuesByKey[key] = append(valuesByKey[key], value.Value)
+		}
+	}
+	rawStats := make([]igt.RawValue, 0, len(valuesByKey))
+	for key, values := range valuesByKey {
+		rawStats = append(rawStats, igt.RawValue{
+			Path:  key.path,
+			Unit:  key.unit,
+			Value: aggregateFunc(a.aggregation, values, func(f float64) float64 { return f }),
+		})
+	}
+	slices.SortFunc(rawStats, func(a, b igt.RawValue) int { return strings.Compare(a.Path, b.Path) })
+	return rawStats
 }
 
 // Describe implements the prometheus.Collector interface.
 func (a *Aggregator) Describe(ch chan<- *prometheus.Desc) {
 	ch <- engineMetric
+	ch <- engineClassMetric
 	ch <- powerMetric
 	ch <- clientMetric
+	if a.raw {
+		ch <- rawMetric
+	}
+	if a.validator != nil {
+		a.validator.Describe(ch)
+	}
 }
 
 // Collect implements the prometheus.Collector interface.
 func (a *Aggregator) Collect(ch chan<- prometheus.Metric) {
-	for engine, engineStats := range a.EngineStats() {
-		ch <- prometheus.MustNewConstMetric(engineMetric, prometheus.GaugeValue, engineStats.Busy, engine, "busy")
-		ch <- prometheus.MustNewConstMetric(engineMetric, prometheus.GaugeValue, engineStats.Sema, engine, "sema")
-		ch <- prometheus.MustNewConstMetric(engineMetric, prometheus.GaugeValue, engineStats.Wait, engine, "wait")
+	a.collect(ch)
+	if a.validator != nil {
+		a.validator.Collect(ch)
+	}
+	a.Reset()
+}
+
+// collect sends the metrics for the current GPU stats, without clearing them.
+func (a *Aggregator) collect(ch chan<- prometheus.Metric) {
+	engineStats := a.EngineStats()
+	for engine, stats := range engineStats {
+		class, instance := unknownEngineClass, ""
+		if e, err := igt.ParseEngine(engine); err == nil {
+			class, instance = e.Class, strconv.Itoa(e.Instance)
+		}
+		ch <- prometheus.MustNewConstMetric(engineMetric, prometheus.GaugeValue, stats.Busy, engine, string(class), instance, "busy")
+		ch <- prometheus.MustNewConstMetric(engineMetric, prometheus.GaugeValue, stats.Sema, engine, string(class), instance, "sema")
+		ch <- prometheus.MustNewConstMetric(engineMetric, prometheus.GaugeValue, stats.Wait, engine, string(class), instance, "wait")
+	}
+	for class, stats := range engineStats.ByClass() {
+		ch <- prometheus.MustNewConstMetric(engineClassMetric, prometheus.GaugeValue, stats.Busy, string(class), "busy")
+		ch <- prometheus.MustNewConstMetric(engineClassMetric, prometheus.GaugeValue, stats.Sema, string(class), "sema")
+		ch <- prometheus.MustNewConstMetric(engineClassMetric, prometheus.GaugeValue, stats.Wait, string(class), "wait")
 	}
 	gpuPower, packagePower := a.PowerStats()
 	ch <- prometheus.MustNewConstMetric(powerMetric, prometheus.GaugeValue, packagePower, "pkg")
 	ch <- prometheus.MustNewConstMetric(powerMetric, prometheus.GaugeValue, gpuPower, "gpu")
 	ch <- prometheus.MustNewConstMetric(clientMetric, prometheus.GaugeValue, a.ClientStats())
-	a.Reset()
+	if a.raw {
+		for _, value := range a.RawStats() {
+			ch <- prometheus.MustNewConstMetric(rawMetric, prometheus.GaugeValue, value.Value, value.Path, string(value.Unit))
+		}
+	}
 }
 
 var _ slog.LogValuer = EngineStats{}
 
+// EngineStats contains the statistics for each engine, keyed by the engine name reported by intel_gpu_top.
 type EngineStats map[string]igt.EngineStats
 
+// unknownEngineClass is the engine_class label for engines that igt.ParseEngine does not recognize.
+const unknownEngineClass igt.EngineClass = "unknown"
+
+// ByClass rolls up the statistics of all engines of the same class (e.g. "Video/0" and "Video/1") by averaging them.
+// Engines with an unknown class are ignored.
+func (e EngineStats) ByClass() map[igt.EngineClass]igt.EngineStats {
+	statsByClass := make(map[igt.EngineClass]igt.EngineStats)
+	instances := make(map[igt.EngineClass]int)
+	for engineName, engineStats := range e {
+		engine, err := igt.ParseEngine(engineName)
+		if err != nil {
+			continue
+		}
+		stats := statsByClass[engine.Class]
+		stats.Busy += engineStats.Busy
+		stats.Sema += engineStats.Sema
+		stats.Wait += engineStats.Wait
+		stats.Unit = engineStats.Unit
+		statsByClass[engine.Class] = stats
+		instances[engine.Class]++
+	}
+	for class, stats := range statsByClass {
+		n := float64(instances[class])
+		stats.Busy /= n
+		stats.Sema /= n
+		stats.Wait /= n
+		statsByClass[class] = stats
+	}
+	return statsByClass
+}
+
 func (e EngineStats) LogValue() slog.Value {
 	engineNames := make([]string, 0, len(e))
 	for engineName := range e {
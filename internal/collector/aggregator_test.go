@@ -1,7 +1,9 @@
 package collector
 
 import (
+	"bytes"
 	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	igttestutil "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top/testutil"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -19,7 +21,7 @@ func TestAggregator(t *testing.T) {
 	r, _ := fake.Start(t.Context(), nil)
 	var a Aggregator
 	a.logger = slog.New(slog.DiscardHandler)
-	go func() { assert.NoError(t, a.Read(r)) }()
+	go func() { assert.NoError(t, a.Read(t.Context(), r)) }()
 
 	// a.Read works asynchronously. Wait for all data to be read.
 	assert.Eventually(t, func() bool { return len(a.EngineStats()) >= payloadCount }, time.Second, time.Millisecond)
@@ -30,8 +32,8 @@ func TestAggregator(t *testing.T) {
 	require.Len(t, engineStats, len(wantEngines))
 	for i, engineName := range wantEngines {
 		assert.Contains(t, engineStats, engineName)
-		assert.Equal(t, float64(i+1), engineStats[engineName].Busy)
-		assert.Equal(t, "%", engineStats[engineName].Unit)
+		assert.Equal(t, float64(i+1)/100, engineStats[engineName].Busy)
+		assert.Equal(t, igt.UnitRatio, engineStats[engineName].Unit)
 	}
 
 	assert.Equal(t, 1.0, a.ClientStats())
@@ -40,6 +42,20 @@ func TestAggregator(t *testing.T) {
 	assert.Equal(t, 4.0, pkg)
 }
 
+func TestAggregator_Read_droppedFields(t *testing.T) {
+	var logs bytes.Buffer
+	a := Aggregator{logger: slog.New(slog.NewTextHandler(&logs, nil))}
+	const record = `{ "power": { "GPU": 1, "unit": "hp" }, "engines": { "Video": { "busy": 50, "unit": "%" } } }`
+	require.NoError(t, a.Read(t.Context(), strings.NewReader(record+record+record)))
+
+	// the records are kept, without the value in an unknown unit, and the problem is only logged once
+	assert.Equal(t, 0.5, a.EngineStats()["Video"].Busy)
+	gpu, _ := a.PowerStats()
+	assert.Zero(t, gpu)
+	assert.Equal(t, 1, strings.Count(logs.String(), "unexpected unit"))
+	assert.Contains(t, logs.String(), `power: unknown unit: \"hp\"`)
+}
+
 func TestAggregator_Reset(t *testing.T) {
 	var a Aggregator
 	a.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
@@ -62,7 +78,7 @@ func TestAggregator_Collect(t *testing.T) {
 	r, _ := fake.Start(t.Context(), nil)
 	var a Aggregator
 	a.logger = slog.New(slog.DiscardHandler)
-	go func() { assert.NoError(t, a.Read(r)) }()
+	go func() { assert.NoError(t, a.Read(t.Context(), r)) }()
 
 	// wait for the aggregator to read in the data
 	assert.Eventually(t, func() bool { return a.len() > 0 }, time.Second, time.Millisecond)
@@ -72,20 +88,35 @@ func TestAggregator_Collect(t *testing.T) {
 # TYPE gpumon_clients_count gauge
 gpumon_clients_count 1
 
-# HELP gpumon_engine_usage Usage statistics for the different GPU engines
-# TYPE gpumon_engine_usage gauge
-gpumon_engine_usage{attrib="busy",engine="Blitter"} 2
-gpumon_engine_usage{attrib="busy",engine="Render/3D"} 1
-gpumon_engine_usage{attrib="busy",engine="Video"} 3
-gpumon_engine_usage{attrib="busy",engine="VideoEnhance"} 4
-gpumon_engine_usage{attrib="sema",engine="Blitter"} 0
-gpumon_engine_usage{attrib="sema",engine="Render/3D"} 0
-gpumon_engine_usage{attrib="sema",engine="Video"} 0
-gpumon_engine_usage{attrib="sema",engine="VideoEnhance"} 0
-gpumon_engine_usage{attrib="wait",engine="Blitter"} 0
-gpumon_engine_usage{attrib="wait",engine="Render/3D"} 0
-gpumon_engine_usage{attrib="wait",engine="Video"} 0
-gpumon_engine_usage{attrib="wait",engine="VideoEnhance"} 0
+# HELP gpumon_engine_class_usage_ratio Average usage statistics of all GPU engines in a class, as a ratio (0-1)
+# TYPE gpumon_engine_class_usage_ratio gauge
+gpumon_engine_class_usage_ratio{attrib="busy",engine_class="copy"} 0.02
+gpumon_engine_class_usage_ratio{attrib="busy",engine_class="render"} 0.01
+gpumon_engine_class_usage_ratio{attrib="busy",engine_class="video"} 0.03
+gpumon_engine_class_usage_ratio{attrib="busy",engine_class="video_enhance"} 0.04
+gpumon_engine_class_usage_ratio{attrib="sema",engine_class="copy"} 0
+gpumon_engine_class_usage_ratio{attrib="sema",engine_class="render"} 0
+gpumon_engine_class_usage_ratio{attrib="sema",engine_class="video"} 0
+gpumon_engine_class_usage_ratio{attrib="sema",engine_class="video_enhance"} 0
+gpumon_engine_class_usage_ratio{attrib="wait",engine_class="copy"} 0
+gpumon_engine_class_usage_ratio{attrib="wait",engine_class="render"} 0
+gpumon_engine_class_usage_ratio{attrib="wait",engine_class="video"} 0
+gpumon_engine_class_usage_ratio{attrib="wait",engine_class="video_enhance"} 0
+
+# HELP gpumon_engine_usage_ratio Usage statistics for the different GPU engines, as a ratio (0-1)
+# TYPE gpumon_engine_usage_ratio gauge
+gpumon_engine_usage_ratio{attrib="busy",engine="Blitter",engine_class="copy",engine_instance="0"} 0.02
+gpumon_engine_usage_ratio{attrib="busy",engine="Render/3D",engine_class="render",engine_instance="0"} 0.01
+gpumon_engine_usage_ratio{attrib="busy",engine="Video",engine_class="video",engine_instance="0"} 0.03
+gpumon_engine_usage_ratio{attrib="busy",engine="VideoEnhance",engine_class="video_enhance",engine_instance="0"} 0.04
+gpumon_engine_usage_ratio{attrib="sema",engine="Blitter",engine_class="copy",engine_instance="0"} 0
+gpumon_engine_usage_ratio{attrib="sema",engine="Render/3D",engine_class="render",engine_instance="0"} 0
+gpumon_engine_usage_ratio{attrib="sema",engine="Video",engine_class="video",engine_instance="0"} 0
+gpumon_engine_usage_ratio{attrib="sema",engine="VideoEnhance",engine_class="video_enhance",engine_instance="0"} 0
+gpumon_engine_usage_ratio{attrib="wait",engine="Blitter",engine_class="copy",engine_instance="0"} 0
+gpumon_engine_usage_ratio{attrib="wait",engine="Render/3D",engine_class="render",engine_instance="0"} 0
+gpumon_engine_usage_ratio{attrib="wait",engine="Video",engine_class="video",engine_instance="0"} 0
+gpumon_engine_usage_ratio{attrib="wait",engine="VideoEnhance",engine_class="video_enhance",engine_instance="0"} 0
 
 # HELP gpumon_power Power consumption by type
 # TYPE gpumon_power gauge
@@ -94,6 +125,95 @@ gpumon_power{type="pkg"} 4
 `)))
 }
 
+func TestAggregator_Raw(t *testing.T) {
+	a := Aggregator{logger: slog.New(slog.DiscardHandler), raw: true}
+	input := igttestutil.SinglePayload + `{ "power": { "GPU": 3, "unit": "W" }, "new-section": { "value": 12.5, "unit": "mW" } }`
+	require.NoError(t, a.Read(t.Context(), strings.NewReader(input)))
+	assert.Contains(t, a.unknown, "new-section")
+
+	assert.NoError(t, testutil.CollectAndCompare(&a, strings.NewReader(`
+# HELP gpumon_raw Raw values reported by intel_gpu_top
+# TYPE gpumon_raw gauge
+gpumon_raw{path="engines.Blitter.busy",unit="ratio"} 0.02
+gpumon_raw{path="engines.Blitter.sema",unit="ratio"} 0
+gpumon_raw{path="engines.Blitter.wait",unit="ratio"} 0
+gpumon_raw{path="engines.Render/3D.busy",unit="ratio"} 0.01
+gpumon_raw{path="engines.Render/3D.sema",unit="ratio"} 0
+gpumon_raw{path="engines.Render/3D.wait",unit="ratio"} 0
+gpumon_raw{path="engines.Video.busy",unit="ratio"} 0.03
+gpumon_raw{path="engines.Video.sema",unit="ratio"} 0
+gpumon_raw{path="engines.Video.wait",unit="ratio"} 0
+gpumon_raw{path="engines.VideoEnhance.busy",unit="ratio"} 0.04
+gpumon_raw{path="engines.VideoEnhance.sema",unit="ratio"} 0
+gpumon_raw{path="engines.VideoEnhance.wait",unit="ratio"} 0
+gpumon_raw{path="frequency.actual",unit="Hz"} 0
+gpumon_raw{path="frequency.requested",unit="Hz"} 0
+gpumon_raw{path="imc-bandwidth.reads",unit="B/s"} 5.27897813057536e+08
+gpumon_raw{path="imc-bandwidth.writes",unit="B/s"} 5.3808438706176e+07
+gpumon_raw{path="interrupts.count",unit="irq/s"} 0
+gpumon_raw{path="new-section.value",unit="W"} 0.0125
+gpumon_raw{path="period.duration",unit="s"} 1.048677745
+gpumon_raw{path="power.GPU",unit="W"} 2
+gpumon_raw{path="power.Package",unit="W"} 4
+gpumon_raw{path="rc6.value",unit="ratio"} 0.99999597
+`), "gpumon_raw"))
+	assert.Empty(t, a.rawStats)
+}
+
+func TestAggregator_Window(t *testing.T) {
+	a := Aggregator{logger: slog.New(slog.DiscardHandler), retention: time.Hour}
+	for i := range 4 {
+		var stat igt.GPUStats
+		stat.Power.GPU = float64(i + 1)
+		stat.Frequency.Actual = float64(100 * (i + 1))
+		a.add(stat)
+	}
+	// samples outside the retention period are dropped
+	a.recent[0].time = time.Now().Add(-2 * time.Hour)
+	a.add(igt.GPUStats{})
+	require.Len(t, a.recent, 4)
+	// samples outside the window are ignored
+	a.recent[0].time = time.Now().Add(-time.Minute)
+
+	// the window is independent of Prometheus
+	a.Reset()
+	w := a.Window(30*time.Second, AggregationMax)
+	assert.Equal(t, 3, w.len())
+	gpu, _ := w.PowerStats()
+	assert.Equal(t, 4.0, gpu)
+	_, actual := w.FrequencyStats()
+	assert.Equal(t, 400.0, actual)
+	_, ok := w.LastUpdate()
+	assert.True(t, ok)
+
+	w = a.Window(30*time.Second, AggregationLast)
+	gpu, _ = w.PowerStats()
+	assert.Zero(t, gpu)
+
+	_, ok = (&Aggregator{}).Window(time.Minute, AggregationMedian).LastUpdate()
+	assert.False(t, ok)
+}
+
+func TestAggregator_retention(t *testing.T) {
+	a := Aggregator{logger: slog.New(slog.DiscardHandler), raw: true, retention: time.Hour}
+	for range 1000 {
+		a.addRaw(igt.GPUStats{}, []igt.RawValue{{Value: 1}})
+	}
+	assert.Equal(t, 1000, a.len())
+
+	// without scrapes, samples older than the retention period are dropped
+	for i := range a.recent {
+		a.recent[i].time = time.Now().Add(-2 * time.Hour)
+	}
+	for range 1000 {
+		a.addRaw(igt.GPUStats{}, []igt.RawValue{{Value: 2}})
+	}
+	assert.Equal(t, 1000, a.len())
+	require.Len(t, a.rawStats, 1000)
+	assert.Equal(t, 2.0, a.rawStats[0][0].Value)
+	assert.Len(t, a.recent, 1000)
+}
+
 func TestEngineStats_LogValue(t *testing.T) {
 	stats := EngineStats{
 		"FOO": {},
@@ -104,6 +224,20 @@ func TestEngineStats_LogValue(t *testing.T) {
 	assert.Equal(t, "", stats.LogValue().String())
 }
 
+func TestEngineStats_ByClass(t *testing.T) {
+	stats := EngineStats{
+		"Render/3D": {Busy: 0.5, Unit: igt.UnitRatio},
+		"Video/0":   {Busy: 0.2, Sema: 0.1, Unit: igt.UnitRatio},
+		"Video/1":   {Busy: 0.4, Sema: 0.3, Unit: igt.UnitRatio},
+		"Foo":       {Busy: 1},
+	}
+	byClass := stats.ByClass()
+	require.Len(t, byClass, 2)
+	assert.Equal(t, igt.EngineStats{Busy: 0.5, Unit: igt.UnitRatio}, byClass[igt.EngineClassRender])
+	assert.InDelta(t, 0.3, byClass[igt.EngineClassVideo].Busy, 1e-9)
+	assert.InDelta(t, 0.2, byClass[igt.EngineClassVideo].Sema, 1e-9)
+}
+
 func Test_medianFunc(t *testing.T) {
 	tests := []struct {
 		name   string
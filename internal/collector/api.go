@@ -0,0 +1,217 @@
+package collector
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/rmarchant/intel-gpu-exporter/internal/web"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultStatsWindow is the window the stats API reports on, if none is requested.
+	defaultStatsWindow = 10 * time.Second
+	// MaxStatsWindow is the longest window statistics can be reported on. Samples are kept for this long.
+	MaxStatsWindow = 5 * time.Minute
+)
+
+// DeviceStats contains the GPU statistics of one device (the local host or a remote target), consolidated over a window.
+// Engine usage is a ratio (0-1), power is in watts and frequencies are in Hz.
+type DeviceStats struct {
+	Name          string                          `json:"name"`
+	State         SourceState                     `json:"state"`
+	LastUpdate    *time.Time                      `json:"last_update,omitempty"`
+	Samples       int                             `json:"samples"`
+	Engines       map[string]EngineUsage          `json:"engines"`
+	EngineClasses map[igt.EngineClass]EngineUsage `json:"engine_classes"`
+	Power         PowerUsage                      `json:"power"`
+	Frequency     Frequency                       `json:"frequency"`
+	Clients       ClientUsage                     `json:"clients"`
+}
+
+// EngineUsage is the usage of an engine, or of all engines in a class.
+type EngineUsage struct {
+	Busy float64 `json:"busy"`
+	Sema float64 `json:"sema"`
+	Wait float64 `json:"wait"`
+}
+
+// PowerUsage is the power consumption of the GPU and the package.
+type PowerUsage struct {
+	GPU     float64 `json:"gpu_watts"`
+	Package float64 `json:"package_watts"`
+}
+
+// Frequency is the requested and actual GPU frequency.
+type Frequency struct {
+	Requested float64 `json:"requested_hz"`
+	Actual    float64 `json:"actual_hz"`
+}
+
+// ClientUsage contains the number of clients over the window and the clients using the GPU in the last sample.
+type ClientUsage struct {
+	Count  float64  `json:"count"`
+	Active []Client `json:"active"`
+}
+
+// Client is a process using the GPU. Busy contains its usage (0-1) of each engine class, keyed like EngineClasses.
+type Client struct {
+	PID  string                      `json:"pid"`
+	Name string                      `json:"name"`
+	Busy map[igt.EngineClass]float64 `json:"busy"`
+}
+
+// newDeviceStats consolidates the samples of an Aggregator, as returned by Aggregator.Window.
+func newDeviceStats(status SourceStatus, a *Aggregator) DeviceStats {
+	stats := DeviceStats{
+		Name:          status.Name,
+		State:         status.State,
+		LastUpdate:    status.LastUpdate,
+		Samples:       a.len(),
+		Engines:       make(map[string]EngineUsage),
+		EngineClasses: make(map[igt.EngineClass]EngineUsage),
+		Clients:       ClientUsage{Count: a.ClientStats(), Active: make([]Client, 0)},
+	}
+	engineStats := a.EngineStats()
+	for engine, usage := range engineStats {
+		stats.Engines[engine] = EngineUsage{Busy: usage.Busy, Sema: usage.Sema, Wait: usage.Wait}
+	}
+	for class, usage := range engineStats.ByClass() {
+		stats.EngineClasses[class] = EngineUsage{Busy: usage.Busy, Sema: usage.Sema, Wait: usage.Wait}
+	}
+	stats.Power.GPU, stats.Power.Package = a.PowerStats()
+	stats.Frequency.Requested, stats.Frequency.Actual = a.FrequencyStats()
+	for _, client := range a.Clients() {
+		c := Client{PID: client.Pid, Name: client.Name, Busy: make(map[igt.EngineClass]float64, len(client.EngineClasses))}
+		for className, usage := range client.EngineClasses {
+			// like EngineStats.ByClass, classes that can't be parsed are ignored
+			if engine, err := igt.ParseEngine(className); err == nil {
+				c.Busy[engine.Class] += usage.Unit.ToBase(usage.Busy)
+			}
+		}
+		stats.Clients.Active = append(stats.Clients.Active, c)
+	}
+	slices.SortFunc(stats.Clients.Active, func(a, b Client) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.PID, b.PID))
+	})
+	return stats
+}
+
+// statsReporter reports the GPU statistics of a source.
+type statsReporter interface {
+	statusReporter
+	Stats(window time.Duration, aggregation Aggregation) DeviceStats
+	// samples returns the broadcaster that sends each sample the source receives.
+	samples() *broadcaster
+	// subscribed is called regularly while stream clients are subscribed to the samples, so the source keeps producing
+	// them.
+	subscribed()
+}
+
+// Source reports the GPU statistics of each device, e.g. the API. It is used by the exporters pushing the statistics.
+type Source interface {
+	Devices(window time.Duration, aggregation Aggregation) []DeviceStats
+}
+
+// API serves the current GPU statistics as JSON.
+type API struct {
+	lock    sync.RWMutex
+	sources []statsReporter
+	done    chan struct{}
+	close   sync.Once
+}
+
+// NewAPI returns a new API. Its sources are added by Run.
+func NewAPI() *API {
+	return &API{done: make(chan struct{})}
+}
+
+// Close ends all open streams.
+func (a *API) Close() {
+	a.close.Do(func() { close(a.done) })
+}
+
+func (a *API) closed() <-chan struct{} {
+	return a.done
+}
+
+func (a *API) add(source statsReporter) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.sources = append(a.sources, source)
+}
+
+// Devices returns the GPU statistics of each device, consolidated over window.
+func (a *API) Devices(window time.Duration, aggregation Aggregation) []DeviceStats {
+	a.lock.RLock()
+	sources := slices.Clone(a.sources)
+	a.lock.RUnlock()
+
+	devices := make([]DeviceStats, 0, len(sources))
+	for _, source := range sources {
+		devices = append(devices, source.Stats(window, aggregation))
+	}
+	return devices
+}
+
+// statsResponse is the body of the /api/v1/stats response.
+type statsResponse struct {
+	Version     string        `json:"version"`
+	Window      string        `json:"window"`
+	Aggregation Aggregation   `json:"aggregation"`
+	Devices     []DeviceStats `json:"devices"`
+}
+
+// Stats returns the GPU statistics of each device, consolidated over a window. The following query parameters are supported:
+//
+//   - window: the duration to report on (e.g. 30s). Defaults to 10s, maximum 5m.
+//   - aggregation: how samples are consolidated: median (the default), mean, min, max or last.
+//   - device: only report the device with this name.
+func (a *API) Stats(w http.ResponseWriter, req *http.Request) {
+	window, aggregation, err := parseStatsQuery(req)
+	if err != nil {
+		web.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	device := req.URL.Query().Get("device")
+
+	a.lock.RLock()
+	sources := slices.Clone(a.sources)
+	a.lock.RUnlock()
+
+	response := statsResponse{Version: web.APIVersion, Window: window.String(), Aggregation: aggregation, Devices: make([]DeviceStats, 0, len(sources))}
+	for _, source := range sources {
+		if device == "" || source.Status().Name == device {
+			response.Devices = append(response.Devices, source.Stats(window, aggregation))
+		}
+	}
+	if device != "" && len(response.Devices) == 0 {
+		web.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown device %q", device))
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, response)
+}
+
+func parseStatsQuery(req *http.Request) (time.Duration, Aggregation, error) {
+	query := req.URL.Query()
+	window, aggregation := defaultStatsWindow, AggregationMedian
+	if value := query.Get("window"); value != "" {
+		var err error
+		if window, err = time.ParseDuration(value); err != nil {
+			return 0, "", fmt.Errorf("invalid window %q", value)
+		}
+		if window <= 0 || window > MaxStatsWindow {
+			return 0, "", fmt.Errorf("window must be between 0 and %s", MaxStatsWindow)
+		}
+	}
+	if value := query.Get("aggregation"); value != "" {
+		var err error
+		if aggregation, err = ParseAggregation(value); err != nil {
+			return 0, "", err
+		}
+	}
+	return window, aggregation, nil
+}
@@ -0,0 +1,133 @@
+package collector
+
+import (
+	"github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPI_Stats(t *testing.T) {
+	a := Aggregator{logger: slog.New(slog.DiscardHandler), retention: MaxStatsWindow}
+	require.NoError(t, a.Read(t.Context(), strings.NewReader(testutil.SinglePayload+testutil.SinglePayload)))
+	// the API doesn't depend on Prometheus scrapes
+	a.Reset()
+
+	api := NewAPI()
+	api.add(fakeStatsReporter{name: "nuc1", aggregator: &a})
+	api.add(fakeStatsReporter{name: "nuc2", aggregator: &Aggregator{}})
+
+	w := httptest.NewRecorder()
+	api.Stats(w, httptest.NewRequest(http.MethodGet, "/api/v1/stats?window=1m&aggregation=max&device=nuc1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{
+  "version": "v1",
+  "window": "1m0s",
+  "aggregation": "max",
+  "devices": [{
+    "name": "nuc1",
+    "state": "running",
+    "samples": 2,
+    "engines": {
+      "Blitter": {"busy": 0.02, "sema": 0, "wait": 0},
+      "Render/3D": {"busy": 0.01, "sema": 0, "wait": 0},
+      "Video": {"busy": 0.03, "sema": 0, "wait": 0},
+      "VideoEnhance": {"busy": 0.04, "sema": 0, "wait": 0}
+    },
+    "engine_classes": {
+      "copy": {"busy": 0.02, "sema": 0, "wait": 0},
+      "render": {"busy": 0.01, "sema": 0, "wait": 0},
+      "video": {"busy": 0.03, "sema": 0, "wait": 0},
+      "video_enhance": {"busy": 0.04, "sema": 0, "wait": 0}
+    },
+    "power": {"gpu_watts": 1, "package_watts": 4},
+    "frequency": {"requested_hz": 0, "actual_hz": 0},
+    "clients": {
+      "count": 1,
+      "active": [{"pid": "1427673", "name": "foo", "busy": {"copy": 0, "render": 0, "video": 0, "video_enhance": 0}}]
+    }
+  }]
+}`, w.Body.String())
+}
+
+func TestAPI_Stats_Query(t *testing.T) {
+	api := NewAPI()
+	api.add(fakeStatsReporter{name: "local", aggregator: &Aggregator{}})
+
+	tests := []struct {
+		query    string
+		wantCode int
+		wantBody string
+	}{
+		{query: "", wantCode: http.StatusOK, wantBody: `"window":"10s","aggregation":"median"`},
+		{query: "?window=5m&aggregation=last", wantCode: http.StatusOK, wantBody: `"window":"5m0s","aggregation":"last"`},
+		{query: "?window=1h", wantCode: http.StatusBadRequest, wantBody: `"error":"window must be between 0 and 5m0s"`},
+		{query: "?window=soon", wantCode: http.StatusBadRequest, wantBody: `"error":"invalid window \"soon\""`},
+		{query: "?aggregation=p99", wantCode: http.StatusBadRequest, wantBody: `"error":"invalid aggregation \"p99\""`},
+		{query: "?device=nuc1", wantCode: http.StatusNotFound, wantBody: `"error":"unknown device \"nuc1\""`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			api.Stats(w, httptest.NewRequest(http.MethodGet, "/api/v1/stats"+tt.query, nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.wantBody)
+		})
+	}
+}
+
+func TestTopReader_Stats(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := NewTopReader(l, Config{Interval: 10 * time.Millisecond, Lazy: true, IdleTimeout: time.Minute})
+	r.topRunner = &fakeRunner{interval: 10 * time.Millisecond}
+	go func() { assert.NoError(t, r.Run(t.Context())) }()
+
+	// in lazy mode, the API starts intel_gpu_top
+	var stats DeviceStats
+	assert.Eventually(t, func() bool {
+		stats = r.Stats(time.Minute, AggregationMedian)
+		return stats.Samples > 0 && stats.State == SourceRunning
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, localSource, stats.Name)
+	assert.Len(t, stats.Engines, 4)
+}
+
+type fakeStatsReporter struct {
+	name       string
+	aggregator *Aggregator
+}
+
+func (f fakeStatsReporter) Status() SourceStatus {
+	return SourceStatus{Name: f.name, State: SourceRunning}
+}
+
+func (f fakeStatsReporter) Stats(window time.Duration, aggregation Aggregation) DeviceStats {
+	return newDeviceStats(f.Status(), f.aggregator.Window(window, aggregation))
+}
+
+func (f fakeStatsReporter) samples() *broadcaster {
+	return f.aggregator.stream
+}
+
+func (f fakeStatsReporter) subscribed() {}
+
+func TestAPI_Devices(t *testing.T) {
+	a := Aggregator{logger: slog.New(slog.DiscardHandler), retention: MaxStatsWindow}
+	require.NoError(t, a.Read(t.Context(), strings.NewReader(testutil.SinglePayload)))
+
+	api := NewAPI()
+	api.add(fakeStatsReporter{name: "nuc1", aggregator: &a})
+	api.add(fakeStatsReporter{name: "nuc2", aggregator: &Aggregator{}})
+	devices := api.Devices(time.Minute, AggregationLast)
+	require.Len(t, devices, 2)
+	assert.Equal(t, "nuc1", devices[0].Name)
+	assert.Equal(t, 1.0, devices[0].Power.GPU)
+	assert.Equal(t, "nuc2", devices[1].Name)
+	assert.Zero(t, devices[1].Samples)
+}
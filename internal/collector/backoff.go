@@ -0,0 +1,42 @@
+package collector
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// backoff calculates how long to wait before restarting intel_gpu_top. The delay doubles after each consecutive failure,
+// up to a maximum. A random jitter of up to ±20% prevents several exporters from restarting in lockstep.
+type backoff struct {
+	min      time.Duration
+	max      time.Duration
+	failures int
+	jitter   func() float64 // returns a value in [0, 1). Overridden during testing.
+}
+
+const backoffJitter = 0.2
+
+// next records a failure and returns the delay before the next attempt.
+func (b *backoff) next() time.Duration {
+	delay := b.min
+	for range b.failures {
+		if delay >= b.max/2 {
+			delay = b.max
+			break
+		}
+		delay *= 2
+	}
+	b.failures++
+
+	jitter := rand.Float64
+	if b.jitter != nil {
+		jitter = b.jitter
+	}
+	delay = time.Duration(float64(delay) * (1 + backoffJitter*(2*jitter()-1)))
+	return min(delay, b.max)
+}
+
+// reset clears the failure count, so the next failure is retried after the minimum delay.
+func (b *backoff) reset() {
+	b.failures = 0
+}
@@ -0,0 +1,37 @@
+package collector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: time.Second, max: 10 * time.Second, jitter: func() float64 { return 0.5 }}
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		assert.Equal(t, want, b.next())
+	}
+	assert.Equal(t, 6, b.failures)
+	b.reset()
+	assert.Equal(t, time.Second, b.next())
+}
+
+func TestBackoff_Jitter(t *testing.T) {
+	b := backoff{min: time.Second, max: time.Minute, jitter: func() float64 { return 0 }}
+	assert.Equal(t, 800*time.Millisecond, b.next())
+	b = backoff{min: time.Second, max: time.Minute, jitter: func() float64 { return 0.999999 }}
+	assert.InDelta(t, 1200*time.Millisecond, b.next(), float64(time.Millisecond))
+
+	// jitter never exceeds the maximum delay
+	b = backoff{min: time.Minute, max: time.Minute, jitter: func() float64 { return 0.999999 }}
+	assert.Equal(t, time.Minute, b.next())
+
+	// default jitter
+	b = backoff{min: time.Second, max: time.Minute}
+	for range 100 {
+		b.reset()
+		delay := b.next()
+		assert.GreaterOrEqual(t, delay, 800*time.Millisecond)
+		assert.LessOrEqual(t, delay, 1200*time.Millisecond)
+	}
+}
@@ -0,0 +1,189 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultBinary is the intel_gpu_top binary that's run if Command doesn't specify one.
+const defaultBinary = "intel_gpu_top"
+
+// placeholders that can be used in a Command
+const (
+	placeholderInterval = "{interval_ms}"
+	placeholderDevice   = "{device}"
+)
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*}`)
+
+// Command is the template of the command that runs intel_gpu_top. It produces the following command line:
+//
+//	<Wrapper...> <Binary> [-d <Device>] -J -s {interval_ms} <Args...>
+//
+// The placeholders {interval_ms} and {device} are replaced in all fields, so they can also be used in the wrapper
+// (e.g. "ssh host intel_gpu_top -s {interval_ms}"), the environment or the working directory.
+type Command struct {
+	// Binary is the path of intel_gpu_top. Defaults to "intel_gpu_top".
+	Binary string
+	// Wrapper is the command that runs intel_gpu_top, e.g. sudo, nsenter or ssh.
+	Wrapper []string
+	// Args are added to intel_gpu_top's arguments.
+	Args []string
+	// Env contains additional environment variables (KEY=VALUE) for the command.
+	Env []string
+	// Dir is the working directory of the command.
+	Dir string
+	// Device is intel_gpu_top's device filter (-d). If empty, intel_gpu_top selects the device.
+	Device string
+}
+
+// reservedOptions are intel_gpu_top's options that are set by the exporter and can't be part of Command.Args, in any
+// form: -s 100, -s100, -Js100 or --json.
+var (
+	reservedOptions     = "Jsnd"
+	reservedLongOptions = []string{"--json"}
+	// optionsWithValue are intel_gpu_top's options that take a value.
+	optionsWithValue = "sndo"
+)
+
+// Validate checks that the command template is valid.
+func (c Command) Validate() error {
+	var errs []error
+	for _, field := range c.fields() {
+		for _, placeholder := range placeholderPattern.FindAllString(field, -1) {
+			switch {
+			case placeholder == placeholderDevice && c.Device == "":
+				errs = append(errs, fmt.Errorf("%q: %s requires a device", field, placeholderDevice))
+			case placeholder != placeholderInterval && placeholder != placeholderDevice:
+				errs = append(errs, fmt.Errorf("%q: unknown placeholder %s", field, placeholder))
+			}
+		}
+	}
+	for _, arg := range reservedArgs(c.Args) {
+		errs = append(errs, fmt.Errorf("argument %s is set by the exporter", arg))
+	}
+	for _, env := range c.Env {
+		if key, _, ok := strings.Cut(env, "="); !ok || key == "" {
+			errs = append(errs, fmt.Errorf("environment variable %q: must be KEY=VALUE", env))
+		}
+	}
+	if c.Dir != "" && !strings.Contains(c.Dir, "{") {
+		if info, err := os.Stat(c.Dir); err != nil {
+			errs = append(errs, fmt.Errorf("working directory: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("working directory %q: not a directory", c.Dir))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid command: %w", err)
+	}
+	return nil
+}
+
+// reservedArgs returns the arguments that set one of the reservedOptions. Short options are parsed like getopt does:
+// several options can be combined in one argument, and the value of an option can follow it directly.
+func reservedArgs(args []string) []string {
+	var reserved []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if name, _, _ := strings.Cut(arg, "="); slices.Contains(reservedLongOptions, name) {
+			reserved = append(reserved, arg)
+			continue
+		}
+		if arg == "--" {
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' || arg[1] == '-' {
+			continue
+		}
+		for j, option := range arg[1:] {
+			if strings.ContainsRune(reservedOptions, option) {
+				reserved = append(reserved, arg)
+				break
+			}
+			if strings.ContainsRune(optionsWithValue, option) {
+				if j == len(arg)-2 {
+					// the value is the next argument
+					i++
+				}
+				break
+			}
+		}
+	}
+	return reserved
+}
+
+// Resolve returns the command with the executable it runs (the wrapper, or intel_gpu_top itself) resolved to its path,
+// so a missing executable is reported at startup rather than on every start.
+func (c Command) Resolve() (Command, error) {
+	executable := &c.Binary
+	if len(c.Wrapper) > 0 {
+		c.Wrapper = slices.Clone(c.Wrapper)
+		executable = &c.Wrapper[0]
+	} else if c.Binary == "" {
+		c.Binary = defaultBinary
+	}
+	// an executable relative to the working directory is resolved when the command starts
+	if strings.Contains(*executable, "{") || (c.Dir != "" && strings.Contains(*executable, "/") && !filepath.IsAbs(*executable)) {
+		return c, nil
+	}
+	path, err := exec.LookPath(*executable)
+	if err != nil {
+		return c, fmt.Errorf("invalid command: %w", err)
+	}
+	*executable = path
+	return c, nil
+}
+
+// fields returns all fields that can contain placeholders.
+func (c Command) fields() []string {
+	fields := []string{c.Binary, c.Dir}
+	fields = append(fields, c.Wrapper...)
+	fields = append(fields, c.Args...)
+	return append(fields, c.Env...)
+}
+
+// build returns the command line to run intel_gpu_top at the specified interval.
+func (c Command) build(interval time.Duration) []string {
+	binary := c.Binary
+	if binary == "" {
+		binary = defaultBinary
+	}
+	cmdline := append(slices.Clone(c.Wrapper), binary)
+	if c.Device != "" {
+		cmdline = append(cmdline, "-d", placeholderDevice)
+	}
+	cmdline = append(cmdline, "-J", "-s", placeholderInterval)
+	cmdline = append(cmdline, c.Args...)
+	return c.expand(cmdline, interval)
+}
+
+// env returns the additional environment variables for the command.
+func (c Command) env(interval time.Duration) []string {
+	return c.expand(c.Env, interval)
+}
+
+// dir returns the working directory for the command.
+func (c Command) dir(interval time.Duration) string {
+	return c.expand([]string{c.Dir}, interval)[0]
+}
+
+func (c Command) expand(values []string, interval time.Duration) []string {
+	replacer := strings.NewReplacer(
+		placeholderInterval, strconv.Itoa(int(interval.Milliseconds())),
+		placeholderDevice, c.Device,
+	)
+	expanded := make([]string, len(values))
+	for i, value := range values {
+		expanded[i] = replacer.Replace(value)
+	}
+	return expanded
+}
@@ -0,0 +1,94 @@
+package collector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestCommand_build(t *testing.T) {
+	tests := []struct {
+		name    string
+		command Command
+		want    []string
+	}{
+		{
+			name: "default",
+			want: []string{"intel_gpu_top", "-J", "-s", "1000"},
+		},
+		{
+			name:    "device",
+			command: Command{Device: "sriov"},
+			want:    []string{"intel_gpu_top", "-d", "sriov", "-J", "-s", "1000"},
+		},
+		{
+			name:    "wrapper",
+			command: Command{Binary: "/usr/bin/intel_gpu_top", Wrapper: []string{"ssh", "ubuntu@nuc1", "sudo"}, Args: []string{"-o", "-"}},
+			want:    []string{"ssh", "ubuntu@nuc1", "sudo", "/usr/bin/intel_gpu_top", "-J", "-s", "1000", "-o", "-"},
+		},
+		{
+			name:    "placeholders",
+			command: Command{Wrapper: []string{"timeout", "{interval_ms}ms"}, Device: "pci:card=1", Args: []string{"--device={device}"}},
+			want:    []string{"timeout", "1000ms", "intel_gpu_top", "-d", "pci:card=1", "-J", "-s", "1000", "--device=pci:card=1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.command.build(time.Second))
+		})
+	}
+}
+
+func TestCommand_env(t *testing.T) {
+	c := Command{Env: []string{"INTERVAL={interval_ms}", "DEVICE={device}"}, Dir: "/tmp/{device}", Device: "sriov"}
+	assert.Equal(t, []string{"INTERVAL=500", "DEVICE=sriov"}, c.env(500*time.Millisecond))
+	assert.Equal(t, "/tmp/sriov", c.dir(500*time.Millisecond))
+}
+
+func TestCommand_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		command Command
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{name: "default", wantErr: assert.NoError},
+		{name: "full", command: Command{Binary: "intel_gpu_top", Wrapper: []string{"sudo"}, Args: []string{"-o", "-"}, Env: []string{"FOO=bar"}, Dir: t.TempDir(), Device: "sriov"}, wantErr: assert.NoError},
+		{name: "unknown placeholder", command: Command{Args: []string{"{foo}"}}, wantErr: assert.Error},
+		{name: "device placeholder without device", command: Command{Args: []string{"--device={device}"}}, wantErr: assert.Error},
+		{name: "reserved argument", command: Command{Args: []string{"-s", "100"}}, wantErr: assert.Error},
+		{name: "reserved argument with value", command: Command{Args: []string{"-s500"}}, wantErr: assert.Error},
+		{name: "combined reserved argument", command: Command{Args: []string{"-pJ"}}, wantErr: assert.Error},
+		{name: "reserved long argument", command: Command{Args: []string{"--json"}}, wantErr: assert.Error},
+		{name: "value of another argument", command: Command{Args: []string{"-o", "-s"}}, wantErr: assert.NoError},
+		{name: "attached value of another argument", command: Command{Args: []string{"-o-J"}}, wantErr: assert.NoError},
+		{name: "invalid environment", command: Command{Env: []string{"FOO"}}, wantErr: assert.Error},
+		{name: "missing directory", command: Command{Dir: "/does/not/exist"}, wantErr: assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.wantErr(t, tt.command.Validate())
+		})
+	}
+}
+
+func TestCommand_Resolve(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	require.NoError(t, err)
+
+	c, err := Command{Binary: "sh"}.Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, sh, c.Binary)
+
+	// with a wrapper, the wrapper is resolved: intel_gpu_top may only be available to it
+	c, err = Command{Binary: "intel_gpu_top", Wrapper: []string{"sh", "-c"}}.Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, []string{sh, "-c"}, c.Wrapper)
+	assert.Equal(t, "intel_gpu_top", c.Binary)
+
+	_, err = Command{Binary: "/does/not/exist"}.Resolve()
+	assert.Error(t, err)
+	_, err = Command{Wrapper: []string{"does-not-exist"}}.Resolve()
+	assert.Error(t, err)
+}
@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/fs"
+	"os/exec"
+	"strings"
+)
+
+// FailureReason classifies why intel_gpu_top failed.
+type FailureReason string
+
+const (
+	FailureNotFound          FailureReason = "not_found"
+	FailurePermissionDenied  FailureReason = "permission_denied"
+	FailureNoDevice          FailureReason = "no_device"
+	FailureUnsupportedKernel FailureReason = "unsupported_kernel"
+	FailureExited            FailureReason = "exited"
+	FailureTimeout           FailureReason = "timeout"
+	FailureFrozen            FailureReason = "frozen"
+	FailureUnknown           FailureReason = "unknown"
+)
+
+var failureReasons = []FailureReason{
+	FailureNotFound, FailurePermissionDenied, FailureNoDevice, FailureUnsupportedKernel, FailureExited, FailureTimeout, FailureFrozen, FailureUnknown,
+}
+
+// failurePatterns map (lowercase) messages written by intel_gpu_top to a FailureReason. The first match wins.
+var failurePatterns = []struct {
+	pattern string
+	reason  FailureReason
+}{
+	// "Failed to initialize PMU! (Permission denied)"
+	{"permission denied", FailurePermissionDenied},
+	{"operation not permitted", FailurePermissionDenied},
+	// "(Kernel 4.16 or newer is required for i915 PMU support.)"
+	{"kernel", FailureUnsupportedKernel},
+	{"failed to initialize pmu", FailureUnsupportedKernel},
+	{"failed to detect engines", FailureUnsupportedKernel},
+	// "No device filter specified and no discrete/integrated i915 devices found"
+	{"no device", FailureNoDevice},
+	{"devices found", FailureNoDevice},
+	{"device not found", FailureNoDevice},
+	{"requested device", FailureNoDevice},
+}
+
+// classifyFailure returns the FailureReason for the output written by intel_gpu_top.
+func classifyFailure(output string) FailureReason {
+	output = strings.ToLower(output)
+	for _, p := range failurePatterns {
+		if strings.Contains(output, p.pattern) {
+			return p.reason
+		}
+	}
+	return FailureUnknown
+}
+
+// failureReason returns the FailureReason for an error returned while starting or running intel_gpu_top.
+func failureReason(err error) FailureReason {
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Reason
+	}
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, fs.ErrNotExist):
+		return FailureNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return FailurePermissionDenied
+	case errors.Is(err, errTimeout):
+		return FailureTimeout
+	case errors.Is(err, errFrozen):
+		return FailureFrozen
+	default:
+		return FailureUnknown
+	}
+}
+
+// newFailureCounter returns the counter for intel_gpu_top failures, with all reasons initialized.
+func newFailureCounter() *prometheus.CounterVec {
+	failures := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName("gpumon", "source", "failures_total"),
+		Help: "Number of times intel_gpu_top failed, by reason",
+	}, []string{"reason"})
+	for _, reason := range failureReasons {
+		failures.WithLabelValues(string(reason))
+	}
+	return failures
+}
+
+// errTimeout indicates that intel_gpu_top stopped sending data.
+var errTimeout = errors.New("timed out waiting for data")
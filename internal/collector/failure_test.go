@@ -0,0 +1,67 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+func Test_classifyFailure(t *testing.T) {
+	tests := []struct {
+		output string
+		want   FailureReason
+	}{
+		{"Failed to initialize PMU! (Permission denied)", FailurePermissionDenied},
+		{"Failed to initialize PMU! (Operation not permitted)", FailurePermissionDenied},
+		{"Failed to detect engines! (No such file or directory)\n(Kernel 4.16 or newer is required for i915 PMU support.)", FailureUnsupportedKernel},
+		{"Failed to initialize PMU! (No such file or directory)", FailureUnsupportedKernel},
+		{"No device filter specified and no discrete/integrated i915 devices found", FailureNoDevice},
+		{"Requested device sriov not found!", FailureNoDevice},
+		{"something else went wrong", FailureUnknown},
+		{"", FailureUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			assert.Equal(t, tt.want, classifyFailure(tt.output))
+		})
+	}
+}
+
+func Test_failureReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want FailureReason
+	}{
+		{fmt.Errorf("intel-gpu-top: %w", exec.ErrNotFound), FailureNotFound},
+		{fmt.Errorf("intel-gpu-top: %w", fs.ErrNotExist), FailureNotFound},
+		{fmt.Errorf("intel-gpu-top: %w", fs.ErrPermission), FailurePermissionDenied},
+		{fmt.Errorf("%w: no data received for 15s", errTimeout), FailureTimeout},
+		{fmt.Errorf("stopped: %w", &ExitError{Reason: FailureNoDevice}), FailureNoDevice},
+		{errors.New("foo"), FailureUnknown},
+	}
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert.Equal(t, tt.want, failureReason(tt.err))
+		})
+	}
+}
+
+func Test_stderrBuffer(t *testing.T) {
+	b := stderrBuffer{logger: slog.New(slog.DiscardHandler)}
+	_, _ = b.Write([]byte("line 1\r\nline"))
+	_, _ = b.Write([]byte(" 2\n\n"))
+	assert.Equal(t, []string{"line 1", "line 2"}, b.Lines())
+
+	for i := range 2 * stderrLines {
+		_, _ = fmt.Fprintf(&b, "line %d\n", i)
+	}
+	_, _ = b.Write([]byte("partial"))
+	lines := b.Lines()
+	assert.Len(t, lines, stderrLines)
+	assert.Equal(t, "partial", lines[len(lines)-1])
+}
@@ -0,0 +1,96 @@
+package collector
+
+import (
+	"github.com/rmarchant/intel-gpu-exporter/internal/web"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SourceStatus is the status of one source of GPU statistics (the local host or a remote target).
+type SourceStatus struct {
+	// Name is the name of the source: "local" or the target's name.
+	Name string `json:"name"`
+	// State is the state of intel_gpu_top.
+	State SourceState `json:"state"`
+	// LastUpdate is the time data was last received. Nil if no data has been received yet.
+	LastUpdate *time.Time `json:"last_update,omitempty"`
+	// LastError is the last error that caused intel_gpu_top to fail.
+	LastError string `json:"last_error,omitempty"`
+	// Ready is true if the source is sending fresh data.
+	Ready bool `json:"ready"`
+}
+
+// localSource is the name of the source that monitors the local host.
+const localSource = "local"
+
+// statusReporter reports the status of a source.
+type statusReporter interface {
+	Status() SourceStatus
+}
+
+// Health reports the health and readiness of the exporter over HTTP. A source is ready if it isn't in a crash loop and
+// it received data within the configured maximum age. A source that is idle (in lazy or sync mode) is also ready.
+type Health struct {
+	maxAge  time.Duration
+	lock    sync.RWMutex
+	sources []statusReporter
+}
+
+// NewHealth returns a Health that considers data older than maxAge to be stale.
+func NewHealth(maxAge time.Duration) *Health {
+	return &Health{maxAge: maxAge}
+}
+
+func (h *Health) add(source statusReporter) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.sources = append(h.sources, source)
+}
+
+// Status returns the status of each source. Returns false if any source isn't ready, or if no sources are running yet.
+func (h *Health) Status() ([]SourceStatus, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	statuses := make([]SourceStatus, 0, len(h.sources))
+	ready := len(h.sources) > 0
+	for _, source := range h.sources {
+		status := source.Status()
+		status.Ready = h.isReady(status)
+		ready = ready && status.Ready
+		statuses = append(statuses, status)
+	}
+	return statuses, ready
+}
+
+func (h *Health) isReady(status SourceStatus) bool {
+	switch status.State {
+	case SourceIdle:
+		return true
+	case SourceCrashLoop, SourceStopped:
+		return false
+	default:
+		return status.LastUpdate != nil && time.Since(*status.LastUpdate) <= h.maxAge
+	}
+}
+
+// healthResponse is the body of the /healthz and /readyz responses.
+type healthResponse struct {
+	Status  string         `json:"status"`
+	Sources []SourceStatus `json:"sources,omitempty"`
+}
+
+// Healthz reports that the exporter is alive.
+func (h *Health) Healthz(w http.ResponseWriter, _ *http.Request) {
+	web.WriteJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// Readyz reports whether all sources are sending fresh data. The body contains the status of each source.
+func (h *Health) Readyz(w http.ResponseWriter, _ *http.Request) {
+	statuses, ready := h.Status()
+	response, code := healthResponse{Status: "ok", Sources: statuses}, http.StatusOK
+	if !ready {
+		response.Status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	web.WriteJSON(w, code, response)
+}
@@ -0,0 +1,74 @@
+package collector
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth_Readyz(t *testing.T) {
+	now := time.Now()
+	stale := now.Add(-2 * time.Minute)
+	tests := []struct {
+		name      string
+		sources   []SourceStatus
+		wantCode  int
+		wantReady []bool
+	}{
+		{name: "no sources", wantCode: http.StatusServiceUnavailable},
+		{name: "running", sources: []SourceStatus{{Name: "local", State: SourceRunning, LastUpdate: &now}}, wantCode: http.StatusOK, wantReady: []bool{true}},
+		{name: "stale", sources: []SourceStatus{{Name: "local", State: SourceRunning, LastUpdate: &stale}}, wantCode: http.StatusServiceUnavailable, wantReady: []bool{false}},
+		{name: "starting", sources: []SourceStatus{{Name: "local", State: SourceStarting}}, wantCode: http.StatusServiceUnavailable, wantReady: []bool{false}},
+		{name: "idle", sources: []SourceStatus{{Name: "local", State: SourceIdle, LastUpdate: &stale}}, wantCode: http.StatusOK, wantReady: []bool{true}},
+		{name: "crashloop", sources: []SourceStatus{{Name: "local", State: SourceCrashLoop, LastUpdate: &now, LastError: "exit status 1"}}, wantCode: http.StatusServiceUnavailable, wantReady: []bool{false}},
+		{
+			name: "one target down",
+			sources: []SourceStatus{
+				{Name: "nuc1", State: SourceRunning, LastUpdate: &now},
+				{Name: "nuc2", State: SourceBackoff, LastUpdate: &stale},
+			},
+			wantCode:  http.StatusServiceUnavailable,
+			wantReady: []bool{true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHealth(time.Minute)
+			for _, source := range tt.sources {
+				h.add(fakeStatusReporter(source))
+			}
+			w := httptest.NewRecorder()
+			h.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+			var response healthResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+			require.Len(t, response.Sources, len(tt.wantReady))
+			for i, source := range response.Sources {
+				assert.Equal(t, tt.sources[i].Name, source.Name)
+				assert.Equal(t, tt.sources[i].State, source.State)
+				assert.Equal(t, tt.sources[i].LastError, source.LastError)
+				assert.Equal(t, tt.wantReady[i], source.Ready)
+			}
+		})
+	}
+}
+
+func TestHealth_Healthz(t *testing.T) {
+	h := NewHealth(time.Minute)
+	w := httptest.NewRecorder()
+	h.Healthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+}
+
+type fakeStatusReporter SourceStatus
+
+func (f fakeStatusReporter) Status() SourceStatus {
+	return SourceStatus(f)
+}
@@ -0,0 +1,43 @@
+package collector
+
+import (
+	"context"
+	"github.com/rmarchant/intel-gpu-exporter/internal/history"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+)
+
+// record adds each sample published by the broadcaster to the history, until ctx is done.
+func record(ctx context.Context, store *history.Store, samples *broadcaster, q *queue) {
+	defer samples.detach(q)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.ready:
+			for _, event := range q.take() {
+				store.Record(event.Device, event.Time, historyValues(event.Stats))
+			}
+		}
+	}
+}
+
+// historyValues returns the values of a sample that are kept in the history. Engine usage is a ratio (0-1) per engine
+// class, power is in watts and frequencies in Hz. Sections that intel_gpu_top didn't report are left out.
+func historyValues(stats igt.GPUStats) map[string]float64 {
+	values := map[string]float64{"clients": float64(len(stats.Clients))}
+	for class, usage := range EngineStats(stats.Engines).ByClass() {
+		values["engine_busy_"+string(class)] = usage.Busy
+	}
+	if stats.Power.Unit != "" {
+		values["power_gpu_watts"] = stats.Power.GPU
+		values["power_package_watts"] = stats.Power.Package
+	}
+	if stats.Frequency.Unit != "" {
+		values["frequency_requested_hz"] = stats.Frequency.Requested
+		values["frequency_actual_hz"] = stats.Frequency.Actual
+	}
+	if stats.Rc6.Unit != "" {
+		values["rc6_ratio"] = stats.Rc6.Value
+	}
+	return values
+}
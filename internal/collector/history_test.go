@@ -0,0 +1,52 @@
+package collector
+
+import (
+	"github.com/rmarchant/intel-gpu-exporter/internal/history"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_historyValues(t *testing.T) {
+	for stats, err := range igt.ReadGPUStats(strings.NewReader(testutil.SinglePayload)) {
+		require.NoError(t, err)
+		values := historyValues(stats)
+		assert.Equal(t, 1.0, values["clients"])
+		assert.InDelta(t, 0.01, values["engine_busy_render"], 1e-9)
+		assert.InDelta(t, 0.02, values["engine_busy_copy"], 1e-9)
+		assert.InDelta(t, 0.03, values["engine_busy_video"], 1e-9)
+		assert.InDelta(t, 0.04, values["engine_busy_video_enhance"], 1e-9)
+		assert.Equal(t, 1.0, values["power_gpu_watts"])
+		assert.Equal(t, 4.0, values["power_package_watts"])
+		assert.Zero(t, values["frequency_actual_hz"])
+		assert.InDelta(t, 1.0, values["rc6_ratio"], 1e-5)
+		assert.Len(t, values, 10)
+	}
+
+	// sections that intel_gpu_top didn't report are left out
+	assert.Equal(t, map[string]float64{"clients": 0}, historyValues(igt.GPUStats{}))
+}
+
+func Test_register_history(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	store, err := history.Open(t.TempDir(), history.DefaultTiers(), l)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = store.Close() })
+
+	cfg := Config{Interval: 10 * time.Millisecond, History: store}
+	r := NewTopReader(l, cfg)
+	r.topRunner = &fakeRunner{interval: 10 * time.Millisecond}
+	r.name = "nuc1"
+	register(t.Context(), cfg, r)
+	go func() { assert.NoError(t, r.Run(t.Context())) }()
+
+	assert.Eventually(t, func() bool {
+		series, _, err := store.Query("power_gpu_watts", "nuc1", time.Now().Add(-time.Minute), time.Now(), time.Second)
+		return err == nil && len(series) == 1 && len(series[0].Points) > 0
+	}, time.Second, 10*time.Millisecond)
+}
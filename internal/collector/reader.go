@@ -1,106 +1,395 @@
 package collector
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
-	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"github.com/prometheus/client_golang/prometheus"
 	"io"
 	"log/slog"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // TopReader starts intel-gpu-top, reads/decodes its output and collects the sampler for the Collector to export them to Prometheus.
 //
-// TopReader regularly checks if it's still receiving data from intel-gpu-top. After a timeout, it stops the running instance
-// of intel-gpu-top and start a new instance.
+// TopReader supervises the running instance of intel-gpu-top. If intel-gpu-top fails to start, exits, or stops sending data
+// for longer than the timeout, TopReader stops it and starts a new instance. Consecutive failures are retried with exponential
+// backoff. After several consecutive failures, the source is considered to be in a crash loop: TopReader keeps retrying
+// (the delay keeps doubling, up to the maximum), but a failing source never stops the exporter.
+//
+// In lazy mode, TopReader only runs intel_gpu_top while the exporter is being scraped: the first scrape starts
+// intel_gpu_top and intel_gpu_top is stopped when no scrapes were received for the configured idle time.
 type TopReader struct {
 	topRunner
 	logger *slog.Logger
 	Aggregator
-	interval time.Duration
-	timeout  time.Duration
+	name            string
+	command         Command
+	interval        time.Duration
+	timeout         time.Duration
+	checkInterval   time.Duration
+	backoff         backoff
+	startedAt       time.Time
+	nextStart       time.Time
+	started         bool
+	generation      *generation
+	state           atomic.Value
+	lastErr         atomic.Pointer[error]
+	restarts        prometheus.Counter
+	failures        *prometheus.CounterVec
+	stalls          *prometheus.CounterVec
+	lazy            bool
+	idleTimeout     time.Duration
+	firstSampleWait time.Duration
+	lastScrape      atomic.Int64 // unix nanoseconds. zero if not scraped yet.
+	scraped         chan struct{}
+}
+
+// generation is one run of intel_gpu_top and the goroutine reading its output.
+type generation struct {
+	cancel  context.CancelFunc
+	done    chan error    // receives the result of reading intel_gpu_top's output
+	stopped chan struct{} // closed when the reading goroutine has finished
 }
 
 // topRunner interface allows us to override Runner during testing.
 type topRunner interface {
 	Start(ctx context.Context, cmdline []string) (io.Reader, error)
-	Stop()
+	Stop() error
 	Running() bool
 }
 
-// NewTopReader returns a new TopReader that will measure GPU usage at `interval` seconds.
-func NewTopReader(logger *slog.Logger, interval time.Duration) *TopReader {
+// SourceState is the state of the intel_gpu_top source.
+type SourceState string
+
+const (
+	// SourceStarting means intel_gpu_top was started, but we haven't received any data yet.
+	SourceStarting SourceState = "starting"
+	// SourceRunning means intel_gpu_top is running and sending data.
+	SourceRunning SourceState = "running"
+	// SourceBackoff means intel_gpu_top failed and TopReader is waiting to restart it.
+	SourceBackoff SourceState = "backoff"
+	// SourceCrashLoop means intel_gpu_top failed repeatedly. TopReader keeps retrying with exponential backoff.
+	SourceCrashLoop SourceState = "crashloop"
+	// SourceIdle means TopReader runs in lazy mode and stopped intel_gpu_top, as the exporter isn't being scraped.
+	SourceIdle SourceState = "idle"
+	// SourceStopped means the TopReader is not running.
+	SourceStopped SourceState = "stopped"
+)
+
+// crashLoopThreshold is the number of consecutive failures after which the source is considered to be in a crash loop.
+const crashLoopThreshold = 5
+
+var sourceUpMetric = prometheus.NewDesc(
+	prometheus.BuildFQName("gpumon", "source", "up"),
+	"Whether intel_gpu_top is running and sending data",
+	nil,
+	nil,
+)
+
+// NewTopReader returns a new TopReader that will measure GPU usage at the configured interval.
+func NewTopReader(logger *slog.Logger, cfg Config) *TopReader {
 	r := TopReader{
-		logger:     logger,
-		Aggregator: Aggregator{logger: logger.With("subsystem", "aggregator")},
-		topRunner:  &Runner{logger: logger.With("subsystem", "runner")},
-		interval:   interval,
-		timeout:    15 * time.Second,
+		logger: logger,
+		Aggregator: Aggregator{
+			logger:    logger.With("subsystem", "aggregator"),
+			validator: newValidator(cfg.Validation),
+			raw:       cfg.Raw,
+			frozen:    cfg.FrozenRecords,
+			retention: MaxStatsWindow,
+			stream:    newBroadcaster(),
+		},
+		topRunner:     newRunner(logger, cfg),
+		name:          localSource,
+		command:       cfg.Command,
+		interval:      cfg.Interval,
+		timeout:       cmp.Or(cfg.Timeout, 15*time.Second),
+		checkInterval: cmp.Or(cfg.CheckInterval, time.Second),
+		backoff:       backoff{min: time.Second, max: 2 * time.Minute},
+		restarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prometheus.BuildFQName("gpumon", "source", "restarts_total"),
+			Help: "Number of times intel_gpu_top was restarted",
+		}),
+		failures:        newFailureCounter(),
+		stalls:          newStallCounter(),
+		lazy:            cfg.Lazy,
+		idleTimeout:     cfg.IdleTimeout,
+		firstSampleWait: 2 * cfg.Interval,
+		scraped:         make(chan struct{}, 1),
 	}
+	r.state.Store(SourceStopped)
 	return &r
 }
 
+// Run supervises intel_gpu_top until the context is canceled. Failures to start or run intel_gpu_top are retried,
+// so Run only returns when ctx is done.
 func (r *TopReader) Run(ctx context.Context) error {
 	r.logger.Debug("starting reader")
 	defer r.logger.Debug("shutting down reader")
 
-	ticker := time.NewTicker(time.Second)
+	ticker := time.NewTicker(r.checkInterval)
 	defer ticker.Stop()
 
 	for {
-		if err := r.ensureReaderIsRunning(ctx); err != nil {
-			return err
-		}
+		r.supervise(ctx)
 		select {
 		case <-ctx.Done():
-			r.topRunner.Stop()
+			_ = r.stop()
+			if closer, ok := r.topRunner.(io.Closer); ok {
+				_ = closer.Close()
+			}
+			r.state.Store(SourceStopped)
 			return nil
 		case <-ticker.C:
+		case <-r.scraped:
+		case err := <-r.done():
+			// intel_gpu_top's output ended: no need to wait for the timeout
+			if err == nil {
+				err = errors.New("intel-gpu-top stopped sending data")
+			}
+			r.fail(err)
 		}
 	}
 }
 
-func (r *TopReader) ensureReaderIsRunning(ctx context.Context) (err error) {
-	// if we have received data  `timeout` seconds, do nothing
+// supervise checks the state of intel_gpu_top and (re)starts it if needed.
+func (r *TopReader) supervise(ctx context.Context) {
+	if r.lazy && r.idle() {
+		if r.topRunner.Running() {
+			r.logger.Info("no scrapes received. stopping intel-gpu-top", "idleTimeout", r.idleTimeout)
+			_ = r.stop()
+			// starting it again on the next scrape isn't a restart
+			r.started = false
+		}
+		r.state.Store(SourceIdle)
+		return
+	}
+	if !r.topRunner.Running() {
+		if time.Now().Before(r.nextStart) {
+			return
+		}
+		if err := r.start(ctx); err != nil {
+			r.fail(err)
+		}
+		return
+	}
+
+	// we received data since intel_gpu_top was started: the source is healthy
 	last, ok := r.Aggregator.LastUpdate()
-	if ok && time.Since(last) < r.timeout {
-		return nil
+	if ok && last.After(r.startedAt) {
+		if r.State() != SourceRunning {
+			r.logger.Debug("intel-gpu-top is sending data")
+			r.state.Store(SourceRunning)
+			r.backoff.reset()
+		}
+	} else {
+		last = r.startedAt
+	}
+	if waitTime := time.Since(last); waitTime >= r.timeout {
+		r.logger.Warn("timed out waiting for data. restarting intel-gpu-top", "waitTime", waitTime)
+		r.fail(fmt.Errorf("%w: no data received for %s", errTimeout, waitTime.Round(time.Second)))
 	}
-	if r.topRunner.Running() {
-		// Shut down the current instance of igt.
-		r.logger.Warn("timed out waiting for data. restarting intel-gpu-top", "waitTime", time.Since(last))
-		r.topRunner.Stop()
+}
+
+func (r *TopReader) start(ctx context.Context) error {
+	if r.started {
+		r.restarts.Inc()
 	}
+	r.started = true
 
 	// start a new instance of igt
-	cmdline := buildCommand(r.interval)
+	cmdline := r.command.build(r.interval)
 	r.logger.Debug("top command built", "interval", r.interval, "cmd", strings.Join(cmdline, " "))
 
-	stdout, err := r.topRunner.Start(ctx, cmdline)
+	// each instance gets its own context, so its reader stops as soon as the instance is stopped.
+	genCtx, cancel := context.WithCancel(ctx)
+	stdout, err := r.topRunner.Start(genCtx, cmdline)
 	if err != nil {
+		cancel()
 		return fmt.Errorf("intel-gpu-top: %w", err)
 	}
+	r.startedAt = time.Now()
+	r.state.Store(SourceStarting)
+
 	// start aggregating from the new instance's output.
-	// any previous goroutines will stop as soon as the previous stdout is closed.
+	gen := generation{cancel: cancel, done: make(chan error, 1), stopped: make(chan struct{})}
+	r.generation = &gen
 	go func() {
-		stdout = &igt.V118toV117{Source: stdout}
-		if err := r.Aggregator.Read(stdout); err != nil {
-			r.logger.Error("failed to start reader", "err", err)
+		defer close(gen.stopped)
+		gen.done <- r.Aggregator.Read(genCtx, stdout)
+		if closer, ok := stdout.(io.Closer); ok {
+			_ = closer.Close()
 		}
 	}()
-	// reset the timer
-	r.Aggregator.lastUpdate.Store(time.Now())
 	return nil
 }
 
-func buildCommand(scanInterval time.Duration) []string {
-	//const gpuTopCommand = "ssh ubuntu@nuc1 sudo intel_gpu_top -J -s"
-	const gpuTopCommand = "intel_gpu_top -d sriov -J -s"
+// stop stops intel_gpu_top and waits for the goroutine reading its output to finish. This guarantees that no samples
+// from a previous instance are added once a new instance has started.
+//
+// If intel_gpu_top had exited by itself, stop returns the topRunner's exit error.
+func (r *TopReader) stop() error {
+	err := r.topRunner.Stop()
+	if gen := r.generation; gen != nil {
+		gen.cancel()
+		<-gen.stopped
+		r.generation = nil
+	}
+	return err
+}
+
+// done returns the channel that receives the result of reading intel_gpu_top's output. Returns nil if intel_gpu_top isn't running.
+func (r *TopReader) done() <-chan error {
+	if r.generation == nil {
+		return nil
+	}
+	return r.generation.done
+}
 
-	return append(
-		strings.Split(gpuTopCommand, " "),
-		strconv.Itoa(int(scanInterval.Milliseconds())),
-	)
+// fail stops intel_gpu_top (if it's running) and schedules a restart.
+func (r *TopReader) fail(err error) {
+	// if intel_gpu_top exited by itself, its exit status tells us why it failed.
+	if exitErr := r.stop(); exitErr != nil {
+		err = fmt.Errorf("%w: %w", err, exitErr)
+	}
+	r.lastErr.Store(&err)
+	r.failures.WithLabelValues(string(failureReason(err))).Inc()
+	if kind, ok := stallKind(err); ok {
+		r.stalls.WithLabelValues(kind).Inc()
+	}
+
+	delay := r.backoff.next()
+	r.nextStart = time.Now().Add(delay)
+	if r.backoff.failures >= crashLoopThreshold {
+		if r.State() != SourceCrashLoop {
+			r.logger.Error("intel-gpu-top keeps failing", "failures", r.backoff.failures, "err", err)
+		}
+		r.state.Store(SourceCrashLoop)
+	} else {
+		r.state.Store(SourceBackoff)
+	}
+	r.logger.Warn("intel-gpu-top failed. restarting after delay", "err", err, "reason", failureReason(err), "delay", delay, "failures", r.backoff.failures)
+}
+
+// idle returns true if the exporter wasn't scraped during the idle timeout and no stream clients are subscribed.
+func (r *TopReader) idle() bool {
+	if r.samples().subscribed() {
+		return false
+	}
+	last := r.lastScrape.Load()
+	return last == 0 || time.Since(time.Unix(0, last)) >= r.idleTimeout
+}
+
+// scrape records that the exporter is being scraped and wakes up Run, so it starts intel_gpu_top if it's idle.
+// If intel_gpu_top is (re)starting, scrape waits briefly for the first samples.
+func (r *TopReader) scrape() {
+	r.lastScrape.Store(time.Now().UnixNano())
+	select {
+	case r.scraped <- struct{}{}:
+	default:
+	}
+
+	timeout := time.NewTimer(r.firstSampleWait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for r.Aggregator.len() == 0 {
+		if state := r.State(); state != SourceIdle && state != SourceStarting {
+			return
+		}
+		select {
+		case <-timeout.C:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// State returns the current state of the intel_gpu_top source.
+func (r *TopReader) State() SourceState {
+	return r.state.Load().(SourceState)
+}
+
+// LastError returns the last error that caused intel_gpu_top to be restarted, or nil if it has not failed yet.
+func (r *TopReader) LastError() error {
+	if err := r.lastErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// Status returns the status of the intel_gpu_top source.
+func (r *TopReader) Status() SourceStatus {
+	status := SourceStatus{Name: r.name, State: r.State()}
+	if last, ok := r.Aggregator.LastUpdate(); ok {
+		status.LastUpdate = &last
+	}
+	if err := r.LastError(); err != nil {
+		status.LastError = err.Error()
+	}
+	return status
+}
+
+// Stats returns the GPU statistics received during the last window. In lazy mode, this starts intel_gpu_top if needed.
+func (r *TopReader) Stats(window time.Duration, aggregation Aggregation) DeviceStats {
+	r.activate()
+	return newDeviceStats(r.Status(), r.Aggregator.Window(window, aggregation))
+}
+
+// activate records that the statistics are being used. In lazy mode, this starts intel_gpu_top if needed, or keeps it
+// running, without waiting for a sample if it's already running.
+func (r *TopReader) activate() {
+	if !r.lazy {
+		return
+	}
+	if r.State() == SourceRunning {
+		r.lastScrape.Store(time.Now().UnixNano())
+	} else {
+		r.scrape()
+	}
+}
+
+func (r *TopReader) samples() *broadcaster {
+	return r.Aggregator.stream
+}
+
+// subscribed keeps intel_gpu_top running in lazy mode, as stream clients are waiting for samples.
+func (r *TopReader) subscribed() {
+	r.activate()
+}
+
+// Describe implements the prometheus.Collector interface.
+func (r *TopReader) Describe(ch chan<- *prometheus.Desc) {
+	r.Aggregator.Describe(ch)
+	ch <- sourceUpMetric
+	r.restarts.Describe(ch)
+	r.failures.Describe(ch)
+	if c, ok := r.topRunner.(prometheus.Collector); ok {
+		c.Describe(ch)
+	}
+	r.stalls.Describe(ch)
+	r.samples().Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (r *TopReader) Collect(ch chan<- prometheus.Metric) {
+	if r.lazy {
+		r.scrape()
+	}
+	r.Aggregator.Collect(ch)
+	var up float64
+	if r.State() == SourceRunning {
+		up = 1
+	}
+	ch <- prometheus.MustNewConstMetric(sourceUpMetric, prometheus.GaugeValue, up)
+	r.restarts.Collect(ch)
+	r.failures.Collect(ch)
+	if c, ok := r.topRunner.(prometheus.Collector); ok {
+		c.Collect(ch)
+	}
+	r.stalls.Collect(ch)
+	r.samples().Collect(ch)
 }
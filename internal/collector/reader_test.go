@@ -2,26 +2,29 @@ package collector
 
 import (
 	"context"
+	"errors"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io"
 	"log/slog"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func Test_buildCommand(t *testing.T) {
-	assert.Equal(t, []string{"intel_gpu_top", "-J", "-s", "1000"}, buildCommand(time.Second))
-}
-
 func TestTopReader_Run(t *testing.T) {
 	//l := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
 	l := slog.New(slog.DiscardHandler)
-	r := NewTopReader(l, 100*time.Millisecond)
+	r := NewTopReader(l, Config{Interval: 100 * time.Millisecond})
 	fake := fakeRunner{interval: 100 * time.Millisecond}
 	r.topRunner = &fake
 	r.timeout = time.Second
+	r.checkInterval = 100 * time.Millisecond
+	r.backoff.min = 100 * time.Millisecond
 
 	// start the reader
 	go func() { assert.NoError(t, r.Run(t.Context())) }()
@@ -35,34 +38,200 @@ func TestTopReader_Run(t *testing.T) {
 	got := r.Aggregator.len()
 
 	// stop the current writer
-	fake.Stop()
+	_ = fake.Stop()
 
-	// wait for reader to time out and start a new writer.
+	// wait for reader to detect the end of the stream and start a new writer.
 	assert.Eventually(t, func() bool {
 		return r.Aggregator.len() > got
 	}, 2*time.Second, 100*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return r.State() == SourceRunning
+	}, time.Second, 100*time.Millisecond)
+	assert.Equal(t, 1.0, promtestutil.ToFloat64(r.restarts))
+}
+
+func TestTopReader_Run_Failure(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := NewTopReader(l, Config{Interval: 100 * time.Millisecond})
+	var runner failingRunner
+	r.topRunner = &runner
+	r.checkInterval = 10 * time.Millisecond
+	r.backoff = backoff{min: time.Millisecond, max: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error)
+	go func() { errCh <- r.Run(ctx) }()
+
+	// a source that fails to start doesn't stop the reader. It ends up in a crash loop.
+	assert.Eventually(t, func() bool {
+		return r.State() == SourceCrashLoop
+	}, time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, runner.starts.Load(), int32(crashLoopThreshold))
+	assert.GreaterOrEqual(t, promtestutil.ToFloat64(r.restarts), float64(crashLoopThreshold-1))
+	assert.ErrorIs(t, r.LastError(), errFailingRunner)
+	assert.NoError(t, promtestutil.CollectAndCompare(r, strings.NewReader(`
+# HELP gpumon_source_up Whether intel_gpu_top is running and sending data
+# TYPE gpumon_source_up gauge
+gpumon_source_up 0
+`), "gpumon_source_up"))
+
+	cancel()
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, SourceStopped, r.State())
+}
+
+func TestTopReader_Run_Restart(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := NewTopReader(l, Config{Interval: time.Millisecond})
+	var runner staleRunner
+	r.topRunner = &runner
+	r.timeout = 20 * time.Millisecond
+	r.checkInterval = time.Millisecond
+	r.backoff = backoff{min: time.Millisecond, max: time.Millisecond}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error)
+	go func() { errCh <- r.Run(ctx) }()
+
+	// each generation stops sending data, so the reader times out and restarts it.
+	const generations = 20
+	assert.Eventually(t, func() bool {
+		return runner.generation.Load() >= generations
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.NoError(t, <-errCh)
+
+	// no sample of a previous generation may be added once a new generation has started.
+	r.Aggregator.lock.RLock()
+	defer r.Aggregator.lock.RUnlock()
+	require.NotEmpty(t, r.Aggregator.stats)
+	for i := 1; i < len(r.Aggregator.stats); i++ {
+		require.GreaterOrEqual(t, r.Aggregator.stats[i].Frequency.Actual, r.Aggregator.stats[i-1].Frequency.Actual, "stale sample at index %d", i)
+	}
+}
+
+func TestTopReader_Run_Frozen(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := NewTopReader(l, Config{Interval: 10 * time.Millisecond, CheckInterval: 10 * time.Millisecond, FrozenRecords: 3})
+	// fakeRunner keeps sending the same record
+	r.topRunner = &fakeRunner{interval: 10 * time.Millisecond}
+	r.backoff.min = 10 * time.Millisecond
+
+	go func() { assert.NoError(t, r.Run(t.Context())) }()
+
+	assert.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(r.stalls.WithLabelValues(stallFrozen)) >= 2
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, promtestutil.ToFloat64(r.failures.WithLabelValues(string(FailureFrozen))), 2.0)
+	assert.Zero(t, promtestutil.ToFloat64(r.stalls.WithLabelValues(stallNoData)))
+}
+
+func TestTopReader_Run_Lazy(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := NewTopReader(l, Config{Interval: 100 * time.Millisecond, Lazy: true, IdleTimeout: 500 * time.Millisecond})
+	fake := fakeRunner{interval: 100 * time.Millisecond}
+	r.topRunner = &fake
+	r.checkInterval = 10 * time.Millisecond
+
+	go func() { assert.NoError(t, r.Run(t.Context())) }()
+
+	// intel_gpu_top isn't started until the first scrape
+	assert.Eventually(t, func() bool { return r.State() == SourceIdle }, time.Second, 10*time.Millisecond)
+	assert.False(t, fake.Running())
+
+	// the first scrape starts intel_gpu_top and waits for the first samples
+	assert.NotZero(t, promtestutil.CollectAndCount(r, "gpumon_engine_usage_ratio"))
+	assert.True(t, fake.Running())
+
+	// intel_gpu_top is stopped when no scrapes are received
+	assert.Eventually(t, func() bool { return r.State() == SourceIdle && !fake.Running() }, 2*time.Second, 10*time.Millisecond)
+	assert.Zero(t, promtestutil.ToFloat64(r.restarts))
+}
+
+var _ topRunner = &staleRunner{}
+
+// staleRunner is a topRunner that sends a few samples and then hangs. Once stopped, it still sends a few (stale) samples,
+// like a process flushing its buffered output. Each generation reports its generation number as its actual frequency.
+type staleRunner struct {
+	generation atomic.Int32
+	cancel     atomic.Pointer[context.CancelFunc]
+}
+
+func (f *staleRunner) Start(ctx context.Context, _ []string) (io.Reader, error) {
+	subCtx, cancel := context.WithCancel(ctx)
+	f.cancel.Store(&cancel)
+	payload := []byte(strings.Replace(testutil.SinglePayload, `"actual": 0.000000`, `"actual": `+strconv.Itoa(int(f.generation.Add(1))), 1))
+	r, w := io.Pipe()
+	go func() {
+		defer func() { _ = w.Close() }()
+		for range 3 {
+			if _, err := w.Write(payload); err != nil {
+				return
+			}
+		}
+		<-subCtx.Done()
+		for range 5 {
+			time.Sleep(time.Millisecond)
+			if _, err := w.Write(payload); err != nil {
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+func (f *staleRunner) Stop() error {
+	if cancel := f.cancel.Swap(nil); cancel != nil {
+		(*cancel)()
+	}
+	return nil
+}
+
+func (f *staleRunner) Running() bool {
+	return f.cancel.Load() != nil
+}
+
+var _ topRunner = &failingRunner{}
+
+var errFailingRunner = errors.New("failed to initialize PMU")
+
+// failingRunner is a topRunner that always fails to start.
+type failingRunner struct {
+	starts atomic.Int32
+}
+
+func (f *failingRunner) Start(context.Context, []string) (io.Reader, error) {
+	f.starts.Add(1)
+	return nil, errFailingRunner
+}
+
+func (f *failingRunner) Stop() error { return nil }
+
+func (f *failingRunner) Running() bool {
+	return false
 }
 
 var _ topRunner = &fakeRunner{}
 
 type fakeRunner struct {
 	interval time.Duration
-	cancel   atomic.Value
+	cancel   atomic.Pointer[context.CancelFunc]
 }
 
 func (f *fakeRunner) Start(ctx context.Context, _ []string) (io.Reader, error) {
 	subCtx, cancel := context.WithCancel(ctx)
-	f.cancel.Store(cancel)
+	f.cancel.Store(&cancel)
 	r, w := io.Pipe()
 	go func() {
-		defer func() { _ = r.Close() }()
+		defer func() { _ = w.Close() }()
 		for {
 			select {
 			case <-subCtx.Done():
 				return
 			case <-time.After(f.interval):
 				if _, err := w.Write([]byte(testutil.SinglePayload)); err != nil {
-					panic(err)
+					// the reader closed the pipe
+					return
 				}
 			}
 		}
@@ -70,10 +239,11 @@ func (f *fakeRunner) Start(ctx context.Context, _ []string) (io.Reader, error) {
 	return r, nil
 }
 
-func (f *fakeRunner) Stop() {
-	if cancel := f.cancel.Load().(context.CancelFunc); cancel != nil {
-		cancel()
+func (f *fakeRunner) Stop() error {
+	if cancel := f.cancel.Swap(nil); cancel != nil {
+		(*cancel)()
 	}
+	return nil
 }
 
 func (f *fakeRunner) Running() bool {
@@ -0,0 +1,90 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Resources limits the resources used by intel_gpu_top. Resource limits are only supported on Linux.
+type Resources struct {
+	// Nice is the scheduling niceness of intel_gpu_top (-20 to 19). Zero leaves the niceness unchanged.
+	Nice int
+	// CPUs restricts intel_gpu_top to these CPUs. If empty, intel_gpu_top can run on any CPU.
+	CPUs []int
+	// Cgroup is the cgroup v2 directory (e.g. /sys/fs/cgroup/gpumon) to run intel_gpu_top in. It is created if it doesn't exist.
+	Cgroup string
+	// CPUMax limits the CPU time of the cgroup, in CPUs (e.g. 0.5). Zero means no limit. Requires Cgroup.
+	CPUMax float64
+	// MemoryMax limits the memory of the cgroup, in bytes. Zero means no limit. Requires Cgroup.
+	MemoryMax int64
+}
+
+// Validate checks that the resource limits are valid.
+func (r Resources) Validate() error {
+	var errs []error
+	if r.Nice < -20 || r.Nice > 19 {
+		errs = append(errs, fmt.Errorf("nice %d: must be between -20 and 19", r.Nice))
+	}
+	for _, cpu := range r.CPUs {
+		if cpu < 0 || cpu >= maxCPUs {
+			errs = append(errs, fmt.Errorf("invalid cpu %d", cpu))
+		}
+	}
+	if r.Cgroup != "" && !filepath.IsAbs(r.Cgroup) {
+		errs = append(errs, fmt.Errorf("cgroup %q: must be an absolute path", r.Cgroup))
+	}
+	if r.CPUMax < 0 || r.MemoryMax < 0 {
+		errs = append(errs, errors.New("cgroup limits can't be negative"))
+	}
+	if (r.CPUMax > 0 || r.MemoryMax > 0) && r.Cgroup == "" {
+		errs = append(errs, errors.New("cgroup limits require a cgroup"))
+	}
+	if err := r.validatePlatform(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid resource limits: %w", err)
+	}
+	return nil
+}
+
+func (r Resources) isZero() bool {
+	return r.Nice == 0 && len(r.CPUs) == 0 && r.Cgroup == ""
+}
+
+// maxCPUs is the number of CPUs an affinity mask can hold (CPU_SETSIZE).
+const maxCPUs = 1024
+
+// ParseCPUList parses a list of CPUs, as used by taskset and cpusets, e.g. "0,2-3". CPUs must be below 1024.
+func ParseCPUList(s string) ([]int, error) {
+	var cpus []int
+	if s == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %q: %w", s, err)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("invalid cpu list %q: %w", s, err)
+			}
+		}
+		if from < 0 || to < from {
+			return nil, fmt.Errorf("invalid cpu list %q", s)
+		}
+		if to >= maxCPUs {
+			return nil, fmt.Errorf("invalid cpu list %q: cpus must be below %d", s, maxCPUs)
+		}
+		for cpu := from; cpu <= to; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
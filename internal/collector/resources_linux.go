@@ -0,0 +1,151 @@
+//go:build linux
+
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/procfs"
+	"golang.org/x/sys/unix"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cpuPeriod is the cgroup's CPU period, in microseconds.
+	cpuPeriod = 100000
+	// minCPUQuota is the smallest CPU quota the kernel accepts in cpu.max, in microseconds.
+	minCPUQuota = 1000
+	// userHZ is the unit of the CPU times in /proc/<pid>/stat.
+	userHZ = 100
+)
+
+func (r Resources) validatePlatform() error {
+	if r.CPUMax > 0 && r.CPUMax*cpuPeriod < minCPUQuota {
+		return fmt.Errorf("cgroup cpu max %g: must be at least %g", r.CPUMax, float64(minCPUQuota)/cpuPeriod)
+	}
+	return nil
+}
+
+// prepare creates the cgroup and configures cmd to start in it. The returned function must be called once cmd has started.
+func (r Resources) prepare(cmd *exec.Cmd) (func(), error) {
+	if r.Cgroup == "" {
+		return func() {}, nil
+	}
+	if err := r.setupCgroup(); err != nil {
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+	dir, err := os.Open(r.Cgroup)
+	if err != nil {
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+	// the process is started in the cgroup, so its children are too.
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return func() { _ = dir.Close() }, nil
+}
+
+// setupCgroup creates the cgroup and sets its limits.
+func (r Resources) setupCgroup() error {
+	if err := os.MkdirAll(r.Cgroup, 0o755); err != nil {
+		return err
+	}
+	var controllers []string
+	if r.CPUMax > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if r.MemoryMax > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if len(controllers) > 0 {
+		subtreeControl := filepath.Join(filepath.Dir(r.Cgroup), "cgroup.subtree_control")
+		if err := os.WriteFile(subtreeControl, []byte(strings.Join(controllers, " ")), 0); err != nil {
+			return fmt.Errorf("enable controllers: %w", err)
+		}
+	}
+	cpuMax, memoryMax := "max "+strconv.Itoa(cpuPeriod), "max"
+	if r.CPUMax > 0 {
+		cpuMax = strconv.Itoa(int(r.CPUMax*cpuPeriod)) + " " + strconv.Itoa(cpuPeriod)
+	}
+	if r.MemoryMax > 0 {
+		memoryMax = strconv.FormatInt(r.MemoryMax, 10)
+	}
+	return errors.Join(
+		writeCgroupFile(filepath.Join(r.Cgroup, "cpu.max"), cpuMax, r.CPUMax > 0),
+		writeCgroupFile(filepath.Join(r.Cgroup, "memory.max"), memoryMax, r.MemoryMax > 0),
+	)
+}
+
+// writeCgroupFile writes the value to a cgroup interface file. If the value isn't required, a missing file
+// (i.e. the controller isn't enabled) is ignored.
+func writeCgroupFile(path string, value string, required bool) error {
+	if _, err := os.Stat(path); err != nil && !required {
+		return nil
+	}
+	return os.WriteFile(path, []byte(value), 0)
+}
+
+// start starts cmd with the niceness and CPU affinity set. Both are per-thread attributes that a forked process
+// inherits, so they're set on a dedicated thread that starts cmd: the process has them from the start, before e.g. a
+// wrapper forks intel_gpu_top. The thread is never unlocked, so it's discarded when the goroutine returns.
+// Failing to set them is logged, as intel_gpu_top can still run without them.
+func (r Resources) start(cmd *exec.Cmd, logger *slog.Logger) error {
+	if r.Nice == 0 && len(r.CPUs) == 0 {
+		return cmd.Start()
+	}
+	started := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := r.apply(unix.Gettid()); err != nil {
+			logger.Warn("failed to apply resource limits", "err", err)
+		}
+		started <- cmd.Start()
+	}()
+	return <-started
+}
+
+// apply sets the niceness and CPU affinity of a thread.
+func (r Resources) apply(tid int) error {
+	var errs []error
+	if r.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, r.Nice); err != nil {
+			errs = append(errs, fmt.Errorf("nice: %w", err))
+		}
+	}
+	if len(r.CPUs) > 0 {
+		var set unix.CPUSet
+		for _, cpu := range r.CPUs {
+			set.Set(cpu)
+		}
+		if err := unix.SchedSetaffinity(tid, &set); err != nil {
+			errs = append(errs, fmt.Errorf("cpu affinity: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// groupUsage returns the CPU time (in seconds) and resident memory (in bytes) of the processes in a process group,
+// e.g. a wrapper like sudo and the intel_gpu_top it started, from /proc/<pid>/stat. The CPU time includes the children
+// they reaped.
+func groupUsage(pgid int) (float64, float64, error) {
+	procs, err := procfs.AllProcs()
+	if err != nil {
+		return 0, 0, err
+	}
+	var cpu, resident float64
+	for _, proc := range procs {
+		// processes may exit while we're reading
+		stat, err := proc.Stat()
+		if err != nil || stat.PGRP != pgid {
+			continue
+		}
+		cpu += stat.CPUTime() + float64(stat.CUTime+stat.CSTime)/userHZ
+		resident += float64(stat.ResidentMemory())
+	}
+	return cpu, resident, nil
+}
@@ -0,0 +1,84 @@
+package collector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestResources_setupCgroup(t *testing.T) {
+	// simulate the cgroup filesystem
+	root := t.TempDir()
+	cgroup := filepath.Join(root, "gpumon")
+	require.NoError(t, os.Mkdir(cgroup, 0o755))
+	for _, file := range []string{"cpu.max", "memory.max"} {
+		require.NoError(t, os.WriteFile(filepath.Join(cgroup, file), nil, 0o644))
+	}
+
+	r := Resources{Cgroup: cgroup, CPUMax: 0.5, MemoryMax: 64 << 20}
+	require.NoError(t, r.setupCgroup())
+	for file, want := range map[string]string{
+		filepath.Join(root, "cgroup.subtree_control"): "+cpu +memory",
+		filepath.Join(cgroup, "cpu.max"):              "50000 100000",
+		filepath.Join(cgroup, "memory.max"):           "67108864",
+	} {
+		got, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(got), file)
+	}
+}
+
+func TestRunner_Resources(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := Runner{logger: l, resources: Resources{Nice: 5, CPUs: []int{0}}}
+
+	stdout, err := r.Start(t.Context(), []string{"sh", "-c", "echo ready; sleep 60"})
+	require.NoError(t, err)
+	_, err = stdout.Read(make([]byte, 1024))
+	require.NoError(t, err)
+	pid := r.process.Load().cmd.Process.Pid
+
+	nice, err := unix.Getpriority(unix.PRIO_PROCESS, pid)
+	require.NoError(t, err)
+	// the raw syscall returns 20 - nice
+	assert.Equal(t, 20-5, nice)
+	var set unix.CPUSet
+	require.NoError(t, unix.SchedGetaffinity(pid, &set))
+	assert.Equal(t, 1, set.Count())
+	assert.True(t, set.IsSet(0))
+	// the exporter's other threads are left alone
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	nice, err = unix.Getpriority(unix.PRIO_PROCESS, unix.Gettid())
+	require.NoError(t, err)
+	assert.Equal(t, 20, nice)
+
+	_, resident := r.usage()
+	assert.NotZero(t, resident)
+
+	require.NoError(t, r.Stop())
+	_, resident = r.usage()
+	assert.Zero(t, resident)
+}
+
+func TestRunner_usage_ProcessGroup(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := Runner{logger: l}
+
+	// the leader only waits: the CPU time is used by its child, e.g. intel_gpu_top started by a wrapper
+	stdout, err := r.Start(t.Context(), []string{"sh", "-c", "while :; do :; done & echo ready; wait"})
+	require.NoError(t, err)
+	_, err = stdout.Read(make([]byte, 1024))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		cpu, _ := r.usage()
+		return cpu >= 0.1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, r.Stop())
+}
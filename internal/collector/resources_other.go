@@ -0,0 +1,31 @@
+//go:build !linux
+
+package collector
+
+import (
+	"errors"
+	"log/slog"
+	"os/exec"
+)
+
+func (r Resources) validatePlatform() error {
+	if !r.isZero() {
+		return errors.New("resource limits are only supported on Linux")
+	}
+	return nil
+}
+
+// prepare is a no-op: resource limits are only supported on Linux.
+func (r Resources) prepare(*exec.Cmd) (func(), error) {
+	return func() {}, nil
+}
+
+// start starts cmd: resource limits are only supported on Linux.
+func (r Resources) start(cmd *exec.Cmd, _ *slog.Logger) error {
+	return cmd.Start()
+}
+
+// groupUsage is not supported on this platform.
+func groupUsage(int) (float64, float64, error) {
+	return 0, 0, errors.ErrUnsupported
+}
@@ -0,0 +1,62 @@
+package collector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"runtime"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []int
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{input: "", want: nil, wantErr: assert.NoError},
+		{input: "1", want: []int{1}, wantErr: assert.NoError},
+		{input: "0,2-4", want: []int{0, 2, 3, 4}, wantErr: assert.NoError},
+		{input: "a", wantErr: assert.Error},
+		{input: "3-1", wantErr: assert.Error},
+		{input: "1-", wantErr: assert.Error},
+		{input: "0-100000000", wantErr: assert.Error},
+		{input: "1024", wantErr: assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseCPUList(tt.input)
+			tt.wantErr(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResources_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources Resources
+		wantErr   assert.ErrorAssertionFunc
+	}{
+		{name: "none", wantErr: assert.NoError},
+		{name: "invalid nice", resources: Resources{Nice: 20}, wantErr: assert.Error},
+		{name: "relative cgroup", resources: Resources{Cgroup: "gpumon"}, wantErr: assert.Error},
+		{name: "limits without cgroup", resources: Resources{MemoryMax: 1 << 20}, wantErr: assert.Error},
+		{name: "negative limit", resources: Resources{Cgroup: "/sys/fs/cgroup/gpumon", CPUMax: -1}, wantErr: assert.Error},
+	}
+	if runtime.GOOS == "linux" {
+		tests = append(tests, struct {
+			name      string
+			resources Resources
+			wantErr   assert.ErrorAssertionFunc
+		}{name: "valid", resources: Resources{Nice: 10, CPUs: []int{0}, Cgroup: "/sys/fs/cgroup/gpumon", CPUMax: .5, MemoryMax: 1 << 26}, wantErr: assert.NoError},
+			struct {
+				name      string
+				resources Resources
+				wantErr   assert.ErrorAssertionFunc
+			}{name: "cpu max below the kernel's minimum", resources: Resources{Cgroup: "/sys/fs/cgroup/gpumon", CPUMax: .005}, wantErr: assert.Error})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.wantErr(t, tt.resources.Validate())
+		})
+	}
+}
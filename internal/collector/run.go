@@ -2,7 +2,10 @@ package collector
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rmarchant/intel-gpu-exporter/internal/history"
 	"log/slog"
 	"time"
 )
@@ -11,15 +14,115 @@ var (
 	version = "change-me"
 )
 
-func Run(ctx context.Context, r prometheus.Registerer, scanInterval time.Duration, logger *slog.Logger) error {
-	return runWithTopReader(ctx, r, NewTopReader(logger, scanInterval), logger)
+// Config contains the configuration of the collector.
+type Config struct {
+	// Interval is the interval at which intel_gpu_top measures GPU usage.
+	Interval time.Duration
+	// Command is the template of the command that runs intel_gpu_top.
+	Command Command
+	// Resources limits the resources used by intel_gpu_top.
+	Resources Resources
+	// Timeout is the time without data after which intel_gpu_top is restarted. Defaults to 15s.
+	Timeout time.Duration
+	// CheckInterval is the interval at which the watchdog checks intel_gpu_top. Defaults to 1s.
+	CheckInterval time.Duration
+	// FrozenRecords is the number of identical consecutive records after which intel_gpu_top's output is
+	// considered frozen and intel_gpu_top is restarted. Zero disables detection.
+	FrozenRecords int
+	// Raw exports all numeric values reported by intel_gpu_top as gpumon_raw, including the ones the exporter doesn't model.
+	Raw bool
+	// Validation determines what happens to samples with invalid values (e.g. engine busy above 100%).
+	Validation ValidationPolicy
+	// Lazy only runs intel_gpu_top while the exporter is being scraped.
+	Lazy bool
+	// IdleTimeout is the time without scrapes after which intel_gpu_top is stopped in lazy mode.
+	IdleTimeout time.Duration
+	// Sync runs intel_gpu_top for a fixed sampling window on each scrape, instead of running it continuously.
+	Sync bool
+	// Targets are remote hosts to monitor over SSH. If empty, the exporter monitors the local host.
+	Targets []Target
+	// SSH is the SSH configuration used to connect to the Targets.
+	SSH SSHConfig
+	// Health, if set, receives the status of each source.
+	Health *Health
+	// API, if set, serves the GPU statistics of each source.
+	API *API
+	// History, if set, keeps the history of each source.
+	History *history.Store
 }
 
-func runWithTopReader(ctx context.Context, r prometheus.Registerer, reader *TopReader, logger *slog.Logger) error {
+// A reader measures GPU usage and reports it to Prometheus.
+type reader interface {
+	prometheus.Collector
+	statsReporter
+	Run(ctx context.Context) error
+}
+
+func Run(ctx context.Context, r prometheus.Registerer, cfg Config, logger *slog.Logger) error {
 	logger.Info("intel-gpu-exporter starting", "version", version)
 	defer logger.Info("intel-gpu-exporter shutting down")
 
-	r.MustRegister(&reader.Aggregator)
+	if len(cfg.Targets) == 0 {
+		reader := newReader(logger, cfg, nil)
+		register(ctx, cfg, reader)
+		return runWithReader(ctx, r, reader, logger)
+	}
+	return runWithTargets(ctx, r, cfg, logger)
+}
+
+// runWithTargets runs a reader for each remote target. The metrics of each target are labeled with the target's name.
+func runWithTargets(ctx context.Context, r prometheus.Registerer, cfg Config, logger *slog.Logger) error {
+	if !cfg.Resources.isZero() {
+		return errors.New("resource limits are not supported for remote targets")
+	}
+	names := make(map[string]struct{}, len(cfg.Targets))
+	for _, target := range cfg.Targets {
+		if _, ok := names[target.Name]; ok {
+			return fmt.Errorf("duplicate target %q", target.Name)
+		}
+		names[target.Name] = struct{}{}
+	}
+
+	errCh := make(chan error, len(cfg.Targets))
+	for _, target := range cfg.Targets {
+		targetLogger := logger.With("target", target.Name)
+		targetRegisterer := prometheus.WrapRegistererWith(prometheus.Labels{"target": target.Name}, r)
+		reader := newReader(targetLogger, cfg, &target)
+		register(ctx, cfg, reader)
+		go func() {
+			errCh <- runWithReader(ctx, targetRegisterer, reader, targetLogger)
+		}()
+	}
+	var errs []error
+	for range cfg.Targets {
+		errs = append(errs, <-errCh)
+	}
+	return errors.Join(errs...)
+}
+
+// newReader returns the reader for the configured mode. If target is not nil, the reader runs intel_gpu_top on
+// the target over SSH.
+func newReader(logger *slog.Logger, cfg Config, target *Target) reader {
+	var runner topRunner = newRunner(logger, cfg)
+	name := localSource
+	if target != nil {
+		runner = newSSHRunner(logger, *target, cfg)
+		name = target.Name
+	}
+	if cfg.Sync {
+		r := NewSyncReader(logger, cfg)
+		r.topRunner = runner
+		r.name = name
+		return r
+	}
+	r := NewTopReader(logger, cfg)
+	r.topRunner = runner
+	r.name = name
+	return r
+}
+
+func runWithReader(ctx context.Context, r prometheus.Registerer, reader reader, logger *slog.Logger) error {
+	r.MustRegister(reader)
 
 	errCh := make(chan error)
 	go func() {
@@ -36,3 +139,20 @@ func runWithTopReader(ctx context.Context, r prometheus.Registerer, reader *TopR
 		return nil
 	}
 }
+
+// register adds the reader to the Health and API in cfg. If cfg has a History, the reader's samples are recorded
+// until ctx is done.
+func register(ctx context.Context, cfg Config, reader reader) {
+	if cfg.Health != nil {
+		cfg.Health.add(reader)
+	}
+	if cfg.API != nil {
+		cfg.API.add(reader)
+	}
+	if cfg.History != nil {
+		// the history doesn't go through a subscriber: its samples must not be dropped
+		q := newQueue()
+		reader.samples().attach(q, reader.Status().Name)
+		go record(ctx, cfg.History, reader.samples(), q)
+	}
+}
@@ -14,15 +14,15 @@ func Test_run(t *testing.T) {
 	l := slog.New(slog.DiscardHandler)
 
 	r := prometheus.NewRegistry()
-	reader := NewTopReader(l, 100*time.Millisecond)
+	reader := NewTopReader(l, Config{Interval: 100 * time.Millisecond})
 	reader.topRunner = &fakeRunner{interval: 100 * time.Millisecond}
 
 	go func() {
-		assert.NoError(t, runWithTopReader(t.Context(), r, reader, l))
+		assert.NoError(t, runWithReader(t.Context(), r, reader, l))
 	}()
 
 	assert.Eventually(t, func() bool {
 		n, err := testutil.GatherAndCount(r)
-		return err == nil && n == 15
+		return err == nil && n == 44
 	}, 5*time.Second, 100*time.Millisecond)
 }
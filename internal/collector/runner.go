@@ -1,42 +1,389 @@
 package collector
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"io"
 	"log/slog"
+	"os"
 	"os/exec"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Runner starts / stops a process and collects its stdout output.
+//
+// The process's stderr is logged and the last lines are kept, so Stop can report why the process failed.
+//
+// The process is started in its own process group. If intel_gpu_top is wrapped (e.g. by sudo, ssh or a shell),
+// Stop terminates the wrapper and all of its children.
+//
+// Runner can limit the resources used by the process (see Resources) and reports the process's CPU time and memory.
 type Runner struct {
-	logger     *slog.Logger
-	cmd        atomic.Pointer[exec.Cmd]
-	runCounter atomic.Int32
+	logger      *slog.Logger
+	process     atomic.Pointer[process]
+	runCounter  atomic.Int32
+	gracePeriod time.Duration // time between SIGTERM and SIGKILL. Defaults to defaultGracePeriod.
+	lock        sync.Mutex    // serializes Start and Stop
+	env         []string      // additional environment variables
+	dir         string        // working directory
+	resources   Resources
+	usageLock   sync.Mutex
+	cpuDone     float64 // CPU time used by processes that have exited
+	cpuLast     float64 // last CPU time read for the current process
 }
 
+var (
+	sourceCPUMetric = prometheus.NewDesc(
+		prometheus.BuildFQName("gpumon", "source", "cpu_seconds_total"),
+		"CPU time used by intel_gpu_top, including its wrapper and any other process in its process group",
+		nil,
+		nil,
+	)
+	sourceResidentMetric = prometheus.NewDesc(
+		prometheus.BuildFQName("gpumon", "source", "resident_bytes"),
+		"Resident memory size of intel_gpu_top, including its wrapper and any other process in its process group",
+		nil,
+		nil,
+	)
+)
+
+// newRunner returns a Runner for the command configured in cfg.
+func newRunner(logger *slog.Logger, cfg Config) *Runner {
+	return &Runner{
+		logger:    logger.With("subsystem", "runner"),
+		env:       cfg.Command.env(cfg.Interval),
+		dir:       cfg.Command.dir(cfg.Interval),
+		resources: cfg.Resources,
+	}
+}
+
+var errAlreadyRunning = errors.New("already running")
+
+// defaultGracePeriod is the time a process gets to shut down after SIGTERM before it is killed.
+const defaultGracePeriod = 5 * time.Second
+
+type process struct {
+	cmd    *exec.Cmd
+	stdout *output
+	stderr *stderrBuffer
+	exited chan struct{}
+	lock   sync.Mutex // serializes signals with the leader's exit
+	done   bool       // the leader has exited: the process group must no longer be signaled
+}
+
+// output is the read end of the process's stdout. It records whether the process closed its stdout, which it
+// normally only does when it exits.
+type output struct {
+	reader io.Reader
+	eof    atomic.Bool
+}
+
+func (o *output) Read(p []byte) (int, error) {
+	n, err := o.reader.Read(p)
+	if err == io.EOF {
+		o.eof.Store(true)
+	}
+	return n, err
+}
+
+func (o *output) Close() error {
+	if closer, ok := o.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Start starts the command and returns its stdout. Only one process can run at a time: Start fails if the previous
+// process hasn't been stopped.
 func (t *Runner) Start(ctx context.Context, cmdline []string) (io.Reader, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.process.Load() != nil {
+		return nil, errAlreadyRunning
+	}
 	cmd := exec.CommandContext(ctx, cmdline[0], cmdline[1:]...)
-	stdout, _ := cmd.StdoutPipe()
+	setProcessGroup(cmd)
+	p := process{cmd: cmd, stderr: &stderrBuffer{logger: t.logger}, exited: make(chan struct{})}
+	// if ctx is canceled, give the process group the same grace period as Stop does.
+	cmd.Cancel = func() error { return p.signal(terminate) }
+	cmd.WaitDelay = t.grace()
+	if len(t.env) > 0 {
+		cmd.Env = append(os.Environ(), t.env...)
+	}
+	cmd.Dir = t.dir
+	release, err := t.resources.prepare(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	// use our own pipe rather than cmd.StdoutPipe(), so the process can be reaped while we're still reading its output.
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("pipe: %w", err)
+	}
+	p.stdout = &output{reader: stdout}
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = p.stderr
 	t.runCounter.Add(1)
-	if err := cmd.Start(); err != nil {
+	err = t.resources.start(cmd, t.logger)
+	// the process has its own copy of the writer
+	_ = stdoutWriter.Close()
+	if err != nil {
+		_ = stdout.Close()
 		return nil, fmt.Errorf("could not start command: %w", err)
 	}
 	t.logger.Debug("started top command", "count", t.runCounter.Load(), "pid", cmd.Process.Pid)
-	t.cmd.Store(cmd)
-	return stdout, nil
+	go func() {
+		if awaitExit(cmd.Process.Pid) == nil {
+			// the leader has exited, but isn't reaped yet: its process group can't be reused, so it's safe to kill
+			// anything left in it, so no orphans keep the PMU busy.
+			_ = p.signal(kill)
+			p.leaderExited()
+			_ = cmd.Wait()
+		} else {
+			// the leader can only be waited for by reaping it. Its children are left alone: signaling the group now
+			// could hit an unrelated process group.
+			_ = cmd.Wait()
+			p.leaderExited()
+		}
+		t.exited(cmd.ProcessState)
+		close(p.exited)
+	}()
+	t.process.Store(&p)
+	return p.stdout, nil
+}
+
+// signal sends a signal to the process group, using terminate or kill. Once the leader has exited, the process group
+// is no longer signaled, as its id may be reused.
+func (p *process) signal(send func(*os.Process) error) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.done {
+		return os.ErrProcessDone
+	}
+	return send(p.cmd.Process)
+}
+
+// leaderExited records that the process group's leader has exited.
+func (p *process) leaderExited() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done = true
+}
+
+// Stop stops the process. If the process had already exited by itself, Stop returns an *ExitError describing how it exited.
+//
+// Stop waits at most one grace period: if the process is still running by then, it is killed and reaped in the background.
+func (t *Runner) Stop() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p := t.process.Load()
+	if p == nil {
+		return nil
+	}
+	t.logger.Debug("stopping top command", "count", t.runCounter.Load(), "pid", p.cmd.Process.Pid)
+	defer func() {
+		_ = p.stdout.Close()
+		t.process.Store(nil)
+	}()
+	deadline := time.NewTimer(t.grace())
+	defer deadline.Stop()
+	expired := false
+	// waitExited waits for the process to exit, until the deadline. Returns false if the process is still running.
+	waitExited := func() bool {
+		if !expired {
+			select {
+			case <-p.exited:
+				return true
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		select {
+		case <-p.exited:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// if the process closed its stdout, it's exiting by itself, but may not have been reaped yet: wait for its exit
+	// status rather than mistaking the exit for our own SIGTERM.
+	if p.stdout.eof.Load() {
+		waitExited()
+	}
+	select {
+	case <-p.exited:
+		exitErr := newExitError(p.cmd.ProcessState, p.stderr.Lines())
+		t.logger.Debug("top command exited", "code", exitErr.Code, "signal", exitErr.Signal, "reason", exitErr.Reason)
+		return exitErr
+	default:
+	}
+
+	// we stop the process: its exit status doesn't tell us anything.
+	_ = p.signal(terminate)
+	if waitExited() {
+		return nil
+	}
+	t.logger.Warn("top command did not stop after SIGTERM. killing it", "pid", p.cmd.Process.Pid, "gracePeriod", t.grace())
+	_ = p.signal(kill)
+	return nil
+}
+
+// waitClosed waits up to timeout for ch to be closed. Returns false if ch wasn't closed in time.
+func waitClosed(ch <-chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		return false
+	}
 }
 
-func (t *Runner) Stop() {
-	if cmd := t.cmd.Load(); cmd != nil {
-		t.logger.Debug("stopping top command", "count", t.runCounter.Load(), "pid", cmd.Process.Pid)
-		t.cmd.Store(nil)
-		_ = cmd.Process.Kill()
-		_ = cmd.Wait()
+func (t *Runner) grace() time.Duration {
+	if t.gracePeriod > 0 {
+		return t.gracePeriod
 	}
+	return defaultGracePeriod
 }
 
 func (t *Runner) Running() bool {
-	return t.cmd.Load() != nil
+	return t.process.Load() != nil
+}
+
+// exited records the CPU time used by a process that exited.
+func (t *Runner) exited(state *os.ProcessState) {
+	t.usageLock.Lock()
+	defer t.usageLock.Unlock()
+	// the last value read from /proc may be rounded up: make sure the total never goes down.
+	t.cpuDone += max((state.UserTime() + state.SystemTime()).Seconds(), t.cpuLast)
+	t.cpuLast = 0
+}
+
+// usage returns the total CPU time used by all processes and the resident memory of the current process group.
+func (t *Runner) usage() (float64, float64) {
+	t.usageLock.Lock()
+	defer t.usageLock.Unlock()
+	var resident float64
+	if p := t.process.Load(); p != nil {
+		select {
+		case <-p.exited:
+		default:
+			if cpu, rss, err := groupUsage(p.cmd.Process.Pid); err == nil {
+				t.cpuLast = max(cpu, t.cpuLast)
+				resident = rss
+			}
+		}
+	}
+	return t.cpuDone + t.cpuLast, resident
+}
+
+// Describe implements the prometheus.Collector interface.
+func (t *Runner) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sourceCPUMetric
+	ch <- sourceResidentMetric
+}
+
+// Collect implements the prometheus.Collector interface.
+func (t *Runner) Collect(ch chan<- prometheus.Metric) {
+	cpu, resident := t.usage()
+	ch <- prometheus.MustNewConstMetric(sourceCPUMetric, prometheus.CounterValue, cpu)
+	ch <- prometheus.MustNewConstMetric(sourceResidentMetric, prometheus.GaugeValue, resident)
+}
+
+// ExitError describes how intel_gpu_top exited.
+type ExitError struct {
+	// Code is the process's exit code, or -1 if it was terminated by a signal.
+	Code int
+	// Signal is the signal that terminated the process, if any.
+	Signal string
+	// Stderr contains the last lines the process wrote to stderr.
+	Stderr []string
+	// Reason classifies the failure, based on the process's output (e.g. permission_denied).
+	Reason FailureReason
+}
+
+func newExitError(state *os.ProcessState, stderr []string) *ExitError {
+	var signal string
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		signal = status.Signal().String()
+	}
+	return exitError(state.ExitCode(), signal, stderr)
+}
+
+func exitError(code int, signal string, stderr []string) *ExitError {
+	e := ExitError{Code: code, Signal: signal, Stderr: stderr}
+	e.Reason = classifyFailure(strings.Join(stderr, "\n"))
+	if e.Reason == FailureUnknown {
+		e.Reason = FailureExited
+	}
+	return &e
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("exit status %d", e.Code)
+	if e.Signal != "" {
+		msg = "terminated by signal " + e.Signal
+	}
+	if len(e.Stderr) > 0 {
+		msg += ": " + e.Stderr[len(e.Stderr)-1]
+	}
+	return msg
+}
+
+// stderrLines is the number of stderr lines kept for diagnostics.
+const stderrLines = 20
+
+// stderrBuffer receives the process's stderr output. It logs each line and keeps the last stderrLines lines.
+type stderrBuffer struct {
+	logger  *slog.Logger
+	partial []byte
+	lines   []string
+	lock    sync.Mutex
+}
+
+func (s *stderrBuffer) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i == -1 {
+			break
+		}
+		s.addLine(string(bytes.TrimRight(s.partial[:i], "\r")))
+		s.partial = s.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (s *stderrBuffer) addLine(line string) {
+	if line == "" {
+		return
+	}
+	s.logger.Warn("intel-gpu-top", "stderr", line)
+	if len(s.lines) == stderrLines {
+		s.lines = append(s.lines[:0], s.lines[1:]...)
+	}
+	s.lines = append(s.lines, line)
+}
+
+// Lines returns the last lines written to stderr, including any final line without a newline.
+func (s *stderrBuffer) Lines() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.partial) > 0 {
+		s.addLine(string(s.partial))
+		s.partial = s.partial[:0]
+	}
+	return append([]string(nil), s.lines...)
 }
@@ -0,0 +1,20 @@
+//go:build linux
+
+package collector
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+)
+
+// awaitExit waits for the process to exit, without reaping it: until it is reaped, its pid and process group id can't
+// be reused.
+func awaitExit(pid int) error {
+	for {
+		var info unix.Siginfo
+		err := unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WNOWAIT, nil)
+		if !errors.Is(err, unix.EINTR) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package collector
+
+import "errors"
+
+// awaitExit is not supported: other platforms can only wait for a process by reaping it.
+func awaitExit(_ int) error {
+	return errors.ErrUnsupported
+}
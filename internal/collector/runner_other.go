@@ -0,0 +1,21 @@
+//go:build !unix
+
+package collector
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op: process groups are only supported on unix.
+func setProcessGroup(_ *exec.Cmd) {}
+
+// terminate kills the process: other platforms don't support SIGTERM.
+func terminate(p *os.Process) error {
+	return p.Kill()
+}
+
+// kill kills the process.
+func kill(p *os.Process) error {
+	return p.Kill()
+}
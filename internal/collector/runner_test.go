@@ -3,11 +3,19 @@
 package collector
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRunner(t *testing.T) {
@@ -21,13 +29,141 @@ func TestRunner(t *testing.T) {
 	require.NoError(t, err)
 	line := make([]byte, 1024)
 	assert.True(t, r.Running())
+	// only one process can run at a time
+	_, err = r.Start(ctx, []string{"sh", "-c", "sleep 60"})
+	assert.ErrorIs(t, err, errAlreadyRunning)
 	n, err := stdout.Read(line)
 	assert.NoError(t, err)
 	assert.Equal(t, "hello world\n", string(line[:n]))
-	r.Stop()
+	// we stopped the command: no exit error
+	assert.NoError(t, r.Stop())
 
 	// invalid command
 	_, err = r.Start(ctx, []string{"not a command"})
 	assert.Error(t, err)
 	assert.False(t, r.Running())
 }
+
+func TestRunner_EnvDir(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	dir := t.TempDir()
+	r := Runner{logger: l, env: []string{"FOO=bar"}, dir: dir}
+
+	stdout, err := r.Start(t.Context(), []string{"sh", "-c", `echo "$FOO"; pwd`})
+	require.NoError(t, err)
+	output, err := io.ReadAll(stdout)
+	require.NoError(t, err)
+	realDir, err := filepath.EvalSymlinks(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "bar\n"+realDir+"\n", string(output))
+	_ = r.Stop()
+}
+
+func TestRunner_ExitError(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := Runner{logger: l}
+
+	stdout, err := r.Start(t.Context(), []string{"sh", "-c", "echo 'Failed to initialize PMU! (Permission denied)' >&2; exit 3"})
+	require.NoError(t, err)
+	// the command closed its stdout: Stop waits for it to exit
+	_, err = io.ReadAll(stdout)
+	require.NoError(t, err)
+
+	err = r.Stop()
+	var exitErr *ExitError
+	require.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, 3, exitErr.Code)
+	assert.Empty(t, exitErr.Signal)
+	assert.Equal(t, FailurePermissionDenied, exitErr.Reason)
+	assert.Equal(t, []string{"Failed to initialize PMU! (Permission denied)"}, exitErr.Stderr)
+	assert.Equal(t, "exit status 3: Failed to initialize PMU! (Permission denied)", err.Error())
+	assert.False(t, r.Running())
+}
+
+func TestRunner_Signal(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := Runner{logger: l}
+
+	stdout, err := r.Start(t.Context(), []string{"sh", "-c", "kill -TERM $$"})
+	require.NoError(t, err)
+	_, _ = io.ReadAll(stdout)
+
+	var exitErr *ExitError
+	require.ErrorAs(t, r.Stop(), &exitErr)
+	assert.Equal(t, -1, exitErr.Code)
+	assert.Equal(t, "terminated", exitErr.Signal)
+	assert.Equal(t, FailureExited, exitErr.Reason)
+}
+
+func TestRunner_GracePeriod(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := Runner{logger: l, gracePeriod: 500 * time.Millisecond}
+
+	// ignored signals are inherited: the whole process group ignores SIGTERM.
+	stdout, err := r.Start(t.Context(), []string{"sh", "-c", "trap '' TERM; echo ready; sleep 60"})
+	require.NoError(t, err)
+	line := make([]byte, 1024)
+	_, err = stdout.Read(line)
+	require.NoError(t, err)
+
+	start := time.Now()
+	assert.NoError(t, r.Stop())
+	// Stop waits for one grace period, then kills the process group without waiting for it to be reaped
+	assert.GreaterOrEqual(t, time.Since(start), r.gracePeriod)
+	assert.Less(t, time.Since(start), r.gracePeriod+250*time.Millisecond)
+	assert.False(t, r.Running())
+}
+
+func TestRunner_ProcessGroup(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("requires /proc")
+	}
+	l := slog.New(slog.DiscardHandler)
+	r := Runner{logger: l}
+
+	// the shell wrapper starts a child and reports its pid
+	stdout, err := r.Start(t.Context(), []string{"sh", "-c", "sleep 60 & echo $!; wait"})
+	require.NoError(t, err)
+	line := make([]byte, 1024)
+	n, err := stdout.Read(line)
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(line[:n])))
+	require.NoError(t, err)
+	require.True(t, processAlive(pid))
+
+	assert.NoError(t, r.Stop())
+	assert.Eventually(t, func() bool { return !processAlive(pid) }, time.Second, 10*time.Millisecond)
+}
+
+func TestRunner_ProcessGroup_LeaderExited(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("requires /proc")
+	}
+	l := slog.New(slog.DiscardHandler)
+	r := Runner{logger: l}
+
+	// the shell wrapper exits, leaving its child behind
+	stdout, err := r.Start(t.Context(), []string{"sh", "-c", "sleep 60 >/dev/null & echo $!"})
+	require.NoError(t, err)
+	output, err := io.ReadAll(stdout)
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	require.NoError(t, err)
+
+	// the rest of the process group is killed before the leader is reaped
+	var exitErr *ExitError
+	require.ErrorAs(t, r.Stop(), &exitErr)
+	assert.Equal(t, 0, exitErr.Code)
+	assert.Eventually(t, func() bool { return !processAlive(pid) }, time.Second, 10*time.Millisecond)
+}
+
+// processAlive returns true if the process exists and is not a zombie.
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// the state follows the command name, which is enclosed in parentheses
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z" && fields[0] != "X"
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package collector
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in a new process group, with the command as its leader.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminate sends SIGTERM to the process group.
+func terminate(p *os.Process) error {
+	return signalGroup(p, syscall.SIGTERM)
+}
+
+// kill sends SIGKILL to the process group.
+func kill(p *os.Process) error {
+	return signalGroup(p, syscall.SIGKILL)
+}
+
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	err := syscall.Kill(-p.Pid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		return os.ErrProcessDone
+	}
+	return err
+}
@@ -0,0 +1,347 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target is a remote host whose GPU is monitored over SSH.
+type Target struct {
+	// Name is the value of the target label. Defaults to the host.
+	Name string
+	// Address is the host and port of the SSH server.
+	Address string
+	// User is the SSH user.
+	User string
+}
+
+// ParseTarget parses a target in the format [name=][user@]host[:port]. The port defaults to 22.
+// If no user is specified, the user from the SSHConfig is used.
+func ParseTarget(s string) (Target, error) {
+	var target Target
+	rest := s
+	if name, after, ok := strings.Cut(rest, "="); ok {
+		target.Name, rest = name, after
+	}
+	if user, host, ok := strings.Cut(rest, "@"); ok {
+		target.User, rest = user, host
+	}
+	host, port, err := net.SplitHostPort(rest)
+	if err != nil {
+		host, port = rest, "22"
+	}
+	if host == "" {
+		return Target{}, fmt.Errorf("invalid target %q: missing host", s)
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return Target{}, fmt.Errorf("invalid target %q: invalid port %q", s, port)
+	}
+	target.Address = net.JoinHostPort(host, port)
+	if target.Name == "" {
+		target.Name = host
+	}
+	return target, nil
+}
+
+// SSHConfig contains the SSH configuration shared by all targets.
+type SSHConfig struct {
+	// User is the SSH user for targets that don't specify one.
+	User string
+	// Auth contains the authentication methods, e.g. ssh.PublicKeys.
+	Auth []ssh.AuthMethod
+	// HostKeyCallback verifies the targets' host keys, e.g. using knownhosts.New.
+	HostKeyCallback ssh.HostKeyCallback
+	// Timeout is the maximum time to connect to a target. Defaults to 10s.
+	Timeout time.Duration
+	// KeepAlive is the interval at which keepalives are sent to detect broken connections. Defaults to 15s.
+	KeepAlive time.Duration
+}
+
+// sshRunner is a topRunner that runs intel_gpu_top on a remote host over SSH. sshRunner keeps a persistent connection
+// to the host: a new session is started on the existing connection when intel_gpu_top is restarted. If the connection
+// fails, it is re-established on the next Start.
+type sshRunner struct {
+	logger      *slog.Logger
+	target      Target
+	config      SSHConfig
+	env         []string
+	dir         string
+	gracePeriod time.Duration
+	lock        sync.Mutex
+	client      *ssh.Client
+	session     *sshSession
+}
+
+// sshSession is one run of intel_gpu_top on the remote host.
+type sshSession struct {
+	session *ssh.Session
+	stdout  *output
+	stderr  *stderrBuffer
+	exited  chan struct{}
+	err     error
+}
+
+// newSSHRunner returns an sshRunner for the target, running the command configured in cfg.
+func newSSHRunner(logger *slog.Logger, target Target, cfg Config) *sshRunner {
+	return &sshRunner{
+		logger:      logger.With("subsystem", "ssh"),
+		target:      target,
+		config:      cfg.SSH,
+		env:         cfg.Command.env(cfg.Interval),
+		dir:         cfg.Command.dir(cfg.Interval),
+		gracePeriod: defaultGracePeriod,
+	}
+}
+
+func (s *sshRunner) Start(ctx context.Context, cmdline []string) (io.Reader, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.session != nil {
+		return nil, errAlreadyRunning
+	}
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		// the connection is broken: reconnect on the next attempt
+		s.disconnect()
+		return nil, fmt.Errorf("ssh session: %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, fmt.Errorf("ssh session: %w", err)
+	}
+	stderr := stderrBuffer{logger: s.logger}
+	session.Stderr = &stderr
+	if err = session.Start(remoteCommand(cmdline, s.env, s.dir)); err != nil {
+		_ = session.Close()
+		return nil, fmt.Errorf("could not start command: %w", err)
+	}
+	s.logger.Debug("started top command", "target", s.target.Name)
+
+	p := sshSession{session: session, stdout: &output{reader: stdout}, stderr: &stderr, exited: make(chan struct{})}
+	go func() {
+		p.err = session.Wait()
+		close(p.exited)
+	}()
+	s.session = &p
+	// stop the session if ctx is canceled
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = session.Close()
+		case <-p.exited:
+		}
+	}()
+	return p.stdout, nil
+}
+
+// Stop stops intel_gpu_top on the remote host. If it had already exited by itself, Stop returns an *ExitError
+// describing how it exited. The connection to the host is kept open.
+func (s *sshRunner) Stop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.session
+	if p == nil {
+		return nil
+	}
+	s.session = nil
+	defer func() { _ = p.session.Close() }()
+
+	// if the command closed its stdout, it's exiting by itself: wait for its exit status to arrive.
+	if p.stdout.eof.Load() {
+		waitClosed(p.exited, s.gracePeriod)
+	}
+	select {
+	case <-p.exited:
+		return s.exitError(p)
+	default:
+	}
+
+	// we stop the process: its exit status doesn't tell us anything.
+	// not all SSH servers support signals. Closing the session makes the server stop the process.
+	_ = p.session.Signal(ssh.SIGTERM)
+	if !waitClosed(p.exited, s.gracePeriod) {
+		s.logger.Warn("top command did not stop after SIGTERM. closing session", "target", s.target.Name)
+		_ = p.session.Close()
+	}
+	return nil
+}
+
+// exitError converts the result of the session into an *ExitError.
+func (s *sshRunner) exitError(p *sshSession) error {
+	var sshErr *ssh.ExitError
+	switch {
+	case p.err == nil:
+		return exitError(0, "", p.stderr.Lines())
+	case errors.As(p.err, &sshErr):
+		var signal string
+		if sshErr.Signal() != "" {
+			signal = "SIG" + sshErr.Signal()
+		}
+		code := sshErr.ExitStatus()
+		if signal != "" {
+			code = -1
+		}
+		return exitError(code, signal, p.stderr.Lines())
+	default:
+		// e.g. the connection was lost
+		s.disconnect()
+		return fmt.Errorf("ssh session: %w", p.err)
+	}
+}
+
+func (s *sshRunner) Running() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.session != nil
+}
+
+// connect returns the connection to the target, connecting to it if needed.
+func (s *sshRunner) connect(ctx context.Context) (*ssh.Client, error) {
+	if s.client != nil {
+		return s.client, nil
+	}
+	timeout := s.config.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	user := s.target.User
+	if user == "" {
+		user = s.config.User
+	}
+	config := ssh.ClientConfig{
+		User:            user,
+		Auth:            s.config.Auth,
+		HostKeyCallback: s.config.HostKeyCallback,
+		Timeout:         timeout,
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.target.Address)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, channels, requests, err := ssh.NewClientConn(conn, s.target.Address, &config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("ssh: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	s.client = ssh.NewClient(c, channels, requests)
+	s.logger.Info("connected", "target", s.target.Name, "address", s.target.Address)
+	go s.keepAlive(s.client)
+	return s.client, nil
+}
+
+// keepAlive sends keepalives to the target, so a broken connection is detected (and closed) even if the session hangs.
+// A keepalive that isn't answered within the keepalive interval also counts as a broken connection.
+func (s *sshRunner) keepAlive(client *ssh.Client) {
+	interval := s.config.KeepAlive
+	if interval == 0 {
+		interval = 15 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	done := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := sendKeepAlive(client, interval); err != nil {
+				s.logger.Warn("connection lost", "target", s.target.Name, "err", err)
+				s.lock.Lock()
+				if s.client == client {
+					s.disconnect()
+				} else {
+					_ = client.Close()
+				}
+				s.lock.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// sendKeepAlive sends a keepalive request and waits up to timeout for the reply.
+func sendKeepAlive(client *ssh.Client, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return errors.New("keepalive timed out")
+	}
+}
+
+// disconnect closes the connection to the target. Must be called with the lock held.
+func (s *sshRunner) disconnect() {
+	if s.client != nil {
+		_ = s.client.Close()
+		s.client = nil
+	}
+}
+
+// Close closes the connection to the target.
+func (s *sshRunner) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.disconnect()
+	return nil
+}
+
+// remoteCommand returns the command line to run on the remote host. Environment variables and the working directory
+// are part of the command line, as most SSH servers don't accept environment variables from the client.
+func remoteCommand(cmdline []string, env []string, dir string) string {
+	var parts []string
+	if dir != "" {
+		parts = append(parts, "cd", shellQuote(dir), "&&")
+	}
+	if len(env) > 0 {
+		parts = append(parts, "env")
+		for _, e := range env {
+			parts = append(parts, shellQuote(e))
+		}
+	}
+	for _, arg := range cmdline {
+		parts = append(parts, shellQuote(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// shellQuote quotes s for a POSIX shell, unless it only contains safe characters.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@,+") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
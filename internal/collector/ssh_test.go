@@ -0,0 +1,337 @@
+package collector
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Target
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{input: "nuc1", want: Target{Name: "nuc1", Address: "nuc1:22"}, wantErr: assert.NoError},
+		{input: "ubuntu@nuc1:2222", want: Target{Name: "nuc1", Address: "nuc1:2222", User: "ubuntu"}, wantErr: assert.NoError},
+		{input: "kitchen=ubuntu@192.168.0.10", want: Target{Name: "kitchen", Address: "192.168.0.10:22", User: "ubuntu"}, wantErr: assert.NoError},
+		{input: "ubuntu@", wantErr: assert.Error},
+		{input: "nuc1:", wantErr: assert.Error},
+		{input: "nuc1:ssh", wantErr: assert.Error},
+		{input: "nuc1:65536", wantErr: assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseTarget(tt.input)
+			tt.wantErr(t, err)
+			if err != nil {
+				// the error quotes the target as specified
+				assert.Contains(t, err.Error(), strconv.Quote(tt.input))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_remoteCommand(t *testing.T) {
+	assert.Equal(t,
+		`cd '/var/tmp/my dir' && env FOO=bar 'BAR=it'\''s' sudo intel_gpu_top -J -s 1000`,
+		remoteCommand([]string{"sudo", "intel_gpu_top", "-J", "-s", "1000"}, []string{"FOO=bar", "BAR=it's"}, "/var/tmp/my dir"),
+	)
+}
+
+func TestSSHRunner(t *testing.T) {
+	server := newSSHServer(t)
+	l := slog.New(slog.DiscardHandler)
+	cfg := Config{Interval: 100 * time.Millisecond, Command: Command{Env: []string{"FOO=bar"}}, SSH: server.clientConfig()}
+	r := newSSHRunner(l, Target{Name: "test", Address: server.addr()}, cfg)
+	t.Cleanup(func() { _ = r.Close() })
+
+	for range 2 {
+		stdout, err := r.Start(t.Context(), cfg.Command.build(cfg.Interval))
+		require.NoError(t, err)
+		assert.True(t, r.Running())
+		_, err = stdout.Read(make([]byte, 1024))
+		require.NoError(t, err)
+		// we stopped the command: no exit error
+		assert.NoError(t, r.Stop())
+		assert.False(t, r.Running())
+	}
+
+	// both sessions use the same connection
+	assert.Equal(t, int32(1), server.connections.Load())
+	assert.Equal(t, []string{"env FOO=bar intel_gpu_top -J -s 100", "env FOO=bar intel_gpu_top -J -s 100"}, server.commands())
+}
+
+func TestSSHRunner_ExitError(t *testing.T) {
+	server := newSSHServer(t)
+	l := slog.New(slog.DiscardHandler)
+	r := newSSHRunner(l, Target{Name: "test", Address: server.addr()}, Config{SSH: server.clientConfig()})
+	t.Cleanup(func() { _ = r.Close() })
+
+	stdout, err := r.Start(t.Context(), []string{"fail"})
+	require.NoError(t, err)
+	_, _ = io.ReadAll(stdout)
+
+	var exitErr *ExitError
+	require.ErrorAs(t, r.Stop(), &exitErr)
+	assert.Equal(t, 1, exitErr.Code)
+	assert.Equal(t, FailurePermissionDenied, exitErr.Reason)
+}
+
+func TestSSHRunner_Reconnect(t *testing.T) {
+	server := newSSHServer(t)
+	l := slog.New(slog.DiscardHandler)
+	r := newSSHRunner(l, Target{Name: "test", Address: server.addr()}, Config{Interval: 100 * time.Millisecond, SSH: server.clientConfig()})
+	t.Cleanup(func() { _ = r.Close() })
+
+	stdout, err := r.Start(t.Context(), []string{"intel_gpu_top"})
+	require.NoError(t, err)
+
+	// the connection breaks
+	server.disconnect()
+	_, _ = io.ReadAll(stdout)
+	assert.Error(t, r.Stop())
+
+	// the next start reconnects
+	_, err = r.Start(t.Context(), []string{"intel_gpu_top"})
+	require.NoError(t, err)
+	assert.NoError(t, r.Stop())
+	assert.Equal(t, int32(2), server.connections.Load())
+}
+
+func TestSSHRunner_KeepAliveTimeout(t *testing.T) {
+	server := newSSHServer(t)
+	server.unanswered.Store(true)
+	l := slog.New(slog.DiscardHandler)
+	cfg := server.clientConfig()
+	cfg.KeepAlive = 50 * time.Millisecond
+	r := newSSHRunner(l, Target{Name: "test", Address: server.addr()}, Config{Interval: 100 * time.Millisecond, SSH: cfg})
+	t.Cleanup(func() { _ = r.Close() })
+
+	stdout, err := r.Start(t.Context(), []string{"intel_gpu_top"})
+	require.NoError(t, err)
+	_, err = stdout.Read(make([]byte, 1024))
+	require.NoError(t, err)
+	assert.NoError(t, r.Stop())
+
+	// the unanswered keepalive closes the connection, even though no session is running, and the next start reconnects
+	assert.Eventually(t, func() bool {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return r.client == nil
+	}, time.Second, 10*time.Millisecond)
+	server.unanswered.Store(false)
+	_, err = r.Start(t.Context(), []string{"intel_gpu_top"})
+	require.NoError(t, err)
+	assert.NoError(t, r.Stop())
+	assert.Equal(t, int32(2), server.connections.Load())
+}
+
+func TestRun_Targets(t *testing.T) {
+	server := newSSHServer(t)
+	l := slog.New(slog.DiscardHandler)
+	cfg := Config{
+		Interval: 100 * time.Millisecond,
+		Targets:  []Target{{Name: "nuc1", Address: server.addr()}, {Name: "nuc2", Address: server.addr()}},
+		SSH:      server.clientConfig(),
+	}
+	reg := prometheus.NewRegistry()
+	go func() { assert.NoError(t, Run(t.Context(), reg, cfg, l)) }()
+
+	assert.Eventually(t, func() bool {
+		err := promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP gpumon_source_up Whether intel_gpu_top is running and sending data
+# TYPE gpumon_source_up gauge
+gpumon_source_up{target="nuc1"} 1
+gpumon_source_up{target="nuc2"} 1
+`), "gpumon_source_up")
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestRun_Targets_Duplicate(t *testing.T) {
+	cfg := Config{Targets: []Target{{Name: "nuc1"}, {Name: "nuc1"}}}
+	assert.Error(t, Run(t.Context(), prometheus.NewRegistry(), cfg, slog.New(slog.DiscardHandler)))
+}
+
+func TestRun_Targets_Resources(t *testing.T) {
+	// resource limits only apply to a local intel_gpu_top
+	cfg := Config{Targets: []Target{{Name: "nuc1"}}, Resources: Resources{Nice: 10}}
+	assert.Error(t, Run(t.Context(), prometheus.NewRegistry(), cfg, slog.New(slog.DiscardHandler)))
+}
+
+// sshServer is an in-process SSH server that simulates intel_gpu_top: each session streams samples until it is signaled
+// or closed. Commands starting with "fail" write an error to stderr and exit with status 1.
+type sshServer struct {
+	listener    net.Listener
+	config      *ssh.ServerConfig
+	hostKey     ssh.Signer
+	connections atomic.Int32
+	unanswered  atomic.Bool // global requests, e.g. keepalives, aren't answered
+	lock        sync.Mutex
+	conns       []net.Conn
+	cmds        []string
+}
+
+func newSSHServer(t *testing.T) *sshServer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	s := sshServer{
+		hostKey: hostKey,
+		config: &ssh.ServerConfig{
+			PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if c.User() == "test" && string(password) == "secret" {
+					return nil, nil
+				}
+				return nil, errors.New("access denied")
+			},
+		},
+	}
+	s.config.AddHostKey(hostKey)
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = s.listener.Close()
+		s.disconnect()
+	})
+	go s.serve()
+	return &s
+}
+
+func (s *sshServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *sshServer) clientConfig() SSHConfig {
+	return SSHConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(s.hostKey.PublicKey()),
+	}
+}
+
+func (s *sshServer) commands() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.cmds...)
+}
+
+// disconnect closes all connections.
+func (s *sshServer) disconnect() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *sshServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *sshServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	s.connections.Add(1)
+	s.lock.Lock()
+	s.conns = append(s.conns, conn)
+	s.lock.Unlock()
+	go func() {
+		for req := range requests {
+			if req.WantReply && !s.unanswered.Load() {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}()
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(channel, requests)
+	}
+}
+
+func (s *sshServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	stop := make(chan struct{})
+	var once sync.Once
+	defer once.Do(func() { close(stop) })
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			_ = ssh.Unmarshal(req.Payload, &payload)
+			_ = req.Reply(true, nil)
+			s.lock.Lock()
+			s.cmds = append(s.cmds, payload.Command)
+			s.lock.Unlock()
+			go s.run(channel, payload.Command, stop)
+		case "signal":
+			once.Do(func() { close(stop) })
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *sshServer) run(channel ssh.Channel, command string, stop <-chan struct{}) {
+	defer func() { _ = channel.Close() }()
+	if strings.HasPrefix(command, "fail") {
+		_, _ = fmt.Fprintln(channel.Stderr(), "Failed to initialize PMU! (Permission denied)")
+		_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+		return
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			_, _ = channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+				Signal     string
+				CoreDumped bool
+				Error      string
+				Lang       string
+			}{Signal: "TERM"}))
+			return
+		case <-ticker.C:
+			if _, err := channel.Write([]byte(testutil.SinglePayload)); err != nil {
+				return
+			}
+		}
+	}
+}
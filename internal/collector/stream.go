@@ -0,0 +1,288 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rmarchant/intel-gpu-exporter/internal/web"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// streamBuffer is the number of samples buffered for each stream subscriber.
+	streamBuffer = 64
+	// streamKeepAlive is the interval at which a comment is sent to idle streams, so proxies don't close them.
+	streamKeepAlive = 15 * time.Second
+	// subscribedInterval is the interval at which a source is told that stream clients are subscribed to it.
+	subscribedInterval = time.Second
+)
+
+// streamEvent is a sample sent to stream subscribers.
+type streamEvent struct {
+	Device string       `json:"device"`
+	Time   time.Time    `json:"time"`
+	Stats  igt.GPUStats `json:"stats"`
+}
+
+// subscriber receives the samples of one or more broadcasters. If it can't keep up, samples are dropped.
+type subscriber struct {
+	events  chan streamEvent
+	dropped atomic.Uint64
+}
+
+func newSubscriber(buffer int) *subscriber {
+	return &subscriber{events: make(chan streamEvent, buffer)}
+}
+
+// queue receives the samples of a broadcaster without ever dropping them, e.g. to record the history, which must not
+// lose samples while the store is busy. The queue grows until its samples are taken.
+type queue struct {
+	lock   sync.Mutex
+	events []streamEvent
+	ready  chan struct{} // signaled when samples are added
+}
+
+func newQueue() *queue {
+	return &queue{ready: make(chan struct{}, 1)}
+}
+
+func (q *queue) push(event streamEvent) {
+	q.lock.Lock()
+	q.events = append(q.events, event)
+	q.lock.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take removes and returns all queued samples.
+func (q *queue) take() []streamEvent {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	events := q.events
+	q.events = nil
+	return events
+}
+
+// broadcaster sends the samples received by an Aggregator to its subscribers and queues. Publishing never blocks: if
+// a subscriber's buffer is full, the sample is dropped for that subscriber, so slow clients don't hold up reading
+// intel_gpu_top.
+type broadcaster struct {
+	lock        sync.RWMutex
+	subscribers map[*subscriber]string // the device name to report for each subscriber
+	queues      map[*queue]string      // the device name to report for each queue
+	dropped     prometheus.Counter
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{
+		subscribers: make(map[*subscriber]string),
+		queues:      make(map[*queue]string),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prometheus.BuildFQName("gpumon", "stream", "dropped_samples_total"),
+			Help: "Number of samples dropped because a stream subscriber couldn't keep up",
+		}),
+	}
+}
+
+func (b *broadcaster) subscribe(s *subscriber, device string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribers[s] = device
+}
+
+func (b *broadcaster) unsubscribe(s *subscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.subscribers, s)
+}
+
+// subscribed returns true if any subscribers are subscribed. Queues aren't taken into account.
+func (b *broadcaster) subscribed() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.subscribers) > 0
+}
+
+func (b *broadcaster) attach(q *queue, device string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.queues[q] = device
+}
+
+func (b *broadcaster) detach(q *queue) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.queues, q)
+}
+
+// publish sends the sample to all subscribers and queues. The sample must not be modified afterwards.
+func (b *broadcaster) publish(stats igt.GPUStats) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if len(b.subscribers) == 0 && len(b.queues) == 0 {
+		return
+	}
+	now := time.Now()
+	for q, device := range b.queues {
+		q.push(streamEvent{Device: device, Time: now, Stats: stats})
+	}
+	for s, device := range b.subscribers {
+		select {
+		case s.events <- streamEvent{Device: device, Time: now, Stats: stats}:
+		default:
+			s.dropped.Add(1)
+			b.dropped.Inc()
+		}
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (b *broadcaster) Describe(ch chan<- *prometheus.Desc) {
+	b.dropped.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (b *broadcaster) Collect(ch chan<- prometheus.Metric) {
+	b.dropped.Collect(ch)
+}
+
+// streamFields returns the top-level fields of a sample, i.e. the sections reported by intel_gpu_top.
+var streamFields = sync.OnceValue(func() []string {
+	var fields map[string]json.RawMessage
+	content, _ := json.Marshal(igt.GPUStats{})
+	_ = json.Unmarshal(content, &fields)
+	return slices.Sorted(maps.Keys(fields))
+})
+
+// marshal returns the event as JSON. If fields isn't empty, the stats only contain these fields.
+func (e streamEvent) marshal(fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return json.Marshal(e)
+	}
+	content, err := json.Marshal(e.Stats)
+	if err != nil {
+		return nil, err
+	}
+	var stats map[string]json.RawMessage
+	if err = json.Unmarshal(content, &stats); err != nil {
+		return nil, err
+	}
+	maps.DeleteFunc(stats, func(field string, _ json.RawMessage) bool { return !slices.Contains(fields, field) })
+	return json.Marshal(struct {
+		Device string                     `json:"device"`
+		Time   time.Time                  `json:"time"`
+		Stats  map[string]json.RawMessage `json:"stats"`
+	}{Device: e.Device, Time: e.Time, Stats: stats})
+}
+
+// Stream sends each sample received from intel_gpu_top as a Server-Sent Event. The following query parameters are supported:
+//
+//   - device: only send the samples of the device with this name.
+//   - fields: comma-separated list of the sections to send, e.g. "engines,power". By default, all sections are sent.
+//
+// Each sample is sent as a "sample" event. If the client can't keep up, samples are dropped: the next sample is then
+// preceded by a "dropped" event, holding the number of samples that were dropped.
+//
+// While a client is subscribed, its sources keep producing samples: in lazy mode, the stream keeps intel_gpu_top running
+// like scrapes do and in sync mode, it keeps taking measurements.
+func (a *API) Stream(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	device := query.Get("device")
+	var fields []string
+	if value := query.Get("fields"); value != "" {
+		fields = strings.Split(value, ",")
+		for _, field := range fields {
+			if !slices.Contains(streamFields(), field) {
+				web.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid field %q. valid fields: %s", field, strings.Join(streamFields(), ",")))
+				return
+			}
+		}
+	}
+
+	a.lock.RLock()
+	sources := slices.Clone(a.sources)
+	a.lock.RUnlock()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	s := newSubscriber(streamBuffer)
+	var subscribed bool
+	for _, source := range sources {
+		if name := source.Status().Name; device == "" || name == device {
+			source.samples().subscribe(s, name)
+			defer source.samples().unsubscribe(s)
+			go keepSubscribed(ctx, source)
+			subscribed = true
+		}
+	}
+	if !subscribed && device != "" {
+		web.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown device %q", device))
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// disable response buffering in nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	var id, reported uint64
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.closed():
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case event := <-s.events:
+			if dropped := s.dropped.Load(); dropped != reported {
+				_, err = fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped-reported)
+				reported = dropped
+			}
+			var data []byte
+			if err == nil {
+				data, err = event.marshal(fields)
+			}
+			if err == nil {
+				id++
+				_, err = fmt.Fprintf(w, "id: %d\nevent: sample\ndata: %s\n\n", id, data)
+			}
+		}
+		if err = errors.Join(err, rc.Flush()); err != nil {
+			return
+		}
+	}
+}
+
+// keepSubscribed tells the source that a stream client is subscribed to it, until ctx is done.
+func keepSubscribed(ctx context.Context, source statsReporter) {
+	ticker := time.NewTicker(subscribedInterval)
+	defer ticker.Stop()
+	for {
+		source.subscribed()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package collector
+
+import (
+	"bufio"
+	"encoding/json"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBroadcaster(t *testing.T) {
+	b := newBroadcaster()
+	fast, slow := newSubscriber(10), newSubscriber(1)
+	b.subscribe(fast, "nuc1")
+	b.subscribe(slow, "nuc1")
+	for i := range 3 {
+		var stats igt.GPUStats
+		stats.Power.GPU = float64(i)
+		b.publish(stats)
+	}
+	assert.Len(t, fast.events, 3)
+	assert.Zero(t, fast.dropped.Load())
+
+	// a slow subscriber doesn't block publishing: samples are dropped instead
+	require.Len(t, slow.events, 1)
+	event := <-slow.events
+	assert.Equal(t, "nuc1", event.Device)
+	assert.Zero(t, event.Stats.Power.GPU)
+	assert.Equal(t, uint64(2), slow.dropped.Load())
+	assert.Equal(t, 2.0, promtestutil.ToFloat64(b.dropped))
+
+	b.unsubscribe(fast)
+	b.publish(igt.GPUStats{})
+	assert.Len(t, fast.events, 3)
+}
+
+func TestBroadcaster_Queue(t *testing.T) {
+	b := newBroadcaster()
+	q := newQueue()
+	b.attach(q, "nuc1")
+	// a queue never drops samples
+	for range 2 * streamBuffer {
+		b.publish(igt.GPUStats{})
+	}
+	events := q.take()
+	assert.Len(t, events, 2*streamBuffer)
+	assert.Equal(t, "nuc1", events[0].Device)
+	assert.Zero(t, promtestutil.ToFloat64(b.dropped))
+	assert.Empty(t, q.take())
+
+	b.detach(q)
+	b.publish(igt.GPUStats{})
+	assert.Empty(t, q.take())
+}
+
+func TestAPI_Stream(t *testing.T) {
+	a := Aggregator{logger: slog.New(slog.DiscardHandler), stream: newBroadcaster()}
+	api := NewAPI()
+	api.add(fakeStatsReporter{name: "nuc1", aggregator: &a})
+	server := httptest.NewServer(http.HandlerFunc(api.Stream))
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + "?device=nuc1&fields=power,engines")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// the stream has subscribed once the headers are received
+	require.NoError(t, a.Read(t.Context(), strings.NewReader(testutil.SinglePayload)))
+
+	lines := bufio.NewScanner(resp.Body)
+	var event []string
+	for lines.Scan() && lines.Text() != "" {
+		event = append(event, lines.Text())
+	}
+	require.Len(t, event, 3)
+	assert.Equal(t, "id: 1", event[0])
+	assert.Equal(t, "event: sample", event[1])
+	data, ok := strings.CutPrefix(event[2], "data: ")
+	require.True(t, ok)
+	var sample struct {
+		Device string                     `json:"device"`
+		Time   time.Time                  `json:"time"`
+		Stats  map[string]json.RawMessage `json:"stats"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(data), &sample))
+	assert.Equal(t, "nuc1", sample.Device)
+	assert.NotZero(t, sample.Time)
+	assert.Len(t, sample.Stats, 2)
+	assert.JSONEq(t, `{"unit":"W","GPU":1,"Package":4}`, string(sample.Stats["power"]))
+
+	// closing the API ends the stream
+	api.Close()
+	_, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+}
+
+func TestAPI_Stream_Dropped(t *testing.T) {
+	a := Aggregator{logger: slog.New(slog.DiscardHandler), stream: newBroadcaster()}
+	api := NewAPI()
+	api.add(fakeStatsReporter{name: "nuc1", aggregator: &a})
+	server := httptest.NewServer(http.HandlerFunc(api.Stream))
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + "?fields=power")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	// count the samples received and the samples reported as dropped
+	var samples, dropped atomic.Int64
+	go func() {
+		lines := bufio.NewScanner(resp.Body)
+		for lines.Scan() {
+			line := lines.Text()
+			switch {
+			case line == "event: sample":
+				samples.Add(1)
+			case strings.HasPrefix(line, `data: {"dropped":`):
+				var event struct{ Dropped int64 }
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+				dropped.Add(event.Dropped)
+			}
+		}
+	}()
+
+	// publish faster than the stream can send
+	a.stream.lock.RLock()
+	var s *subscriber
+	for s = range a.stream.subscribers {
+	}
+	a.stream.lock.RUnlock()
+	require.NotNil(t, s)
+	const count = 1000
+	for range count {
+		a.stream.publish(igt.GPUStats{})
+	}
+	require.NotZero(t, s.dropped.Load())
+	// once the buffer is drained, the next sample is sent, preceded by the number of dropped samples
+	require.Eventually(t, func() bool { return len(s.events) == 0 }, time.Second, time.Millisecond)
+	a.stream.publish(igt.GPUStats{})
+
+	assert.Eventually(t, func() bool {
+		return samples.Load()+dropped.Load() == count+1
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, float64(s.dropped.Load()), promtestutil.ToFloat64(a.stream.dropped))
+}
+
+func TestAPI_Stream_Lazy(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := NewTopReader(l, Config{Interval: 10 * time.Millisecond, CheckInterval: 10 * time.Millisecond, Lazy: true, IdleTimeout: 50 * time.Millisecond})
+	r.topRunner = &fakeRunner{interval: 10 * time.Millisecond}
+	go func() { assert.NoError(t, r.Run(t.Context())) }()
+	api := NewAPI()
+	api.add(r)
+	server := httptest.NewServer(http.HandlerFunc(api.Stream))
+	t.Cleanup(server.Close)
+
+	// the stream starts intel_gpu_top and keeps it running for longer than the idle timeout
+	resp, err := http.Get(server.URL + "?fields=power")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	assert.Equal(t, 30, countSamples(t, resp.Body, 30))
+	assert.Equal(t, SourceRunning, r.State())
+}
+
+func TestAPI_Stream_Sync(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := NewSyncReader(l, Config{Interval: 10 * time.Millisecond})
+	r.topRunner = &windowRunner{}
+	api := NewAPI()
+	api.add(r)
+	server := httptest.NewServer(http.HandlerFunc(api.Stream))
+	t.Cleanup(server.Close)
+
+	// the stream takes measurements, without any scrapes
+	resp, err := http.Get(server.URL + "?fields=power")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	assert.Equal(t, 2, countSamples(t, resp.Body, 2))
+}
+
+// countSamples reads the stream until it received want samples, or the stream ends. Returns the number of samples read.
+func countSamples(t *testing.T, body io.Reader, want int) int {
+	t.Helper()
+	var samples int
+	lines := bufio.NewScanner(body)
+	for samples < want && lines.Scan() {
+		if lines.Text() == "event: sample" {
+			samples++
+		}
+	}
+	return samples
+}
+
+func TestAPI_Stream_Query(t *testing.T) {
+	api := NewAPI()
+	api.add(fakeStatsReporter{name: "nuc1", aggregator: &Aggregator{stream: newBroadcaster()}})
+
+	w := httptest.NewRecorder()
+	api.Stream(w, httptest.NewRequest(http.MethodGet, "/api/v1/stream?fields=power,foo", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `invalid field \"foo\"`)
+
+	w = httptest.NewRecorder()
+	api.Stream(w, httptest.NewRequest(http.MethodGet, "/api/v1/stream?device=nuc2", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,214 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syncSamples is the number of samples intel_gpu_top takes per measurement. The first sample only covers the time since
+// intel_gpu_top started, so only the last sample is reported.
+const syncSamples = 2
+
+// SyncReader measures GPU usage when it's scraped: each scrape runs intel_gpu_top for a fixed sampling window
+// (intel_gpu_top -n 2), waits for it to finish and reports that measurement. Concurrent scrapes share the same measurement.
+//
+// Unlike TopReader, SyncReader doesn't keep intel_gpu_top running or buffer samples between scrapes.
+type SyncReader struct {
+	topRunner
+	logger    *slog.Logger
+	command   Command
+	interval  time.Duration
+	timeout   time.Duration
+	raw       bool
+	validator *validator
+	failures  *prometheus.CounterVec
+	ctx       context.Context
+	name      string
+	stream    *broadcaster
+	lock      sync.Mutex
+	inflight  *measurement
+	last      *measurement // last completed measurement
+	updated   time.Time    // time the last successful measurement completed
+	failed    int          // number of consecutive failed measurements
+}
+
+// measurement is one run of intel_gpu_top, shared by all concurrent scrapes.
+type measurement struct {
+	done       chan struct{}
+	aggregator *Aggregator
+	err        error
+}
+
+// NewSyncReader returns a new SyncReader that measures GPU usage over the configured interval.
+func NewSyncReader(logger *slog.Logger, cfg Config) *SyncReader {
+	return &SyncReader{
+		topRunner: newRunner(logger, cfg),
+		command:   cfg.Command,
+		logger:    logger,
+		interval:  cfg.Interval,
+		timeout:   syncSamples*cfg.Interval + 15*time.Second,
+		raw:       cfg.Raw,
+		validator: newValidator(cfg.Validation),
+		failures:  newFailureCounter(),
+		ctx:       context.Background(),
+		name:      localSource,
+		stream:    newBroadcaster(),
+	}
+}
+
+// Run waits for ctx to be done. Any measurement in progress is then stopped.
+func (s *SyncReader) Run(ctx context.Context) error {
+	s.lock.Lock()
+	s.ctx = ctx
+	s.lock.Unlock()
+	<-ctx.Done()
+	if closer, ok := s.topRunner.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	return nil
+}
+
+// measure returns the result of a measurement. If a measurement is in progress, measure waits for it to finish
+// and returns its result. Otherwise, it starts a new measurement.
+func (s *SyncReader) measure() *measurement {
+	s.lock.Lock()
+	if m := s.inflight; m != nil {
+		s.lock.Unlock()
+		<-m.done
+		return m
+	}
+	m := measurement{done: make(chan struct{})}
+	s.inflight = &m
+	ctx := s.ctx
+	s.lock.Unlock()
+
+	m.aggregator, m.err = s.run(ctx)
+	if m.err != nil {
+		s.failures.WithLabelValues(string(failureReason(m.err))).Inc()
+		s.logger.Warn("intel-gpu-top failed", "err", m.err, "reason", failureReason(m.err))
+	}
+
+	s.lock.Lock()
+	s.inflight = nil
+	if m.err == nil {
+		s.updated = time.Now()
+		s.failed = 0
+	} else {
+		s.failed++
+	}
+	s.last = &m
+	s.lock.Unlock()
+	close(m.done)
+	return &m
+}
+
+// run runs intel_gpu_top for one sampling window and returns an Aggregator holding its last sample.
+func (s *SyncReader) run(ctx context.Context) (*Aggregator, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	cmdline := append(s.command.build(s.interval), "-n", strconv.Itoa(syncSamples))
+	s.logger.Debug("top command built", "interval", s.interval, "cmd", strings.Join(cmdline, " "))
+	stdout, err := s.topRunner.Start(ctx, cmdline)
+	if err != nil {
+		return nil, fmt.Errorf("intel-gpu-top: %w", err)
+	}
+
+	a := Aggregator{logger: s.logger.With("subsystem", "aggregator"), validator: s.validator, raw: s.raw, retention: MaxStatsWindow}
+	err = a.Read(ctx, stdout)
+	var exitErr *ExitError
+	if stopErr := s.topRunner.Stop(); errors.As(stopErr, &exitErr) && exitErr.Code != 0 {
+		err = errors.Join(err, stopErr)
+	}
+	if err == nil && ctx.Err() != nil {
+		err = fmt.Errorf("%w: %w", errTimeout, ctx.Err())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("intel-gpu-top: %w", err)
+	}
+	if a.len() == 0 {
+		return nil, errors.New("intel-gpu-top: no data received")
+	}
+	a.keepLast()
+	// like the measurement, stream clients and the history only get the last sample
+	s.stream.publish(a.stats[0])
+	return &a, nil
+}
+
+// Status returns the status of the intel_gpu_top source. Between scrapes, the source is idle. After several consecutive
+// failed measurements, it's in a crash loop. LastUpdate is the time of the last successful measurement, even if later
+// measurements failed.
+func (s *SyncReader) Status() SourceStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := SourceStatus{Name: s.name, State: SourceIdle}
+	switch {
+	case s.failed >= crashLoopThreshold:
+		status.State = SourceCrashLoop
+	case s.inflight != nil:
+		status.State = SourceRunning
+	}
+	if s.last != nil && s.last.err != nil {
+		status.LastError = s.last.err.Error()
+	}
+	if !s.updated.IsZero() {
+		updated := s.updated
+		status.LastUpdate = &updated
+	}
+	return status
+}
+
+// Stats takes a measurement and returns its GPU statistics. As a measurement only holds one sample, window is ignored.
+func (s *SyncReader) Stats(window time.Duration, aggregation Aggregation) DeviceStats {
+	m := s.measure()
+	a := &Aggregator{logger: s.logger}
+	if m.err == nil {
+		a = m.aggregator.Window(MaxStatsWindow, aggregation)
+	}
+	return newDeviceStats(s.Status(), a)
+}
+
+func (s *SyncReader) samples() *broadcaster {
+	return s.stream
+}
+
+// subscribed takes a measurement, as stream clients only receive the samples of measurements.
+func (s *SyncReader) subscribed() {
+	s.measure()
+}
+
+// Describe implements the prometheus.Collector interface.
+func (s *SyncReader) Describe(ch chan<- *prometheus.Desc) {
+	(&Aggregator{validator: s.validator, raw: s.raw}).Describe(ch)
+	ch <- sourceUpMetric
+	s.failures.Describe(ch)
+	s.stream.Describe(ch)
+	if c, ok := s.topRunner.(prometheus.Collector); ok {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (s *SyncReader) Collect(ch chan<- prometheus.Metric) {
+	m := s.measure()
+	var up float64
+	if m.err == nil {
+		up = 1
+		m.aggregator.collect(ch)
+	}
+	s.validator.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(sourceUpMetric, prometheus.GaugeValue, up)
+	s.failures.Collect(ch)
+	s.stream.Collect(ch)
+	if c, ok := s.topRunner.(prometheus.Collector); ok {
+		c.Collect(ch)
+	}
+}
@@ -0,0 +1,143 @@
+package collector
+
+import (
+	"context"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSyncReader_Collect(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := NewSyncReader(l, Config{Interval: 100 * time.Millisecond})
+	var runner windowRunner
+	r.topRunner = &runner
+
+	// concurrent scrapes share the same measurement
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, promtestutil.CollectAndCompare(r, strings.NewReader(`
+# HELP gpumon_power Power consumption by type
+# TYPE gpumon_power gauge
+gpumon_power{type="gpu"} 2
+gpumon_power{type="pkg"} 4
+# HELP gpumon_source_up Whether intel_gpu_top is running and sending data
+# TYPE gpumon_source_up gauge
+gpumon_source_up 1
+`), "gpumon_power", "gpumon_source_up"))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), runner.starts.Load())
+	assert.Equal(t, []string{"intel_gpu_top", "-J", "-s", "100", "-n", "2"}, runner.cmdline)
+
+	// the next scrape takes a new measurement
+	assert.NotZero(t, promtestutil.CollectAndCount(r, "gpumon_engine_usage_ratio"))
+	assert.Equal(t, int32(2), runner.starts.Load())
+}
+
+func TestSyncReader_samples(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := NewSyncReader(l, Config{Interval: 10 * time.Millisecond})
+	r.topRunner = &windowRunner{}
+	q := newQueue()
+	r.samples().attach(q, localSource)
+
+	// the first, partial, sample of a measurement isn't published
+	r.measure()
+	events := q.take()
+	require.Len(t, events, 1)
+	assert.Equal(t, 2.0, events[0].Stats.Power.GPU)
+}
+
+func TestSyncReader_Collect_Failure(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := NewSyncReader(l, Config{Interval: 100 * time.Millisecond})
+	r.topRunner = &failingRunner{}
+
+	assert.NoError(t, promtestutil.CollectAndCompare(r, strings.NewReader(`
+# HELP gpumon_source_up Whether intel_gpu_top is running and sending data
+# TYPE gpumon_source_up gauge
+gpumon_source_up 0
+`), "gpumon_source_up", "gpumon_engine_usage_ratio"))
+	assert.Equal(t, 1.0, promtestutil.ToFloat64(r.failures.WithLabelValues(string(FailureUnknown))))
+}
+
+var _ topRunner = &windowRunner{}
+
+// windowRunner is a topRunner that behaves like intel_gpu_top -n 2: it writes two samples and exits.
+// The first sample reports a GPU power of 1W, the second one 2W.
+type windowRunner struct {
+	starts  atomic.Int32
+	running atomic.Bool
+	cmdline []string
+}
+
+func (f *windowRunner) Start(_ context.Context, cmdline []string) (io.Reader, error) {
+	f.starts.Add(1)
+	f.running.Store(true)
+	f.cmdline = cmdline
+	r, w := io.Pipe()
+	go func() {
+		defer func() { _ = w.Close() }()
+		for i := range 2 {
+			time.Sleep(50 * time.Millisecond)
+			payload := strings.Replace(testutil.SinglePayload, `"GPU": 1.000000`, `"GPU": `+strconv.Itoa(i+1), 1)
+			if _, err := w.Write([]byte(payload)); err != nil {
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+func (f *windowRunner) Stop() error {
+	f.running.Store(false)
+	return nil
+}
+
+func (f *windowRunner) Running() bool {
+	return f.running.Load()
+}
+
+func TestSyncReader_Status(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	r := NewSyncReader(l, Config{Interval: 100 * time.Millisecond})
+	r.topRunner = &failingRunner{}
+
+	for range crashLoopThreshold {
+		r.measure()
+	}
+	status := r.Status()
+	assert.Equal(t, SourceCrashLoop, status.State)
+	assert.NotEmpty(t, status.LastError)
+	assert.Nil(t, status.LastUpdate)
+
+	r.topRunner = &windowRunner{}
+	r.measure()
+	status = r.Status()
+	assert.Equal(t, SourceIdle, status.State)
+	assert.Empty(t, status.LastError)
+	require.NotNil(t, status.LastUpdate)
+	updated := *status.LastUpdate
+
+	// a failed measurement keeps the time of the last successful one
+	r.topRunner = &failingRunner{}
+	r.measure()
+	status = r.Status()
+	assert.NotEmpty(t, status.LastError)
+	require.NotNil(t, status.LastUpdate)
+	assert.Equal(t, updated, *status.LastUpdate)
+}
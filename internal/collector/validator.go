@@ -0,0 +1,149 @@
+package collector
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"math"
+	"strings"
+)
+
+// ValidationPolicy determines what happens to samples that fail validation.
+type ValidationPolicy string
+
+const (
+	// ValidationDrop drops any invalid sample.
+	ValidationDrop ValidationPolicy = "drop"
+	// ValidationClamp clamps out-of-range values to their valid range. Samples that can't be repaired are still dropped.
+	ValidationClamp ValidationPolicy = "clamp"
+)
+
+// ParseValidationPolicy returns the ValidationPolicy for s.
+func ParseValidationPolicy(s string) (ValidationPolicy, error) {
+	switch policy := ValidationPolicy(s); policy {
+	case ValidationDrop, ValidationClamp:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid validation policy %q", s)
+	}
+}
+
+// reasons why a sample is invalid
+const (
+	reasonEngineBusy = "engine_busy_out_of_range"
+	reasonFrequency  = "negative_frequency"
+	reasonPeriod     = "invalid_period"
+	reasonPower      = "invalid_power"
+)
+
+// A validator checks decoded samples before they are added to the Aggregator. Driver resets, for instance,
+// can produce engine busy values above 100%, which would corrupt the median.
+type validator struct {
+	policy  ValidationPolicy
+	invalid *prometheus.CounterVec
+}
+
+func newValidator(policy ValidationPolicy) *validator {
+	v := validator{
+		policy: policy,
+		invalid: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prometheus.BuildFQName("gpumon", "", "invalid_samples_total"),
+			Help: "Number of samples that failed validation",
+		}, []string{"reason"}),
+	}
+	for _, reason := range []string{reasonEngineBusy, reasonFrequency, reasonPeriod, reasonPower} {
+		v.invalid.WithLabelValues(reason)
+	}
+	return &v
+}
+
+// validate checks stats. If the policy allows, invalid values are clamped to their valid range. Otherwise, stats is left
+// untouched. Returns false if the sample should be dropped.
+func (v *validator) validate(stats *igt.GPUStats) bool {
+	valid := true
+	invalid := func(reason string) {
+		v.invalid.WithLabelValues(reason).Inc()
+		valid = false
+	}
+
+	// values that can't be repaired
+	if !(stats.Period.Duration > 0) {
+		invalid(reasonPeriod)
+	}
+	if !isFinite(stats.Power.GPU) || !isFinite(stats.Power.Package) {
+		invalid(reasonPower)
+	}
+	if !valid {
+		return false
+	}
+
+	// values that can be clamped
+	for _, engine := range stats.Engines {
+		if !validBusy(engine.Busy) {
+			invalid(reasonEngineBusy)
+			break
+		}
+	}
+	if stats.Frequency.Requested < 0 || stats.Frequency.Actual < 0 {
+		invalid(reasonFrequency)
+	}
+	if valid {
+		return true
+	}
+	if v.policy != ValidationClamp {
+		return false
+	}
+	// the engines map is only modified once the sample is kept
+	for name, engine := range stats.Engines {
+		if !validBusy(engine.Busy) {
+			engine.Busy = clamp(engine.Busy, 0, 1)
+			stats.Engines[name] = engine
+		}
+	}
+	stats.Frequency.Requested = max(stats.Frequency.Requested, 0)
+	stats.Frequency.Actual = max(stats.Frequency.Actual, 0)
+	return true
+}
+
+// clampRaw applies the policy to the raw values of a sample that validate kept: the values it clamped in GPUStats are
+// clamped in the same way.
+func (v *validator) clampRaw(values []igt.RawValue) {
+	if v.policy != ValidationClamp {
+		return
+	}
+	for i, value := range values {
+		switch {
+		case strings.HasPrefix(value.Path, "engines.") && strings.HasSuffix(value.Path, ".busy"):
+			if !validBusy(value.Value) {
+				values[i].Value = clamp(value.Value, 0, 1)
+			}
+		case value.Path == "frequency.requested" || value.Path == "frequency.actual":
+			values[i].Value = max(value.Value, 0)
+		}
+	}
+}
+
+func validBusy(busy float64) bool {
+	return busy >= 0 && busy <= 1
+}
+
+// Describe implements the prometheus.Collector interface.
+func (v *validator) Describe(ch chan<- *prometheus.Desc) {
+	v.invalid.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (v *validator) Collect(ch chan<- prometheus.Metric) {
+	v.invalid.Collect(ch)
+}
+
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func clamp(f, low, high float64) float64 {
+	if math.IsNaN(f) {
+		return low
+	}
+	return min(max(f, low), high)
+}
@@ -0,0 +1,148 @@
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestValidator(t *testing.T) {
+	tests := []struct {
+		name       string
+		update     func(*igt.GPUStats)
+		wantReason string
+		wantDrop   bool
+		wantClamp  bool
+		check      func(*testing.T, igt.GPUStats)
+	}{
+		{
+			name:   "valid",
+			update: func(*igt.GPUStats) {},
+		},
+		{
+			name:       "busy above 100%",
+			update:     func(s *igt.GPUStats) { s.Engines["Video"] = igt.EngineStats{Busy: 1.05} },
+			wantReason: reasonEngineBusy,
+			wantDrop:   true,
+			wantClamp:  true,
+			check:      func(t *testing.T, s igt.GPUStats) { assert.Equal(t, 1.0, s.Engines["Video"].Busy) },
+		},
+		{
+			name:       "negative busy",
+			update:     func(s *igt.GPUStats) { s.Engines["Video"] = igt.EngineStats{Busy: -0.1} },
+			wantReason: reasonEngineBusy,
+			wantDrop:   true,
+			wantClamp:  true,
+			check:      func(t *testing.T, s igt.GPUStats) { assert.Equal(t, 0.0, s.Engines["Video"].Busy) },
+		},
+		{
+			name:       "negative frequency",
+			update:     func(s *igt.GPUStats) { s.Frequency.Actual = -1 },
+			wantReason: reasonFrequency,
+			wantDrop:   true,
+			wantClamp:  true,
+			check:      func(t *testing.T, s igt.GPUStats) { assert.Equal(t, 0.0, s.Frequency.Actual) },
+		},
+		{
+			name:       "zero period",
+			update:     func(s *igt.GPUStats) { s.Period.Duration = 0 },
+			wantReason: reasonPeriod,
+			wantDrop:   true,
+		},
+		{
+			name:       "infinite power",
+			update:     func(s *igt.GPUStats) { s.Power.GPU = math.Inf(1) },
+			wantReason: reasonPower,
+			wantDrop:   true,
+		},
+		{
+			name:       "NaN power",
+			update:     func(s *igt.GPUStats) { s.Power.Package = math.NaN() },
+			wantReason: reasonPower,
+			wantDrop:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, policy := range []ValidationPolicy{ValidationDrop, ValidationClamp} {
+				v := newValidator(policy)
+				stats := validStats()
+				tt.update(&stats)
+				keep := v.validate(&stats)
+
+				switch policy {
+				case ValidationDrop:
+					assert.Equal(t, !tt.wantDrop, keep, policy)
+					if tt.wantClamp {
+						// dropped samples aren't modified
+						want := validStats()
+						tt.update(&want)
+						assert.Equal(t, want, stats)
+					}
+				case ValidationClamp:
+					assert.Equal(t, !tt.wantDrop || tt.wantClamp, keep, policy)
+					if tt.check != nil {
+						tt.check(t, stats)
+					}
+				}
+				if tt.wantReason != "" {
+					assert.Equal(t, 1.0, testutil.ToFloat64(v.invalid.WithLabelValues(tt.wantReason)))
+				}
+			}
+		})
+	}
+}
+
+func TestParseValidationPolicy(t *testing.T) {
+	policy, err := ParseValidationPolicy("clamp")
+	require.NoError(t, err)
+	assert.Equal(t, ValidationClamp, policy)
+	_, err = ParseValidationPolicy("ignore")
+	assert.Error(t, err)
+}
+
+func TestAggregator_Validation(t *testing.T) {
+	a := Aggregator{logger: slog.New(slog.DiscardHandler), validator: newValidator(ValidationDrop)}
+	input := `{ "period": { "duration": 1000, "unit": "ms" }, "engines": { "Video": { "busy": 105, "unit": "%" } } }
+{ "period": { "duration": 1000, "unit": "ms" }, "engines": { "Video": { "busy": 50, "unit": "%" } } }`
+	require.NoError(t, a.Read(t.Context(), strings.NewReader(input)))
+	assert.Equal(t, 1, a.len())
+
+	assert.NoError(t, testutil.CollectAndCompare(&a, strings.NewReader(`
+# HELP gpumon_invalid_samples_total Number of samples that failed validation
+# TYPE gpumon_invalid_samples_total counter
+gpumon_invalid_samples_total{reason="engine_busy_out_of_range"} 1
+gpumon_invalid_samples_total{reason="invalid_period"} 0
+gpumon_invalid_samples_total{reason="invalid_power"} 0
+gpumon_invalid_samples_total{reason="negative_frequency"} 0
+`), "gpumon_invalid_samples_total"))
+}
+
+func TestAggregator_Validation_Raw(t *testing.T) {
+	a := Aggregator{logger: slog.New(slog.DiscardHandler), validator: newValidator(ValidationClamp), raw: true}
+	input := `{ "period": { "duration": 1000, "unit": "ms" }, "engines": { "Video": { "busy": 105, "unit": "%" } }, "frequency": { "actual": -1, "unit": "MHz" } }`
+	require.NoError(t, a.Read(t.Context(), strings.NewReader(input)))
+
+	// raw values are clamped like the sample
+	assert.NoError(t, testutil.CollectAndCompare(&a, strings.NewReader(`
+# HELP gpumon_raw Raw values reported by intel_gpu_top
+# TYPE gpumon_raw gauge
+gpumon_raw{path="engines.Video.busy",unit="ratio"} 1
+gpumon_raw{path="frequency.actual",unit="Hz"} 0
+gpumon_raw{path="period.duration",unit="s"} 1
+`), "gpumon_raw"))
+}
+
+func validStats() igt.GPUStats {
+	var stats igt.GPUStats
+	stats.Period.Duration = 1
+	stats.Power.GPU = 1
+	stats.Frequency.Actual = 1e9
+	stats.Engines = map[string]igt.EngineStats{"Render/3D": {Busy: 0.5}}
+	return stats
+}
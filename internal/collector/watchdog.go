@@ -0,0 +1,98 @@
+package collector
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"maps"
+	"math"
+)
+
+// errFrozen indicates that intel_gpu_top keeps sending the same values. We've seen this happen after a GPU reset.
+var errFrozen = errors.New("intel-gpu-top output is frozen")
+
+// kinds of stalls detected by the watchdog
+const (
+	stallNoData = "no_data"
+	stallFrozen = "frozen"
+)
+
+// newStallCounter returns the counter for stalls detected by the watchdog, with all kinds initialized.
+func newStallCounter() *prometheus.CounterVec {
+	stalls := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName("gpumon", "source", "stalls_total"),
+		Help: "Number of times intel_gpu_top stalled, by kind",
+	}, []string{"kind"})
+	for _, kind := range []string{stallNoData, stallFrozen} {
+		stalls.WithLabelValues(kind)
+	}
+	return stalls
+}
+
+// stallKind returns the kind of stall for err. Returns false if err isn't a stall.
+func stallKind(err error) (string, bool) {
+	switch {
+	case errors.Is(err, errTimeout):
+		return stallNoData, true
+	case errors.Is(err, errFrozen):
+		return stallFrozen, true
+	default:
+		return "", false
+	}
+}
+
+// frozenDetector detects frozen intel_gpu_top output: consecutive records with bit-identical engine and frequency values,
+// while clients are using the GPU.
+//
+// Records without clients, or where all engines and frequencies are zero, are never considered frozen:
+// an idle GPU legitimately reports the same values over and over.
+type frozenDetector struct {
+	threshold int
+	count     int
+	engines   map[string]igt.EngineStats
+	requested float64
+	actual    float64
+}
+
+// check adds a record. Returns true if the last threshold records were identical. A threshold of zero disables detection.
+func (f *frozenDetector) check(stats *igt.GPUStats) bool {
+	if f.threshold == 0 {
+		return false
+	}
+	if len(stats.Clients) == 0 || isIdle(stats) {
+		f.count = 0
+		return false
+	}
+	if f.count > 0 &&
+		sameBits(stats.Frequency.Requested, f.requested) &&
+		sameBits(stats.Frequency.Actual, f.actual) &&
+		maps.EqualFunc(stats.Engines, f.engines, sameEngineStats) {
+		f.count++
+	} else {
+		f.count = 1
+		f.engines = maps.Clone(stats.Engines)
+		f.requested = stats.Frequency.Requested
+		f.actual = stats.Frequency.Actual
+	}
+	return f.count >= f.threshold
+}
+
+func isIdle(stats *igt.GPUStats) bool {
+	if stats.Frequency.Requested != 0 || stats.Frequency.Actual != 0 {
+		return false
+	}
+	for _, engine := range stats.Engines {
+		if engine.Busy != 0 || engine.Sema != 0 || engine.Wait != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func sameEngineStats(a, b igt.EngineStats) bool {
+	return sameBits(a.Busy, b.Busy) && sameBits(a.Sema, b.Sema) && sameBits(a.Wait, b.Wait)
+}
+
+func sameBits(a, b float64) bool {
+	return math.Float64bits(a) == math.Float64bits(b)
+}
@@ -0,0 +1,68 @@
+package collector
+
+import (
+	"fmt"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFrozenDetector(t *testing.T) {
+	sample := func(busy float64, clients int) *igt.GPUStats {
+		stats := igt.GPUStats{
+			Engines: map[string]igt.EngineStats{"Render/3D": {Busy: busy}, "Video": {Busy: busy / 2}},
+			Clients: make(map[string]igt.ClientStats),
+		}
+		stats.Frequency.Actual = 1e9
+		for i := range clients {
+			stats.Clients[fmt.Sprint(i)] = igt.ClientStats{}
+		}
+		return &stats
+	}
+
+	tests := []struct {
+		name    string
+		samples []*igt.GPUStats
+		want    bool
+	}{
+		{name: "identical", samples: []*igt.GPUStats{sample(.5, 1), sample(.5, 1), sample(.5, 1)}, want: true},
+		{name: "changing", samples: []*igt.GPUStats{sample(.5, 1), sample(.5, 1), sample(.6, 1)}, want: false},
+		{name: "reset", samples: []*igt.GPUStats{sample(.5, 1), sample(.6, 1), sample(.6, 1)}, want: false},
+		{name: "no clients", samples: []*igt.GPUStats{sample(.5, 0), sample(.5, 0), sample(.5, 0)}, want: false},
+		{name: "idle", samples: []*igt.GPUStats{idleSample(), idleSample(), idleSample()}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := frozenDetector{threshold: 3}
+			var frozen bool
+			for _, s := range tt.samples {
+				frozen = f.check(s)
+			}
+			assert.Equal(t, tt.want, frozen)
+		})
+	}
+
+	// a threshold of zero disables detection
+	var f frozenDetector
+	for range 10 {
+		assert.False(t, f.check(sample(.5, 1)))
+	}
+}
+
+func idleSample() *igt.GPUStats {
+	return &igt.GPUStats{
+		Engines: map[string]igt.EngineStats{"Render/3D": {}},
+		Clients: map[string]igt.ClientStats{"1": {}},
+	}
+}
+
+func Test_stallKind(t *testing.T) {
+	kind, ok := stallKind(fmt.Errorf("%w: no data received for 15s", errTimeout))
+	assert.True(t, ok)
+	assert.Equal(t, stallNoData, kind)
+	kind, ok = stallKind(fmt.Errorf("%w: 30 identical records", errFrozen))
+	assert.True(t, ok)
+	assert.Equal(t, stallFrozen, kind)
+	_, ok = stallKind(errFailingRunner)
+	assert.False(t, ok)
+}
@@ -0,0 +1,288 @@
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+)
+
+// A history file starts with magic, followed by records. A series record assigns an ID to the history of a metric of a
+// device. A point record holds the value of a series during one bucket. A point replaces any earlier point of the same
+// series with the same time.
+//
+//	series: recordSeries, uvarint id, uvarint len, device, uvarint len, metric
+//	point:  recordPoint, uvarint id, varint time (Unix seconds), uvarint count, float32 mean, float32 min, float32 max
+const magic = "GPUMONH1"
+
+const (
+	recordSeries byte = 1
+	recordPoint  byte = 2
+)
+
+func appendSeries(b []byte, id uint64, key seriesKey) []byte {
+	b = append(b, recordSeries)
+	b = binary.AppendUvarint(b, id)
+	b = binary.AppendUvarint(b, uint64(len(key.device)))
+	b = append(b, key.device...)
+	b = binary.AppendUvarint(b, uint64(len(key.metric)))
+	return append(b, key.metric...)
+}
+
+func appendPoint(b []byte, id uint64, p point) []byte {
+	b = append(b, recordPoint)
+	b = binary.AppendUvarint(b, id)
+	b = binary.AppendVarint(b, p.time)
+	b = binary.AppendUvarint(b, uint64(p.count))
+	b = binary.LittleEndian.AppendUint32(b, math.Float32bits(p.mean))
+	b = binary.LittleEndian.AppendUint32(b, math.Float32bits(p.min))
+	return binary.LittleEndian.AppendUint32(b, math.Float32bits(p.max))
+}
+
+// errTruncated indicates that a record is incomplete, e.g. because the exporter stopped while writing it.
+var errTruncated = errors.New("truncated record")
+
+// decoder reads the records of a history file.
+type decoder struct {
+	b   []byte
+	off int
+}
+
+func (d *decoder) uvarint() (uint64, error) {
+	value, n := binary.Uvarint(d.b[d.off:])
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	d.off += n
+	return value, nil
+}
+
+func (d *decoder) varint() (int64, error) {
+	value, n := binary.Varint(d.b[d.off:])
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	d.off += n
+	return value, nil
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(len(d.b)-d.off) {
+		return "", errTruncated
+	}
+	s := string(d.b[d.off : d.off+int(n)])
+	d.off += int(n)
+	return s, nil
+}
+
+func (d *decoder) float32() (float32, error) {
+	if len(d.b)-d.off < 4 {
+		return 0, errTruncated
+	}
+	value := math.Float32frombits(binary.LittleEndian.Uint32(d.b[d.off:]))
+	d.off += 4
+	return value, nil
+}
+
+func (d *decoder) series() (uint64, seriesKey, error) {
+	id, err := d.uvarint()
+	if err != nil {
+		return 0, seriesKey{}, err
+	}
+	var key seriesKey
+	if key.device, err = d.string(); err != nil {
+		return 0, seriesKey{}, err
+	}
+	if key.metric, err = d.string(); err != nil {
+		return 0, seriesKey{}, err
+	}
+	return id, key, nil
+}
+
+func (d *decoder) point() (uint64, point, error) {
+	id, err := d.uvarint()
+	if err != nil {
+		return 0, point{}, err
+	}
+	var p point
+	if p.time, err = d.varint(); err != nil {
+		return 0, point{}, err
+	}
+	count, err := d.uvarint()
+	if err != nil {
+		return 0, point{}, err
+	}
+	p.count = uint32(count)
+	for _, value := range []*float32{&p.mean, &p.min, &p.max} {
+		if *value, err = d.float32(); err != nil {
+			return 0, point{}, err
+		}
+	}
+	return id, p, nil
+}
+
+// openTier loads the tier's file and opens it for appending. An incomplete record at the end of the file is removed.
+func openTier(cfg Tier, path string, logger *slog.Logger) (*tier, error) {
+	t := tier{Tier: cfg, logger: logger, path: path, series: make(map[seriesKey]*series)}
+	size, err := t.load()
+	if err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	if size == 0 {
+		if err = os.WriteFile(path, []byte(magic), 0o644); err != nil {
+			return nil, fmt.Errorf("history: %w", err)
+		}
+	} else if err = os.Truncate(path, size); err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	if t.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	return &t, nil
+}
+
+// load reads the tier's file. It returns the size of the valid part of the file.
+func (t *tier) load() (int64, error) {
+	content, err := os.ReadFile(t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(content) < len(magic) && bytes.HasPrefix([]byte(magic), content) {
+		return 0, nil
+	}
+	if !bytes.HasPrefix(content, []byte(magic)) {
+		return 0, fmt.Errorf("%s is not a history file", t.path)
+	}
+
+	ids := make(map[uint64]*series)
+	d := decoder{b: content, off: len(magic)}
+	valid := d.off
+	for d.off < len(d.b) {
+		recordType := d.b[d.off]
+		d.off++
+		switch recordType {
+		case recordSeries:
+			var id uint64
+			var key seriesKey
+			if id, key, err = d.series(); err != nil {
+				break
+			}
+			ser, ok := t.series[key]
+			if !ok {
+				ser = &series{}
+				t.series[key] = ser
+			}
+			// a series that expired and came back gets a new ID
+			ser.id = id
+			ids[id] = ser
+			t.nextID = max(t.nextID, id+1)
+		case recordPoint:
+			var id uint64
+			var p point
+			if id, p, err = d.point(); err != nil {
+				break
+			}
+			t.addPoint(ids[id], p)
+		default:
+			err = fmt.Errorf("unknown record type %d", recordType)
+		}
+		if err != nil {
+			t.logger.Warn("ignoring the end of the history file", "path", t.path, "offset", valid, "size", len(content), "err", err)
+			break
+		}
+		valid = d.off
+	}
+	return int64(valid), nil
+}
+
+// addPoint adds a point read from the tier's file to the series.
+func (t *tier) addPoint(ser *series, p point) {
+	if ser == nil {
+		t.expired++
+		return
+	}
+	n := len(ser.points)
+	switch {
+	case n == 0 || ser.points[n-1].time < p.time:
+		ser.points = append(ser.points, p)
+		t.live++
+	case ser.points[n-1].time == p.time:
+		ser.points[n-1] = p
+		t.expired++
+	default:
+		t.expired++
+	}
+}
+
+// compact rewrites the tier's file, so it only contains the points that are still kept.
+func (t *tier) compact() {
+	t.replace(writeFileSync(t.path+".tmp", t.snapshot()))
+}
+
+// snapshot returns the content of the compacted file: the points that are still kept. Until replace is called, the
+// records written to the tier are also kept aside, to be appended to the compacted file.
+func (t *tier) snapshot() []byte {
+	var b []byte
+	b = append(b, magic...)
+	for key, ser := range t.series {
+		b = appendSeries(b, ser.id, key)
+		for _, p := range ser.points {
+			b = appendPoint(b, ser.id, p)
+		}
+	}
+	t.compacting = true
+	t.pending = nil
+	t.expired = 0
+	return b
+}
+
+// replace replaces the tier's file by the compacted file, written from snapshot, unless writing it failed (err).
+func (t *tier) replace(err error) {
+	tmp := t.path + ".tmp"
+	pending := t.pending
+	t.compacting, t.pending = false, nil
+	var file *os.File
+	if err == nil {
+		file, err = os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0o644)
+	}
+	if err == nil {
+		_, err = file.Write(pending)
+	}
+	if err == nil {
+		err = os.Rename(tmp, t.path)
+	}
+	if err != nil {
+		if file != nil {
+			_ = file.Close()
+		}
+		_ = os.Remove(tmp)
+		t.logger.Error("failed to compact history", "path", t.path, "err", err)
+		return
+	}
+	_ = t.file.Close()
+	t.file = file
+	t.logger.Debug("history compacted", "path", t.path, "points", t.live)
+}
+
+func writeFileSync(path string, content []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	return errors.Join(err, f.Close())
+}
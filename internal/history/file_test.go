@@ -0,0 +1,69 @@
+package history
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpen_truncated(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, start)
+	s.Record("nuc1", start, map[string]float64{"clients": 1})
+	s.Record("nuc1", start.Add(time.Second), map[string]float64{"clients": 2})
+	require.NoError(t, s.Close())
+
+	// the exporter stopped while writing a point
+	path := filepath.Join(dir, "history-1s.dat")
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, content[:len(content)-3], 0o644))
+
+	s = openStore(t, dir, start)
+	series, _, err := s.Query("clients", "", start, start.Add(time.Minute), time.Second)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Equal(t, []Point{{Time: start, Mean: 1, Min: 1, Max: 1}}, series[0].Points)
+
+	// new points are appended after the last complete record
+	s.Record("nuc1", start.Add(2*time.Second), map[string]float64{"clients": 3})
+	require.NoError(t, s.Close())
+	s = openStore(t, dir, start)
+	series, _, err = s.Query("clients", "", start, start.Add(time.Minute), time.Second)
+	require.NoError(t, err)
+	assert.Len(t, series[0].Points, 2)
+	require.NoError(t, s.Close())
+}
+
+func TestOpen_invalid(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "history-1m.dat"), []byte("not a history file"), 0o644))
+	_, err := Open(dir, testTiers, slog.New(slog.DiscardHandler))
+	assert.ErrorContains(t, err, "is not a history file")
+}
+
+func TestDecoder(t *testing.T) {
+	p := point{time: start.Unix(), count: 60, mean: 0.25, min: 0, max: 1}
+	b := appendSeries(nil, 3, seriesKey{device: "nuc1", metric: "engine_busy_video"})
+	b = appendPoint(b, 3, p)
+
+	d := decoder{b: b, off: 1}
+	id, key, err := d.series()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), id)
+	assert.Equal(t, seriesKey{device: "nuc1", metric: "engine_busy_video"}, key)
+	d.off++
+	id, got, err := d.point()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), id)
+	assert.Equal(t, p, got)
+	assert.Equal(t, len(b), d.off)
+
+	d = decoder{b: b[:len(b)-1], off: len(b) - len(appendPoint(nil, 3, p)) + 1}
+	_, _, err = d.point()
+	assert.ErrorIs(t, err, errTruncated)
+}
@@ -0,0 +1,234 @@
+package history
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"github.com/rmarchant/intel-gpu-exporter/internal/web"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultRange is the period the history API reports on, if no start time is requested.
+	defaultRange = time.Hour
+	// maxPoints is the maximum number of points the history API returns per series.
+	maxPoints = 11000
+)
+
+var (
+	// ErrUnknownMetric indicates that no history is kept for a metric.
+	ErrUnknownMetric = errors.New("unknown metric")
+	// ErrUnknownDevice indicates that no history is kept for a device.
+	ErrUnknownDevice = errors.New("unknown device")
+)
+
+// Series is the history of a metric of one device.
+type Series struct {
+	Device string  `json:"device"`
+	Points []Point `json:"points"`
+}
+
+// Point is the value of a metric during one step: the mean, minimum and maximum of the samples.
+type Point struct {
+	Time time.Time `json:"time"`
+	Mean float32   `json:"mean"`
+	Min  float32   `json:"min"`
+	Max  float32   `json:"max"`
+}
+
+// Query returns the history of metric between from and to, with one point per step. If device is empty, the history
+// of all devices is returned. If step is 0, the resolution of the finest tier covering from is used. Otherwise, step
+// is rounded up to a multiple of the tier's resolution. Query returns the step that was used.
+func (s *Store) Query(metric, device string, from, to time.Time, step time.Duration) ([]Series, time.Duration, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, err := s.selectTier(from, step)
+	if err != nil {
+		return nil, 0, err
+	}
+	if step == 0 {
+		step = t.Resolution
+	}
+	// a point can't consolidate part of a tier's bucket, so the step is rounded up to a multiple of its resolution
+	step = (step + t.Resolution - 1) / t.Resolution * t.Resolution
+	if to.Sub(from)/step > maxPoints {
+		return nil, 0, fmt.Errorf("too many points: increase step or reduce the time range")
+	}
+	if !s.knows(func(key seriesKey) bool { return key.metric == metric }) {
+		return nil, 0, fmt.Errorf("%w %q. known metrics: %s", ErrUnknownMetric, metric, strings.Join(s.metrics(), ","))
+	}
+	if device != "" && !s.knows(func(key seriesKey) bool { return key.device == device }) {
+		return nil, 0, fmt.Errorf("%w %q", ErrUnknownDevice, device)
+	}
+
+	result := make([]Series, 0)
+	for key, ser := range t.series {
+		if key.metric != metric || (device != "" && key.device != device) {
+			continue
+		}
+		result = append(result, Series{Device: key.device, Points: ser.query(from.Unix(), to.Unix(), int64(step/time.Second))})
+	}
+	slices.SortFunc(result, func(a, b Series) int { return cmp.Compare(a.Device, b.Device) })
+	return result, step, nil
+}
+
+// selectTier returns the finest tier that has a resolution of at most step and still holds the data at from. If no
+// tier goes back that far, the coarsest tier is used.
+func (s *Store) selectTier(from time.Time, step time.Duration) (*tier, error) {
+	var selected *tier
+	for _, t := range s.tiers {
+		if step != 0 && t.Resolution > step {
+			break
+		}
+		selected = t
+		if !from.Before(s.now().Add(-t.Retention)) {
+			break
+		}
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("step must be at least %s", s.tiers[0].Resolution)
+	}
+	return selected, nil
+}
+
+// knows reports whether any tier holds a series for which f returns true.
+func (s *Store) knows(f func(seriesKey) bool) bool {
+	for _, t := range s.tiers {
+		for key := range t.series {
+			if f(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// metrics returns the names of the metrics with history.
+func (s *Store) metrics() []string {
+	var metrics []string
+	for _, t := range s.tiers {
+		for key := range t.series {
+			if !slices.Contains(metrics, key.metric) {
+				metrics = append(metrics, key.metric)
+			}
+		}
+	}
+	slices.Sort(metrics)
+	return metrics
+}
+
+// query consolidates the points between from and to (in Unix seconds), including the bucket being filled, per step.
+func (ser *series) query(from, to, step int64) []Point {
+	points := ser.points
+	if ser.open != nil {
+		points = append(points[:len(points):len(points)], ser.open.point())
+	}
+	result := make([]Point, 0)
+	var current *bucket
+	for _, p := range points {
+		if p.time < from || p.time > to {
+			continue
+		}
+		start := p.time - p.time%step
+		if current != nil && current.time != start {
+			result = append(result, current.result())
+			current = nil
+		}
+		if current == nil {
+			current = newBucket(start)
+		}
+		current.merge(p)
+	}
+	if current != nil {
+		result = append(result, current.result())
+	}
+	return result
+}
+
+func (b *bucket) result() Point {
+	p := b.point()
+	return Point{Time: time.Unix(b.time, 0).UTC(), Mean: p.mean, Min: p.min, Max: p.max}
+}
+
+// historyResponse is the body of the /api/v1/history response.
+type historyResponse struct {
+	Version string   `json:"version"`
+	Metric  string   `json:"metric"`
+	Step    string   `json:"step"`
+	Series  []Series `json:"series"`
+}
+
+// History returns the history of a metric. The following query parameters are supported:
+//
+//   - metric: the metric to report (required), e.g. power_gpu_watts.
+//   - from, to: the time range, as RFC 3339 or Unix timestamps. Defaults to the last hour.
+//   - step: the duration of each point (e.g. 1m). Defaults to the resolution of the finest tier holding from, and is
+//     rounded up to a multiple of it.
+//   - device: only report the device with this name.
+func (s *Store) History(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	metric := query.Get("metric")
+	if metric == "" {
+		web.WriteError(w, http.StatusBadRequest, fmt.Errorf("missing metric. known metrics: %s", strings.Join(s.knownMetrics(), ",")))
+		return
+	}
+	to := s.now()
+	if value := query.Get("to"); value != "" {
+		var err error
+		if to, err = parseTime(value); err != nil {
+			web.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid to %q", value))
+			return
+		}
+	}
+	from := to.Add(-defaultRange)
+	if value := query.Get("from"); value != "" {
+		var err error
+		if from, err = parseTime(value); err != nil {
+			web.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid from %q", value))
+			return
+		}
+	}
+	if !from.Before(to) {
+		web.WriteError(w, http.StatusBadRequest, errors.New("from must be before to"))
+		return
+	}
+	var step time.Duration
+	if value := query.Get("step"); value != "" {
+		var err error
+		if step, err = time.ParseDuration(value); err != nil || step <= 0 {
+			web.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid step %q", value))
+			return
+		}
+	}
+
+	series, step, err := s.Query(metric, query.Get("device"), from, to, step)
+	switch {
+	case errors.Is(err, ErrUnknownMetric), errors.Is(err, ErrUnknownDevice):
+		web.WriteError(w, http.StatusNotFound, err)
+	case err != nil:
+		web.WriteError(w, http.StatusBadRequest, err)
+	default:
+		web.WriteJSON(w, http.StatusOK, historyResponse{Version: web.APIVersion, Metric: metric, Step: step.String(), Series: series})
+	}
+}
+
+func (s *Store) knownMetrics() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.metrics()
+}
+
+// parseTime parses an RFC 3339 timestamp or a Unix timestamp in seconds.
+func parseTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*1e9)), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,86 @@
+package history
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStore_History(t *testing.T) {
+	s := openStore(t, t.TempDir(), start.Add(3*time.Second))
+	for i := range 3 {
+		s.Record("nuc1", start.Add(time.Duration(i)*time.Second), map[string]float64{"power_gpu_watts": float64(i), "clients": 1})
+		s.Record("nuc2", start.Add(time.Duration(i)*time.Second), map[string]float64{"power_gpu_watts": 2})
+	}
+
+	w := httptest.NewRecorder()
+	s.History(w, httptest.NewRequest(http.MethodGet, "/api/v1/history?metric=power_gpu_watts&from=2026-10-19T10:00:00Z&step=2s", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{
+  "version": "v1",
+  "metric": "power_gpu_watts",
+  "step": "2s",
+  "series": [
+    {"device": "nuc1", "points": [
+      {"time": "2026-10-19T10:00:00Z", "mean": 0.5, "min": 0, "max": 1},
+      {"time": "2026-10-19T10:00:02Z", "mean": 2, "min": 2, "max": 2}
+    ]},
+    {"device": "nuc2", "points": [
+      {"time": "2026-10-19T10:00:00Z", "mean": 2, "min": 2, "max": 2},
+      {"time": "2026-10-19T10:00:02Z", "mean": 2, "min": 2, "max": 2}
+    ]}
+  ]
+}`, w.Body.String())
+}
+
+func TestStore_History_Query(t *testing.T) {
+	s := openStore(t, t.TempDir(), start)
+	s.Record("nuc1", start, map[string]float64{"clients": 1})
+	from := strconv.FormatInt(start.Add(-time.Minute).Unix(), 10)
+	old := strconv.FormatInt(start.Add(-2*time.Hour).Unix(), 10)
+
+	tests := []struct {
+		query    string
+		wantCode int
+		wantBody string
+	}{
+		{query: "?metric=clients", wantCode: http.StatusOK, wantBody: `"step":"1m0s"`},
+		{query: "?metric=clients&from=" + from, wantCode: http.StatusOK, wantBody: `"step":"1s","series":[{"device":"nuc1"`},
+		{query: "?metric=clients&device=nuc1&step=10s&from=" + from, wantCode: http.StatusOK, wantBody: `"step":"10s"`},
+		{query: "?metric=clients&step=1500ms&from=" + from, wantCode: http.StatusOK, wantBody: `"step":"2s"`},
+		{query: "?metric=clients&step=90s&from=" + old, wantCode: http.StatusOK, wantBody: `"step":"2m0s"`},
+		{query: "", wantCode: http.StatusBadRequest, wantBody: `"error":"missing metric. known metrics: clients"`},
+		{query: "?metric=power", wantCode: http.StatusNotFound, wantBody: `"error":"unknown metric \"power\". known metrics: clients"`},
+		{query: "?metric=clients&device=nuc2", wantCode: http.StatusNotFound, wantBody: `"error":"unknown device \"nuc2\""`},
+		{query: "?metric=clients&from=yesterday", wantCode: http.StatusBadRequest, wantBody: `"error":"invalid from \"yesterday\""`},
+		{query: "?metric=clients&to=tomorrow", wantCode: http.StatusBadRequest, wantBody: `"error":"invalid to \"tomorrow\""`},
+		{query: "?metric=clients&from=2026-10-20T00:00:00Z", wantCode: http.StatusBadRequest, wantBody: `"error":"from must be before to"`},
+		{query: "?metric=clients&step=-1s", wantCode: http.StatusBadRequest, wantBody: `"error":"invalid step \"-1s\""`},
+		{query: "?metric=clients&step=100ms", wantCode: http.StatusBadRequest, wantBody: `"error":"step must be at least 1s"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.History(w, httptest.NewRequest(http.MethodGet, "/api/v1/history"+tt.query, nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Contains(t, w.Body.String(), tt.wantBody)
+		})
+	}
+}
+
+func Test_parseTime(t *testing.T) {
+	got, err := parseTime("1792404000.5")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1792404000, 5e8), got)
+
+	got, err = parseTime("2026-10-19T10:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, start, got)
+
+	_, err = parseTime("now")
+	assert.Error(t, err)
+}
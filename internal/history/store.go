@@ -0,0 +1,333 @@
+// Package history keeps the history of the exporter's metrics on disk, for hosts without Prometheus.
+//
+// Samples are downsampled into tiers of increasing resolution (e.g. 1s, 1m and 1h), each with its own retention period.
+// Each tier is kept in memory and in an append-only file, which is rewritten once most of its points have expired.
+package history
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tier is a resolution at which samples are kept, and how long they are kept for.
+type Tier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// resolutions are the supported tier resolutions, by name.
+var resolutions = map[string]time.Duration{"1s": time.Second, "1m": time.Minute, "1h": time.Hour}
+
+func resolutionName(resolution time.Duration) string {
+	for name, r := range resolutions {
+		if r == resolution {
+			return name
+		}
+	}
+	return resolution.String()
+}
+
+// DefaultTiers returns the default tiers: 1s resolution for 1 hour, 1m for 7 days and 1h for 365 days.
+func DefaultTiers() []Tier {
+	return []Tier{
+		{Resolution: time.Second, Retention: time.Hour},
+		{Resolution: time.Minute, Retention: 7 * 24 * time.Hour},
+		{Resolution: time.Hour, Retention: 365 * 24 * time.Hour},
+	}
+}
+
+// ParseRetention parses the retention of each tier, e.g. "1s=1h,1m=168h,1h=8760h". Tiers that aren't listed keep
+// their default retention. A retention of 0 disables the tier.
+func ParseRetention(s string) ([]Tier, error) {
+	tiers := DefaultTiers()
+	for entry := range strings.SplitSeq(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid retention %q: expected resolution=duration", entry)
+		}
+		resolution, ok := resolutions[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid resolution %q: must be 1s, 1m or 1h", name)
+		}
+		retention, err := time.ParseDuration(value)
+		if err != nil || retention < 0 {
+			return nil, fmt.Errorf("invalid retention %q", value)
+		}
+		if retention > 0 && retention < resolution {
+			return nil, fmt.Errorf("retention of the %s tier must be at least %s", name, resolution)
+		}
+		for i := range tiers {
+			if tiers[i].Resolution == resolution {
+				tiers[i].Retention = retention
+			}
+		}
+	}
+	tiers = slices.DeleteFunc(tiers, func(tier Tier) bool { return tier.Retention == 0 })
+	if len(tiers) == 0 {
+		return nil, errors.New("all tiers are disabled")
+	}
+	return tiers, nil
+}
+
+// Store keeps the history of a set of metrics for each device.
+type Store struct {
+	logger *slog.Logger
+	lock   sync.Mutex
+	tiers  []*tier // from the finest to the coarsest resolution
+	closed bool
+	now    func() time.Time
+}
+
+// Open loads the history kept in dir, creating the directory if needed.
+func Open(dir string, tiers []Tier, logger *slog.Logger) (*Store, error) {
+	return open(dir, tiers, logger, time.Now)
+}
+
+func open(dir string, tiers []Tier, logger *slog.Logger, now func() time.Time) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := Store{logger: logger, now: now}
+	tiers = slices.Clone(tiers)
+	slices.SortFunc(tiers, func(a, b Tier) int { return int(a.Resolution - b.Resolution) })
+	for _, cfg := range tiers {
+		path := filepath.Join(dir, "history-"+resolutionName(cfg.Resolution)+".dat")
+		t, err := openTier(cfg, path, logger.With("tier", resolutionName(cfg.Resolution)))
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		s.tiers = append(s.tiers, t)
+		if t.trim(s.now()) {
+			t.compact()
+		}
+	}
+	return &s, nil
+}
+
+// Record adds a sample of each metric in values, taken at time t, to the history of device.
+func (s *Store) Record(device string, t time.Time, values map[string]float64) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	snapshots := make(map[*tier][]byte)
+	for _, tier := range s.tiers {
+		start := t.Truncate(tier.Resolution).Unix()
+		for metric, value := range values {
+			if !math.IsNaN(value) && !math.IsInf(value, 0) {
+				tier.record(seriesKey{device: device, metric: metric}, start, value)
+			}
+		}
+		if tier.trim(s.now()) {
+			snapshots[tier] = tier.snapshot()
+		}
+	}
+	s.lock.Unlock()
+
+	// syncing the compacted files can take a while: don't block queries meanwhile
+	for tier, snapshot := range snapshots {
+		s.compact(tier, snapshot)
+	}
+}
+
+// compact writes the compacted file of a tier, and replaces the tier's file by it.
+func (s *Store) compact(t *tier, snapshot []byte) {
+	err := writeFileSync(t.path+".tmp", snapshot)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		_ = os.Remove(t.path + ".tmp")
+		return
+	}
+	t.replace(err)
+}
+
+// Close writes the buckets that are still being filled and closes the history files.
+func (s *Store) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var errs []error
+	for _, t := range s.tiers {
+		for _, ser := range t.series {
+			if ser.open != nil {
+				t.closeBucket(ser)
+			}
+		}
+		errs = append(errs, t.file.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// seriesKey identifies the history of a metric of a device.
+type seriesKey struct {
+	device string
+	metric string
+}
+
+// series holds the history of one metric of one device, in one tier.
+type series struct {
+	id     uint64
+	points []point
+	open   *bucket // the bucket being filled
+}
+
+// point is the consolidated value of a metric during one bucket of a tier.
+type point struct {
+	time  int64 // start of the bucket, in Unix seconds
+	count uint32
+	mean  float32
+	min   float32
+	max   float32
+}
+
+// bucket accumulates the samples received during one bucket of a tier.
+type bucket struct {
+	time  int64
+	count uint32
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func newBucket(time int64) *bucket {
+	return &bucket{time: time, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (b *bucket) add(value float64) {
+	b.count++
+	b.sum += value
+	b.min = min(b.min, value)
+	b.max = max(b.max, value)
+}
+
+// merge adds a point to the bucket, e.g. to continue filling a bucket that was written before a restart.
+func (b *bucket) merge(p point) {
+	b.count += p.count
+	b.sum += float64(p.mean) * float64(p.count)
+	b.min = min(b.min, float64(p.min))
+	b.max = max(b.max, float64(p.max))
+}
+
+func (b *bucket) point() point {
+	return point{time: b.time, count: b.count, mean: float32(b.sum / float64(b.count)), min: float32(b.min), max: float32(b.max)}
+}
+
+// minCompaction is the minimum number of expired points in a tier's file before it is rewritten.
+const minCompaction = 1000
+
+// tier holds the history at one resolution.
+type tier struct {
+	Tier
+	logger  *slog.Logger
+	path    string
+	file    *os.File
+	series  map[seriesKey]*series
+	nextID  uint64
+	live    int       // number of points in the file that are still kept
+	expired int       // number of points in the file that expired or were replaced
+	trimmed time.Time // last time expired points were removed
+	failing bool      // whether the last write failed
+	// compacting is set while the compacted file is written. The records written meanwhile are kept in pending.
+	compacting bool
+	pending    []byte
+}
+
+func (t *tier) record(key seriesKey, start int64, value float64) {
+	ser, ok := t.series[key]
+	if !ok {
+		ser = &series{id: t.nextID}
+		t.nextID++
+		t.series[key] = ser
+		t.write(appendSeries(nil, ser.id, key))
+	}
+	if ser.open != nil && ser.open.time != start {
+		if start < ser.open.time {
+			// out of order
+			return
+		}
+		t.closeBucket(ser)
+	}
+	if ser.open == nil {
+		ser.open = newBucket(start)
+		if n := len(ser.points); n > 0 {
+			last := ser.points[n-1]
+			if last.time > start {
+				ser.open = nil
+				return
+			}
+			if last.time == start {
+				// the bucket was written before a restart: continue filling it
+				ser.open.merge(last)
+				ser.points = ser.points[:n-1]
+				t.live--
+				t.expired++
+			}
+		}
+	}
+	ser.open.add(value)
+}
+
+// closeBucket adds the bucket being filled to the series' points.
+func (t *tier) closeBucket(ser *series) {
+	p := ser.open.point()
+	ser.open = nil
+	ser.points = append(ser.points, p)
+	t.live++
+	t.write(appendPoint(nil, ser.id, p))
+}
+
+// trim removes the points that are older than the tier's retention, at most once per resolution. It reports whether
+// most points in the tier's file have expired, so the file should be compacted.
+func (t *tier) trim(now time.Time) bool {
+	if now.Sub(t.trimmed) < t.Resolution {
+		return false
+	}
+	t.trimmed = now
+	cutoff := now.Add(-t.Retention).Unix()
+	for key, ser := range t.series {
+		i := sort.Search(len(ser.points), func(i int) bool { return ser.points[i].time >= cutoff })
+		ser.points = ser.points[i:]
+		t.live -= i
+		t.expired += i
+		if len(ser.points) == 0 && ser.open == nil {
+			delete(t.series, key)
+		}
+	}
+	return !t.compacting && t.expired >= minCompaction && t.expired > t.live
+}
+
+func (t *tier) write(record []byte) {
+	if t.compacting {
+		t.pending = append(t.pending, record...)
+	}
+	if _, err := t.file.Write(record); err != nil {
+		if !t.failing {
+			t.logger.Error("failed to write history", "path", t.path, "err", err)
+		}
+		t.failing = true
+		return
+	}
+	if t.failing {
+		t.logger.Info("writing history recovered", "path", t.path)
+	}
+	t.failing = false
+}
@@ -0,0 +1,187 @@
+package history
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []Tier
+		wantErr string
+	}{
+		{value: "", want: DefaultTiers()},
+		{value: "1s=6h, 1h=0", want: []Tier{{Resolution: time.Second, Retention: 6 * time.Hour}, {Resolution: time.Minute, Retention: 7 * 24 * time.Hour}}},
+		{value: "1s=0,1m=0,1h=0", wantErr: "all tiers are disabled"},
+		{value: "5m=1h", wantErr: `invalid resolution "5m"`},
+		{value: "1s", wantErr: `invalid retention "1s"`},
+		{value: "1m=forever", wantErr: `invalid retention "forever"`},
+		{value: "1h=30m", wantErr: "retention of the 1h tier must be at least 1h0m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			tiers, err := ParseRetention(tt.value)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, tiers)
+		})
+	}
+}
+
+// testTiers keeps 1s samples for 1 minute and 1m samples for 1 hour.
+var testTiers = []Tier{{Resolution: time.Minute, Retention: time.Hour}, {Resolution: time.Second, Retention: time.Minute}}
+
+// start is the time of the first sample in the tests.
+var start = time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+func openStore(t *testing.T, dir string, now time.Time) *Store {
+	t.Helper()
+	s, err := open(dir, testTiers, slog.New(slog.DiscardHandler), func() time.Time { return now })
+	require.NoError(t, err)
+	return s
+}
+
+func TestStore_Record(t *testing.T) {
+	s := openStore(t, t.TempDir(), start.Add(2*time.Minute))
+	// two samples per second during 90 seconds
+	for i := range 180 {
+		s.Record("nuc1", start.Add(time.Duration(i)*500*time.Millisecond), map[string]float64{"power_gpu_watts": float64(i % 4)})
+	}
+
+	series, step, err := s.Query("power_gpu_watts", "", start, start.Add(time.Hour), time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, step)
+	require.Len(t, series, 1)
+	assert.Equal(t, "nuc1", series[0].Device)
+	assert.Equal(t, []Point{
+		{Time: start, Mean: 1.5, Min: 0, Max: 3},
+		{Time: start.Add(time.Minute), Mean: 1.5, Min: 0, Max: 3}, // the bucket being filled
+	}, series[0].Points)
+
+	// the 1s tier covers the last minute
+	series, step, err = s.Query("power_gpu_watts", "nuc1", start.Add(80*time.Second), start.Add(89*time.Second), 0)
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, step)
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Points, 10)
+	assert.Equal(t, Point{Time: start.Add(80 * time.Second), Mean: 0.5, Min: 0, Max: 1}, series[0].Points[0])
+
+	// larger steps consolidate the points of the tier
+	series, step, err = s.Query("power_gpu_watts", "nuc1", start.Add(80*time.Second), start.Add(89*time.Second), 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, step)
+	assert.Equal(t, []Point{
+		{Time: start.Add(80 * time.Second), Mean: 1.3, Min: 0, Max: 3},
+		{Time: start.Add(85 * time.Second), Mean: 1.7, Min: 0, Max: 3},
+	}, series[0].Points)
+}
+
+func TestStore_Query_errors(t *testing.T) {
+	s := openStore(t, t.TempDir(), start)
+	s.Record("nuc1", start, map[string]float64{"clients": 1})
+
+	_, _, err := s.Query("power_gpu_watts", "", start.Add(-time.Minute), start, 0)
+	assert.ErrorIs(t, err, ErrUnknownMetric)
+	assert.ErrorContains(t, err, "known metrics: clients")
+	_, _, err = s.Query("clients", "nuc2", start.Add(-time.Minute), start, 0)
+	assert.ErrorIs(t, err, ErrUnknownDevice)
+	_, _, err = s.Query("clients", "", start.Add(-time.Minute), start, 500*time.Millisecond)
+	assert.EqualError(t, err, "step must be at least 1s")
+	_, _, err = s.Query("clients", "", start.Add(-4*time.Hour), start, time.Second)
+	assert.EqualError(t, err, "too many points: increase step or reduce the time range")
+}
+
+func TestStore_reopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, start)
+	s.Record("nuc1", start, map[string]float64{"clients": 1})
+	s.Record("nuc1", start.Add(time.Second), map[string]float64{"clients": 3})
+	require.NoError(t, s.Close())
+	// samples received after closing are ignored
+	s.Record("nuc1", start.Add(2*time.Second), map[string]float64{"clients": 100})
+
+	// the exporter restarts within the same minute: the bucket is filled further
+	s = openStore(t, dir, start.Add(30*time.Second))
+	s.Record("nuc1", start.Add(30*time.Second), map[string]float64{"clients": 5})
+	require.NoError(t, s.Close())
+
+	s = openStore(t, dir, start.Add(30*time.Second))
+	series, _, err := s.Query("clients", "", start, start.Add(time.Hour), time.Minute)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Equal(t, []Point{{Time: start, Mean: 3, Min: 1, Max: 5}}, series[0].Points)
+
+	series, _, err = s.Query("clients", "", start, start.Add(time.Minute), time.Second)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Len(t, series[0].Points, 3)
+}
+
+func TestStore_compact(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, start)
+	s.Record("nuc1", start, map[string]float64{"clients": 1})
+	s.Record("nuc1", start.Add(time.Second), map[string]float64{"clients": 2})
+
+	// points recorded while the compacted file is written are kept
+	s.lock.Lock()
+	snapshot := s.tiers[0].snapshot()
+	s.lock.Unlock()
+	s.Record("nuc1", start.Add(2*time.Second), map[string]float64{"clients": 3})
+	s.Record("nuc1", start.Add(3*time.Second), map[string]float64{"clients": 4})
+	s.compact(s.tiers[0], snapshot)
+	s.Record("nuc1", start.Add(4*time.Second), map[string]float64{"clients": 5})
+	require.NoError(t, s.Close())
+	assert.NoFileExists(t, filepath.Join(dir, "history-1s.dat.tmp"))
+
+	s = openStore(t, dir, start.Add(5*time.Second))
+	series, _, err := s.Query("clients", "", start, start.Add(time.Minute), time.Second)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Len(t, series[0].Points, 5)
+}
+
+func TestStore_retention(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, start)
+	now := start
+	s.now = func() time.Time { return now }
+	for i := range 3 * minCompaction {
+		now = start.Add(time.Duration(i) * time.Second)
+		s.Record("nuc1", now, map[string]float64{"clients": 1})
+	}
+
+	// only the last minute is kept at 1s resolution
+	series, _, err := s.Query("clients", "", now.Add(-time.Minute), now, time.Second)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Equal(t, now.Add(-time.Minute), series[0].Points[0].Time)
+	assert.Len(t, series[0].Points, 61)
+
+	// the file was compacted
+	info, err := os.Stat(filepath.Join(dir, "history-1s.dat"))
+	require.NoError(t, err)
+	assert.Less(t, info.Size(), int64(2*minCompaction*20))
+	require.NoError(t, s.Close())
+
+	// expired points are removed when loading the history
+	now = now.Add(30 * time.Minute)
+	s = openStore(t, dir, now)
+	series, _, err = s.Query("clients", "", now.Add(-time.Minute), now, time.Second)
+	require.NoError(t, err)
+	assert.Empty(t, series)
+	series, _, err = s.Query("clients", "", now.Add(-time.Hour), now, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Points, 30)
+	assert.Equal(t, Point{Time: start.Add(20 * time.Minute), Mean: 1, Min: 1, Max: 1}, series[0].Points[0])
+}
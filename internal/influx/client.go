@@ -0,0 +1,235 @@
+package influx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchSize     = 5000
+	defaultFlushInterval = time.Second
+	defaultMaxRetries    = 3
+	defaultBufferSize    = 100000
+	// finalFlushTimeout is the time the last lines get to be written when the Client stops.
+	finalFlushTimeout = 5 * time.Second
+)
+
+// Config contains the configuration of a Client.
+type Config struct {
+	// URL is the URL of InfluxDB, e.g. http://influxdb:8086.
+	URL string
+	// Org and Bucket determine where the lines are written.
+	Org    string
+	Bucket string
+	// Token is the API token used to authenticate.
+	Token string
+	// BatchSize is the maximum number of lines sent in one request. Defaults to 5000.
+	BatchSize int
+	// FlushInterval is the interval at which buffered lines are sent. Defaults to 1s.
+	FlushInterval time.Duration
+	// MaxRetries is the number of times a failed request is retried, before the lines are kept for the next flush.
+	// Defaults to 3.
+	MaxRetries int
+	// BufferSize is the maximum number of lines kept while InfluxDB is unavailable. The oldest lines are dropped first.
+	// Defaults to 100000.
+	BufferSize int
+}
+
+// Client writes line protocol to InfluxDB's v2 write API. Lines are buffered and sent in batches by Run. Requests
+// that fail with a network error, 429 or a 5xx response are retried with exponential backoff.
+type Client struct {
+	cfg        Config
+	url        string
+	httpClient *http.Client
+	logger     *slog.Logger
+	lock       sync.Mutex
+	lines      [][]byte
+	dropped    int
+	flush      chan struct{}
+	retryDelay time.Duration // delay before the first retry. Overridden during testing.
+}
+
+// NewClient returns a new Client.
+func NewClient(cfg Config, logger *slog.Logger) (*Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("influx: invalid url %q: must be an http or https URL", cfg.URL)
+	}
+	if cfg.Org == "" {
+		return nil, errors.New("influx: missing org")
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("influx: missing bucket")
+	}
+	u = u.JoinPath("/api/v2/write")
+	u.RawQuery = url.Values{"org": {cfg.Org}, "bucket": {cfg.Bucket}, "precision": {"ns"}}.Encode()
+
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultFlushInterval
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultBufferSize
+	}
+	return &Client{
+		cfg:        cfg,
+		url:        u.String(),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		logger:     logger,
+		flush:      make(chan struct{}, 1),
+		retryDelay: time.Second,
+	}, nil
+}
+
+// Write buffers the lines in p. It never fails: if the buffer is full, the oldest lines are dropped.
+func (c *Client) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for line := range bytes.Lines(p) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			c.lines = append(c.lines, bytes.Clone(line))
+		}
+	}
+	c.trim()
+	if len(c.lines) >= c.cfg.BatchSize {
+		select {
+		case c.flush <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// trim drops the oldest lines if the buffer is full. The caller must hold the lock.
+func (c *Client) trim() {
+	if n := len(c.lines) - c.cfg.BufferSize; n > 0 {
+		c.lines = c.lines[n:]
+		c.dropped += n
+	}
+}
+
+// Run sends the buffered lines every flush interval, or as soon as a batch is full, until ctx is done. Lines that are
+// still buffered are then sent one last time.
+func (c *Client) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), finalFlushTimeout)
+			defer cancel()
+			c.Flush(ctx)
+			return
+		case <-ticker.C:
+		case <-c.flush:
+		}
+		c.Flush(ctx)
+	}
+}
+
+// Flush sends the buffered lines, in batches of at most BatchSize lines. If a batch can't be sent, it is kept for the
+// next flush, unless InfluxDB rejected it.
+func (c *Client) Flush(ctx context.Context) {
+	for {
+		c.lock.Lock()
+		if c.dropped > 0 {
+			c.logger.Warn("InfluxDB buffer full: dropped lines", "dropped", c.dropped)
+			c.dropped = 0
+		}
+		batch := c.lines[:min(len(c.lines), c.cfg.BatchSize)]
+		c.lines = c.lines[len(batch):]
+		c.lock.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+
+		err := c.send(ctx, bytes.Join(batch, []byte("\n")))
+		var rejected *rejectedError
+		switch {
+		case errors.As(err, &rejected):
+			c.logger.Error("InfluxDB rejected lines", "lines", len(batch), "err", err)
+		case err != nil:
+			c.logger.Warn("failed to write to InfluxDB", "err", err)
+			c.lock.Lock()
+			c.lines = append(batch, c.lines...)
+			c.trim()
+			c.lock.Unlock()
+			return
+		}
+	}
+}
+
+// rejectedError indicates that InfluxDB rejected a request, which won't succeed when retried.
+type rejectedError struct {
+	status int
+	body   string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("%s: %s", http.StatusText(e.status), e.body)
+}
+
+// send writes the body to InfluxDB, retrying if the request fails with a temporary error.
+func (c *Client) send(ctx context.Context, body []byte) error {
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.post(ctx, body)
+		var rejected *rejectedError
+		if err == nil || errors.As(err, &rejected) || attempt == c.cfg.MaxRetries {
+			return err
+		}
+		c.logger.Debug("retrying InfluxDB write", "attempt", attempt+1, "err", err)
+		wait := max(delay, retryAfter)
+		delay *= 2
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// post sends one request. For a 429 or 503 response, it returns the delay requested by InfluxDB's Retry-After header.
+func (c *Client) post(ctx context.Context, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+c.cfg.Token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return 0, nil
+	}
+
+	content, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		var retryAfter time.Duration
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return retryAfter, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(content))
+	}
+	return 0, &rejectedError{status: resp.StatusCode, body: string(bytes.TrimSpace(content))}
+}
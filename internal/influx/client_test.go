@@ -0,0 +1,171 @@
+package influx
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient_Flush(t *testing.T) {
+	influxDB := newFakeInfluxDB(t)
+	c := newTestClient(t, influxDB.URL, Config{BatchSize: 2})
+
+	_, err := c.Write([]byte("m,t=1 v=1 1\nm,t=2 v=2 2\n\nm,t=3 v=3 3\n"))
+	require.NoError(t, err)
+	c.Flush(t.Context())
+
+	requests := influxDB.requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "/api/v2/write", requests[0].path)
+	assert.Equal(t, "bucket=gpu&org=home&precision=ns", requests[0].query)
+	assert.Equal(t, "Token secret", requests[0].authorization)
+	assert.Equal(t, "text/plain; charset=utf-8", requests[0].contentType)
+	assert.Equal(t, "m,t=1 v=1 1\nm,t=2 v=2 2", requests[0].body)
+	assert.Equal(t, "m,t=3 v=3 3", requests[1].body)
+}
+
+func TestClient_Flush_retry(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		failures int
+		wantSent bool
+		wantKept bool
+	}{
+		{name: "unavailable", status: http.StatusServiceUnavailable, failures: 2, wantSent: true},
+		{name: "too many requests", status: http.StatusTooManyRequests, failures: 1, wantSent: true},
+		{name: "retries exhausted", status: http.StatusInternalServerError, failures: 10, wantKept: true},
+		{name: "rejected", status: http.StatusBadRequest, failures: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			influxDB := newFakeInfluxDB(t)
+			influxDB.fail(tt.status, tt.failures)
+			c := newTestClient(t, influxDB.URL, Config{MaxRetries: 2})
+
+			_, _ = c.Write([]byte("m v=1 1\n"))
+			c.Flush(t.Context())
+
+			requests := influxDB.requests()
+			assert.Equal(t, tt.wantSent, len(requests) > 0 && requests[len(requests)-1].status == http.StatusNoContent)
+			if tt.wantKept {
+				assert.Len(t, requests, 3)
+			}
+			assert.Equal(t, tt.wantKept, len(c.lines) == 1)
+		})
+	}
+}
+
+func TestClient_Write_bufferFull(t *testing.T) {
+	c := newTestClient(t, "http://localhost:8086", Config{BufferSize: 2})
+	_, _ = c.Write([]byte("m v=1 1\nm v=2 2\nm v=3 3\n"))
+	assert.Equal(t, [][]byte{[]byte("m v=2 2"), []byte("m v=3 3")}, c.lines)
+	assert.Equal(t, 1, c.dropped)
+}
+
+func TestClient_Run(t *testing.T) {
+	influxDB := newFakeInfluxDB(t)
+	c := newTestClient(t, influxDB.URL, Config{BatchSize: 2, FlushInterval: time.Hour})
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+
+	// a full batch is sent immediately
+	_, _ = c.Write([]byte("m v=1 1\nm v=2 2\n"))
+	require.Eventually(t, func() bool { return len(influxDB.requests()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// the remaining lines are sent when the client stops
+	_, _ = c.Write([]byte("m v=3 3\n"))
+	cancel()
+	<-done
+	requests := influxDB.requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "m v=3 3", requests[1].body)
+}
+
+func TestNewClient_invalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{URL: "", Org: "home", Bucket: "gpu"},
+		{URL: "influxdb:8086", Org: "home", Bucket: "gpu"},
+		{URL: "http://influxdb:8086", Bucket: "gpu"},
+		{URL: "http://influxdb:8086", Org: "home"},
+	} {
+		_, err := NewClient(cfg, slog.New(slog.DiscardHandler))
+		assert.Error(t, err, cfg.URL)
+	}
+}
+
+func newTestClient(t *testing.T, url string, cfg Config) *Client {
+	t.Helper()
+	cfg.URL, cfg.Org, cfg.Bucket, cfg.Token = url, "home", "gpu", "secret"
+	c, err := NewClient(cfg, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+	c.retryDelay = time.Millisecond
+	return c
+}
+
+// fakeInfluxDB records the writes it receives. It fails the first requests if told to.
+type fakeInfluxDB struct {
+	*httptest.Server
+	lock     sync.Mutex
+	received []writeRequest
+	status   int
+	failures int
+}
+
+type writeRequest struct {
+	path, query, authorization, contentType, body string
+	status                                        int
+}
+
+func newFakeInfluxDB(t *testing.T) *fakeInfluxDB {
+	f := &fakeInfluxDB{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		status := http.StatusNoContent
+		if f.failures > 0 {
+			f.failures--
+			status = f.status
+		}
+		f.received = append(f.received, writeRequest{
+			path:          req.URL.Path,
+			query:         req.URL.RawQuery,
+			authorization: req.Header.Get("Authorization"),
+			contentType:   req.Header.Get("Content-Type"),
+			body:          string(body),
+			status:        status,
+		})
+		if status != http.StatusNoContent {
+			http.Error(w, strings.ToLower(http.StatusText(status)), status)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeInfluxDB) fail(status, count int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.status, f.failures = status, count
+}
+
+func (f *fakeInfluxDB) requests() []writeRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]writeRequest(nil), f.received...)
+}
@@ -0,0 +1,126 @@
+// Package influx writes the GPU statistics as InfluxDB line protocol, to InfluxDB's v2 write API or to any io.Writer
+// (e.g. stdout, for Telegraf's execd input).
+package influx
+
+import (
+	"context"
+	"fmt"
+	"github.com/rmarchant/intel-gpu-exporter/internal/collector"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Run writes the statistics of source to w every interval, until ctx is done. Each write reports the median of the
+// samples received since the previous one, so interval can't exceed collector.MaxStatsWindow.
+func Run(ctx context.Context, source collector.Source, interval time.Duration, w io.Writer) error {
+	if interval <= 0 || interval > collector.MaxStatsWindow {
+		return fmt.Errorf("influx: invalid interval %s: must be between 0 and %s", interval, collector.MaxStatsWindow)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var b []byte
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			b = b[:0]
+			for _, device := range source.Devices(interval, collector.AggregationMedian) {
+				b = AppendDevice(b, device, now)
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// AppendDevice appends the statistics of a device to b, as line protocol with timestamp t. Each device is identified by
+// the device tag. The gpumon measurement holds the device's power, frequency, clients and whether intel_gpu_top is up;
+// gpumon_engine and gpumon_engine_class hold the usage of each engine and engine class. Engine usage is a ratio (0-1),
+// power is in watts and frequencies in Hz. If the device has no samples, only up is written.
+func AppendDevice(b []byte, device collector.DeviceStats, t time.Time) []byte {
+	timestamp := t.UnixNano()
+	tags := appendTag(nil, "device", device.Name)
+
+	up := 0
+	if device.State == collector.SourceRunning || device.State == collector.SourceIdle {
+		up = 1
+	}
+	b = append(b, "gpumon"...)
+	b = append(b, tags...)
+	b = append(b, " up="...)
+	b = strconv.AppendInt(b, int64(up), 10)
+	b = append(b, 'i')
+	if device.Samples > 0 {
+		b = appendField(b, "clients", device.Clients.Count)
+		b = appendField(b, "power_gpu_watts", device.Power.GPU)
+		b = appendField(b, "power_package_watts", device.Power.Package)
+		b = appendField(b, "frequency_actual_hz", device.Frequency.Actual)
+		b = appendField(b, "frequency_requested_hz", device.Frequency.Requested)
+	}
+	b = appendTimestamp(b, timestamp)
+	if device.Samples == 0 {
+		return b
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(device.Engines)) {
+		b = append(b, "gpumon_engine"...)
+		b = append(b, tags...)
+		b = appendTag(b, "engine", name)
+		if engine, err := igt.ParseEngine(name); err == nil {
+			b = appendTag(b, "engine_class", string(engine.Class))
+			b = appendTag(b, "engine_instance", strconv.Itoa(engine.Instance))
+		}
+		b = appendUsage(b, device.Engines[name])
+		b = appendTimestamp(b, timestamp)
+	}
+	for _, class := range slices.Sorted(maps.Keys(device.EngineClasses)) {
+		b = append(b, "gpumon_engine_class"...)
+		b = append(b, tags...)
+		b = appendTag(b, "engine_class", string(class))
+		b = appendUsage(b, device.EngineClasses[class])
+		b = appendTimestamp(b, timestamp)
+	}
+	return b
+}
+
+func appendUsage(b []byte, usage collector.EngineUsage) []byte {
+	b = append(b, " busy="...)
+	b = strconv.AppendFloat(b, usage.Busy, 'f', -1, 64)
+	b = appendField(b, "sema", usage.Sema)
+	return appendField(b, "wait", usage.Wait)
+}
+
+// appendField appends a float field, after the first field.
+func appendField(b []byte, key string, value float64) []byte {
+	b = append(b, ',')
+	b = append(b, key...)
+	b = append(b, '=')
+	return strconv.AppendFloat(b, value, 'f', -1, 64)
+}
+
+func appendTimestamp(b []byte, timestamp int64) []byte {
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, timestamp, 10)
+	return append(b, '\n')
+}
+
+// tagEscaper escapes the characters that have a special meaning in tag keys and values.
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+func appendTag(b []byte, key, value string) []byte {
+	if value == "" {
+		// InfluxDB rejects empty tag values
+		return b
+	}
+	b = append(b, ',')
+	b = append(b, tagEscaper.Replace(key)...)
+	b = append(b, '=')
+	return append(b, tagEscaper.Replace(value)...)
+}
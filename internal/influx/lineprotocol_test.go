@@ -0,0 +1,116 @@
+package influx
+
+import (
+	"bytes"
+	"context"
+	"github.com/rmarchant/intel-gpu-exporter/internal/collector"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAppendDevice(t *testing.T) {
+	timestamp := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		device collector.DeviceStats
+		want   string
+	}{
+		{
+			name:   "running",
+			device: testDevice,
+			want: `gpumon,device=nuc1 up=1i,clients=2,power_gpu_watts=1.5,power_package_watts=6,frequency_actual_hz=550000000,frequency_requested_hz=600000000 1700000000000000000
+gpumon_engine,device=nuc1,engine=Render/3D/0,engine_class=render,engine_instance=0 busy=0.25,sema=0,wait=0.01 1700000000000000000
+gpumon_engine,device=nuc1,engine=Video/1,engine_class=video,engine_instance=1 busy=0.4,sema=0.1,wait=0 1700000000000000000
+gpumon_engine_class,device=nuc1,engine_class=render busy=0.25,sema=0,wait=0.01 1700000000000000000
+gpumon_engine_class,device=nuc1,engine_class=video busy=0.4,sema=0.1,wait=0 1700000000000000000
+`,
+		},
+		{
+			name:   "no samples",
+			device: collector.DeviceStats{Name: "nuc1", State: collector.SourceBackoff},
+			want:   "gpumon,device=nuc1 up=0i 1700000000000000000\n",
+		},
+		{
+			name:   "escaped tags",
+			device: collector.DeviceStats{Name: "gpu 1,a=b", State: collector.SourceIdle},
+			want:   `gpumon,device=gpu\ 1\,a\=b up=1i 1700000000000000000` + "\n",
+		},
+		{
+			name:   "empty device",
+			device: collector.DeviceStats{State: collector.SourceRunning},
+			want:   "gpumon up=1i 1700000000000000000\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, string(AppendDevice(nil, tt.device, timestamp)))
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	var out lockedBuffer
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() { done <- Run(ctx, fakeSource{}, 10*time.Millisecond, &out) }()
+
+	require.Eventually(t, func() bool { return strings.Count(out.String(), "\n") >= 10 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	for line := range strings.Lines(out.String()) {
+		assert.Regexp(t, `^gpumon(_engine|_engine_class)?,device=nuc1,?\S* \S+ \d+\n$`, line)
+	}
+}
+
+func TestRun_invalidInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second, time.Hour} {
+		assert.ErrorContains(t, Run(t.Context(), fakeSource{}, interval, io.Discard), "invalid interval", interval)
+	}
+}
+
+var testDevice = collector.DeviceStats{
+	Name:    "nuc1",
+	State:   collector.SourceRunning,
+	Samples: 10,
+	Engines: map[string]collector.EngineUsage{
+		"Video/1":     {Busy: 0.4, Sema: 0.1},
+		"Render/3D/0": {Busy: 0.25, Wait: 0.01},
+	},
+	EngineClasses: map[igt.EngineClass]collector.EngineUsage{
+		igt.EngineClassVideo:  {Busy: 0.4, Sema: 0.1},
+		igt.EngineClassRender: {Busy: 0.25, Wait: 0.01},
+	},
+	Power:     collector.PowerUsage{GPU: 1.5, Package: 6},
+	Frequency: collector.Frequency{Requested: 6e8, Actual: 5.5e8},
+	Clients:   collector.ClientUsage{Count: 2},
+}
+
+type fakeSource struct{}
+
+func (fakeSource) Devices(time.Duration, collector.Aggregation) []collector.DeviceStats {
+	return []collector.DeviceStats{testDevice}
+}
+
+// lockedBuffer is a bytes.Buffer that can be written and read concurrently.
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
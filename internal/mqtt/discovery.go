@@ -0,0 +1,141 @@
+package mqtt
+
+import (
+	"fmt"
+	"github.com/rmarchant/intel-gpu-exporter/internal/collector"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// state is the payload published on a device's state topic. Engine busy is a percentage, power is in watts.
+type state struct {
+	Clients      float64            `json:"clients"`
+	PowerGPU     float64            `json:"power_gpu"`
+	PowerPackage float64            `json:"power_package"`
+	Engines      map[string]float64 `json:"engines"`
+}
+
+func newState(device collector.DeviceStats) state {
+	s := state{
+		Clients:      device.Clients.Count,
+		PowerGPU:     device.Power.GPU,
+		PowerPackage: device.Power.Package,
+		Engines:      make(map[string]float64, len(device.EngineClasses)),
+	}
+	for class, usage := range device.EngineClasses {
+		s.Engines[string(class)] = 100 * usage.Busy
+	}
+	return s
+}
+
+// sensor is the configuration of a Home Assistant MQTT sensor.
+// See https://www.home-assistant.io/integrations/sensor.mqtt/.
+type sensor struct {
+	Name             string         `json:"name"`
+	UniqueID         string         `json:"unique_id"`
+	StateTopic       string         `json:"state_topic"`
+	ValueTemplate    string         `json:"value_template"`
+	Unit             string         `json:"unit_of_measurement,omitempty"`
+	DeviceClass      string         `json:"device_class,omitempty"`
+	StateClass       string         `json:"state_class"`
+	Precision        int            `json:"suggested_display_precision"`
+	Availability     []availability `json:"availability"`
+	AvailabilityMode string         `json:"availability_mode"`
+	Device           haDevice       `json:"device"`
+	Origin           origin         `json:"origin"`
+	// id identifies the sensor in its discovery topic.
+	id string
+}
+
+type availability struct {
+	Topic string `json:"topic"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type origin struct {
+	Name string `json:"name"`
+}
+
+// sensors returns the Home Assistant sensors of a device: its number of clients, its power and the busy percentage of
+// each of its engine classes. A sensor is only available while both the exporter and the device's intel_gpu_top are up.
+func (p *Publisher) sensors(device collector.DeviceStats) []sensor {
+	id := p.deviceID(device.Name)
+	deviceName := device.Name
+	if deviceName == "local" {
+		deviceName = p.cfg.Node
+	}
+	newSensor := func(key, name, unit, deviceClass string) sensor {
+		return sensor{
+			Name:          name,
+			UniqueID:      id + "_" + key,
+			StateTopic:    p.deviceTopic(device.Name, "state"),
+			ValueTemplate: "{{ value_json." + key + " }}",
+			Unit:          unit,
+			DeviceClass:   deviceClass,
+			StateClass:    "measurement",
+			Precision:     1,
+			Availability: []availability{
+				{Topic: p.statusTopic()},
+				{Topic: p.deviceTopic(device.Name, "availability")},
+			},
+			AvailabilityMode: "all",
+			Device: haDevice{
+				Identifiers:  []string{id},
+				Name:         deviceName + " GPU",
+				Manufacturer: "Intel",
+				Model:        "GPU",
+			},
+			Origin: origin{Name: "intel-gpu-exporter"},
+			id:     key,
+		}
+	}
+
+	clients := newSensor("clients", "Clients", "", "")
+	clients.Precision = 0
+	sensors := []sensor{
+		clients,
+		newSensor("power_gpu", "GPU power", "W", "power"),
+		newSensor("power_package", "Package power", "W", "power"),
+	}
+	for _, class := range slices.Sorted(maps.Keys(device.EngineClasses)) {
+		busy := newSensor("engine_"+string(class), engineName(class)+" busy", "%", "")
+		busy.ValueTemplate = "{{ value_json.engines." + string(class) + " }}"
+		sensors = append(sensors, busy)
+	}
+	return sensors
+}
+
+// engineName returns the display name of an engine class, e.g. "Video enhance".
+func engineName(class igt.EngineClass) string {
+	name := strings.ReplaceAll(string(class), "_", " ")
+	if name == "" {
+		return name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// objectID replaces the characters that aren't allowed in MQTT topic levels and Home Assistant IDs. If any were
+// replaced, a hash of s is appended, so e.g. "nuc.1" and "nuc_1" don't get the same ID.
+func objectID(s string) string {
+	id := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+	if id == s {
+		return id
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return fmt.Sprintf("%s_%08x", id, h.Sum32())
+}
@@ -0,0 +1,55 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"github.com/rmarchant/intel-gpu-exporter/internal/collector"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestPublisher_sensors(t *testing.T) {
+	p, err := New(Config{Broker: "tcp://mosquitto:1883", Node: "pve1", DiscoveryPrefix: "homeassistant", Interval: time.Second}, fakeSource{}, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+
+	sensors := p.sensors(collector.DeviceStats{
+		Name:          "local",
+		EngineClasses: map[igt.EngineClass]collector.EngineUsage{igt.EngineClassVideoEnhance: {}},
+	})
+	require.Len(t, sensors, 4)
+	payload, err := json.Marshal(sensors[3])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"name": "Video enhance busy",
+		"unique_id": "gpumon_pve1_local_engine_video_enhance",
+		"state_topic": "gpumon/pve1/local/state",
+		"value_template": "{{ value_json.engines.video_enhance }}",
+		"unit_of_measurement": "%",
+		"state_class": "measurement",
+		"suggested_display_precision": 1,
+		"availability": [{"topic": "gpumon/pve1/status"}, {"topic": "gpumon/pve1/local/availability"}],
+		"availability_mode": "all",
+		"device": {"identifiers": ["gpumon_pve1_local"], "name": "pve1 GPU", "manufacturer": "Intel", "model": "GPU"},
+		"origin": {"name": "intel-gpu-exporter"}
+	}`, string(payload))
+	assert.Equal(t, "homeassistant/sensor/gpumon_pve1_local/engine_video_enhance/config", p.discoveryTopic("local", sensors[3].id))
+
+	// remote devices are named after their SSH target
+	sensors = p.sensors(collector.DeviceStats{Name: "nuc 2"})
+	require.Len(t, sensors, 3)
+	assert.Equal(t, "nuc 2 GPU", sensors[0].Device.Name)
+	assert.Equal(t, "gpumon_pve1_nuc_2_5944210f_clients", sensors[0].UniqueID)
+	assert.Equal(t, "gpumon/pve1/nuc_2_5944210f/state", sensors[0].StateTopic)
+}
+
+func Test_objectID(t *testing.T) {
+	assert.Equal(t, "pve1", objectID("pve1"))
+	assert.Equal(t, "nuc-1_local", objectID("nuc-1_local"))
+	assert.Equal(t, "gpu_1__a_b__0f12d3b9", objectID("gpu/1/+a#b "))
+	// replaced characters don't make IDs collide
+	assert.Equal(t, "nuc_1_de2b5a88", objectID("nuc.1"))
+	assert.Equal(t, "nuc_1", objectID("nuc_1"))
+}
@@ -0,0 +1,231 @@
+// Package mqtt publishes the GPU statistics to an MQTT broker, with Home Assistant MQTT discovery.
+//
+// For each device, the publisher sends a JSON state message to <prefix>/<node>/<device>/state and whether its
+// intel_gpu_top is up (as reported by gpumon_source_up) to <prefix>/<node>/<device>/availability. The exporter's own
+// availability is published to <prefix>/<node>/status, which the broker sets to offline (as the last will) if the
+// exporter disconnects unexpectedly.
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rmarchant/intel-gpu-exporter/internal/collector"
+	"log/slog"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	online  = "online"
+	offline = "offline"
+	// publishTimeout is the time a publish gets to complete.
+	publishTimeout = 5 * time.Second
+)
+
+// Config contains the configuration of a Publisher.
+type Config struct {
+	// Broker is the URL of the MQTT broker, e.g. tcp://mosquitto:1883. Use ssl:// for TLS, or ws:// and wss:// for
+	// websockets.
+	Broker string
+	// ClientID identifies the connection to the broker. Defaults to intel-gpu-exporter-<Node>.
+	ClientID string
+	// Username and Password are used to authenticate with the broker.
+	Username string
+	Password string
+	// Node identifies the exporter, e.g. the hostname, so multiple exporters can share a broker.
+	Node string
+	// TopicPrefix is the first level of the published topics. Defaults to gpumon.
+	TopicPrefix string
+	// DiscoveryPrefix is Home Assistant's discovery prefix. Discovery is disabled if empty.
+	DiscoveryPrefix string
+	// Interval is the interval at which the statistics are published. Each message reports the median of the samples
+	// received since the previous one, so it can't exceed collector.MaxStatsWindow.
+	Interval time.Duration
+}
+
+// Publisher periodically publishes the GPU statistics reported by a collector.Source to an MQTT broker.
+type Publisher struct {
+	cfg    Config
+	source collector.Source
+	client paho.Client
+	logger *slog.Logger
+	lock   sync.Mutex
+	// announced holds the sensors announced to Home Assistant, and availability the last availability published,
+	// for each device. Both are cleared on (re)connect, so they are published again.
+	announced    map[string][]string
+	availability map[string]string
+}
+
+// New returns a new Publisher. It connects to the broker when Run is called.
+func New(cfg Config, source collector.Source, logger *slog.Logger) (*Publisher, error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil || u.Host == "" || !slices.Contains([]string{"tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss"}, u.Scheme) {
+		return nil, fmt.Errorf("mqtt: invalid broker %q: must be a tcp, ssl, ws or wss URL", cfg.Broker)
+	}
+	if cfg.Node = objectID(cfg.Node); cfg.Node == "" {
+		return nil, errors.New("mqtt: missing node")
+	}
+	if cfg.Interval <= 0 || cfg.Interval > collector.MaxStatsWindow {
+		return nil, fmt.Errorf("mqtt: invalid interval %s: must be between 0 and %s", cfg.Interval, collector.MaxStatsWindow)
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "intel-gpu-exporter-" + cfg.Node
+	}
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = "gpumon"
+	}
+
+	p := Publisher{cfg: cfg, source: source, logger: logger.With("broker", cfg.Broker)}
+	p.reset()
+	options := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetWill(p.statusTopic(), offline, 1, true).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetOrderMatters(false).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			p.logger.Warn("lost connection to MQTT broker", "err", err)
+		})
+	p.client = paho.NewClient(options)
+	return &p, nil
+}
+
+// Run connects to the broker and publishes the statistics every interval, until ctx is done. It then marks the exporter
+// as offline and disconnects.
+func (p *Publisher) Run(ctx context.Context) {
+	// with ConnectRetry, Connect keeps trying in the background
+	p.client.Connect()
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if p.client.IsConnectionOpen() {
+				if err := wait(p.client.Publish(p.statusTopic(), 1, true, offline)); err != nil {
+					p.logger.Warn("failed to publish MQTT status", "err", err)
+				}
+			}
+			p.client.Disconnect(250)
+			return
+		case <-ticker.C:
+			if !p.client.IsConnectionOpen() {
+				p.logger.Debug("not connected to MQTT broker: skipping publish")
+				continue
+			}
+			if err := p.publish(); err != nil {
+				p.logger.Warn("failed to publish to MQTT", "err", err)
+			}
+		}
+	}
+}
+
+// onConnect marks the exporter as online and makes the next publish announce all sensors again. If discovery is
+// enabled, it also listens to Home Assistant's status, so the sensors are announced again when Home Assistant restarts.
+func (p *Publisher) onConnect(client paho.Client) {
+	p.logger.Info("connected to MQTT broker")
+	p.reset()
+	if err := wait(client.Publish(p.statusTopic(), 1, true, online)); err != nil {
+		p.logger.Warn("failed to publish MQTT status", "err", err)
+	}
+	if p.cfg.DiscoveryPrefix == "" {
+		return
+	}
+	err := wait(client.Subscribe(p.cfg.DiscoveryPrefix+"/status", 1, func(_ paho.Client, msg paho.Message) {
+		if string(msg.Payload()) == online {
+			p.logger.Debug("Home Assistant is online: announcing sensors")
+			p.reset()
+		}
+	}))
+	if err != nil {
+		p.logger.Warn("failed to subscribe to Home Assistant status", "err", err)
+	}
+}
+
+func (p *Publisher) reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.announced = make(map[string][]string)
+	p.availability = make(map[string]string)
+}
+
+// publish publishes the state and availability of each device and, if its sensors changed, announces them to Home
+// Assistant.
+func (p *Publisher) publish() error {
+	p.lock.Lock()
+	var tokens []paho.Token
+	for _, device := range p.source.Devices(p.cfg.Interval, collector.AggregationMedian) {
+		available := offline
+		if device.State == collector.SourceRunning || device.State == collector.SourceIdle {
+			available = online
+		}
+		if p.availability[device.Name] != available {
+			p.availability[device.Name] = available
+			tokens = append(tokens, p.client.Publish(p.deviceTopic(device.Name, "availability"), 1, true, available))
+		}
+		if device.Samples == 0 {
+			continue
+		}
+
+		if p.cfg.DiscoveryPrefix != "" {
+			sensors := p.sensors(device)
+			ids := make([]string, len(sensors))
+			for i, s := range sensors {
+				ids[i] = s.id
+			}
+			if !slices.Equal(p.announced[device.Name], ids) {
+				for _, s := range sensors {
+					payload, _ := json.Marshal(s)
+					tokens = append(tokens, p.client.Publish(p.discoveryTopic(device.Name, s.id), 1, true, payload))
+				}
+				p.announced[device.Name] = ids
+			}
+		}
+		payload, _ := json.Marshal(newState(device))
+		tokens = append(tokens, p.client.Publish(p.deviceTopic(device.Name, "state"), 0, false, payload))
+	}
+	p.lock.Unlock()
+
+	var errs []error
+	for _, token := range tokens {
+		errs = append(errs, wait(token))
+	}
+	return errors.Join(errs...)
+}
+
+// wait waits for token to complete, for at most publishTimeout.
+func wait(token paho.Token) error {
+	if !token.WaitTimeout(publishTimeout) {
+		return errors.New("timeout")
+	}
+	return token.Error()
+}
+
+// statusTopic returns the topic of the exporter's availability.
+func (p *Publisher) statusTopic() string {
+	return p.cfg.TopicPrefix + "/" + p.cfg.Node + "/status"
+}
+
+// deviceTopic returns a topic of a device, e.g. gpumon/pve1/local/state.
+func (p *Publisher) deviceTopic(device, name string) string {
+	return p.cfg.TopicPrefix + "/" + p.cfg.Node + "/" + objectID(device) + "/" + name
+}
+
+// deviceID returns the identifier of a device in Home Assistant, e.g. gpumon_pve1_local.
+func (p *Publisher) deviceID(device string) string {
+	return "gpumon_" + p.cfg.Node + "_" + objectID(device)
+}
+
+// discoveryTopic returns the topic of a sensor's discovery message, e.g. homeassistant/sensor/gpumon_pve1_local/clients/config.
+func (p *Publisher) discoveryTopic(device, sensor string) string {
+	return p.cfg.DiscoveryPrefix + "/sensor/" + p.deviceID(device) + "/" + sensor + "/config"
+}
@@ -0,0 +1,197 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/rmarchant/intel-gpu-exporter/internal/collector"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublisher(t *testing.T) {
+	b := startBroker(t)
+	p, err := New(Config{
+		Broker:          b.url,
+		Node:            "pve1",
+		DiscoveryPrefix: "homeassistant",
+		Interval:        20 * time.Millisecond,
+	}, fakeSource{}, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool { return b.received("gpumon/pve1/local/state") }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, message{payload: "online", retained: true}, b.last("gpumon/pve1/status"))
+	assert.Equal(t, message{payload: "online", retained: true}, b.last("gpumon/pve1/local/availability"))
+	assert.Equal(t, message{payload: "offline", retained: true}, b.last("gpumon/pve1/nuc2/availability"))
+	assert.False(t, b.received("gpumon/pve1/nuc2/state"))
+
+	var s state
+	require.NoError(t, json.Unmarshal([]byte(b.last("gpumon/pve1/local/state").payload), &s))
+	assert.Equal(t, state{Clients: 2, PowerGPU: 1.5, PowerPackage: 6, Engines: map[string]float64{"render": 25, "video": 40}}, s)
+
+	for _, id := range []string{"clients", "power_gpu", "power_package", "engine_render", "engine_video"} {
+		msg := b.last("homeassistant/sensor/gpumon_pve1_local/" + id + "/config")
+		assert.True(t, msg.retained, id)
+		var config map[string]any
+		require.NoError(t, json.Unmarshal([]byte(msg.payload), &config), id)
+		assert.Equal(t, "gpumon_pve1_local_"+id, config["unique_id"])
+		assert.Equal(t, "gpumon/pve1/local/state", config["state_topic"])
+	}
+	assert.False(t, b.received("homeassistant/sensor/gpumon_pve1_nuc2/clients/config"))
+
+	// a graceful shutdown marks the exporter as offline
+	cancel()
+	<-done
+	assert.Equal(t, message{payload: "offline", retained: true}, b.last("gpumon/pve1/status"))
+}
+
+func TestPublisher_lastWill(t *testing.T) {
+	b := startBroker(t)
+	p, err := New(Config{Broker: b.url, Node: "pve1", Interval: collector.MaxStatsWindow}, fakeSource{}, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+	go p.Run(t.Context())
+	require.Eventually(t, func() bool { return b.last("gpumon/pve1/status").payload == "online" }, 5*time.Second, 10*time.Millisecond)
+
+	// the broker publishes the last will when the connection is lost ...
+	client, ok := b.server.Clients.Get("intel-gpu-exporter-pve1")
+	require.True(t, ok)
+	b.reset()
+	client.Stop(errors.New("connection lost"))
+	require.Eventually(t, func() bool { return b.received("gpumon/pve1/status") }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, message{payload: "offline", retained: true}, b.first("gpumon/pve1/status"))
+
+	// ... and the exporter is back online once it reconnects
+	require.Eventually(t, func() bool { return b.last("gpumon/pve1/status").payload == "online" }, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestPublisher_homeAssistantRestart(t *testing.T) {
+	b := startBroker(t)
+	p, err := New(Config{
+		Broker:          b.url,
+		Node:            "pve1",
+		DiscoveryPrefix: "homeassistant",
+		Interval:        20 * time.Millisecond,
+	}, fakeSource{}, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+	go p.Run(t.Context())
+	const topic = "homeassistant/sensor/gpumon_pve1_local/clients/config"
+	require.Eventually(t, func() bool { return b.received(topic) }, 5*time.Second, 10*time.Millisecond)
+
+	// sensors are only announced once ...
+	b.reset()
+	require.Eventually(t, func() bool { return b.received("gpumon/pve1/local/state") }, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, b.received(topic))
+
+	// ... unless Home Assistant restarts
+	require.NoError(t, b.server.Publish("homeassistant/status", []byte("online"), false, 1))
+	require.Eventually(t, func() bool { return b.received(topic) }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNew_invalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{Broker: "", Node: "pve1", Interval: time.Second},
+		{Broker: "mosquitto:1883", Node: "pve1", Interval: time.Second},
+		{Broker: "http://mosquitto:1883", Node: "pve1", Interval: time.Second},
+		{Broker: "tcp://mosquitto:1883", Interval: time.Second},
+		{Broker: "tcp://mosquitto:1883", Node: "pve1"},
+		{Broker: "tcp://mosquitto:1883", Node: "pve1", Interval: time.Hour},
+	} {
+		_, err := New(cfg, fakeSource{}, slog.New(slog.DiscardHandler))
+		assert.Error(t, err, cfg.Broker)
+	}
+}
+
+type fakeSource struct{}
+
+func (fakeSource) Devices(time.Duration, collector.Aggregation) []collector.DeviceStats {
+	return []collector.DeviceStats{
+		{
+			Name:    "local",
+			State:   collector.SourceRunning,
+			Samples: 10,
+			EngineClasses: map[igt.EngineClass]collector.EngineUsage{
+				igt.EngineClassVideo:  {Busy: 0.4},
+				igt.EngineClassRender: {Busy: 0.25},
+			},
+			Power:   collector.PowerUsage{GPU: 1.5, Package: 6},
+			Clients: collector.ClientUsage{Count: 2},
+		},
+		{Name: "nuc2", State: collector.SourceBackoff},
+	}
+}
+
+// broker is an embedded MQTT broker that records the messages published to it.
+type broker struct {
+	server   *mochi.Server
+	url      string
+	lock     sync.Mutex
+	messages map[string][]message
+}
+
+type message struct {
+	payload  string
+	retained bool
+}
+
+func startBroker(t *testing.T) *broker {
+	t.Helper()
+	server := mochi.New(&mochi.Options{InlineClient: true, Logger: slog.New(slog.DiscardHandler)})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	listener := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	require.NoError(t, server.AddListener(listener))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	b := broker{server: server, url: "tcp://" + listener.Address(), messages: make(map[string][]message)}
+	require.NoError(t, server.Subscribe("#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.messages[pk.TopicName] = append(b.messages[pk.TopicName], message{payload: string(pk.Payload), retained: pk.FixedHeader.Retain})
+	}))
+	return &b
+}
+
+func (b *broker) received(topic string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.messages[topic]) > 0
+}
+
+func (b *broker) first(topic string) message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.messages[topic]) == 0 {
+		return message{}
+	}
+	return b.messages[topic][0]
+}
+
+func (b *broker) last(topic string) message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.messages[topic]) == 0 {
+		return message{}
+	}
+	return b.messages[topic][len(b.messages[topic])-1]
+}
+
+func (b *broker) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	clear(b.messages)
+}
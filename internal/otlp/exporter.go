@@ -0,0 +1,231 @@
+// Package otlp pushes the GPU statistics to an OpenTelemetry Collector (or any other OTLP receiver).
+//
+// Metrics follow the OpenTelemetry hardware semantic conventions where they fit: engine busy is reported as
+// hw.gpu.utilization and GPU power as hw.power. The other statistics use the gpumon namespace.
+package otlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rmarchant/intel-gpu-exporter/internal/collector"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocol is the transport used to send metrics.
+type Protocol string
+
+const (
+	ProtocolGRPC Protocol = "grpc"
+	ProtocolHTTP Protocol = "http/protobuf"
+)
+
+// Config contains the configuration of the OTLP exporter.
+type Config struct {
+	// Endpoint is the URL of the OTLP receiver, e.g. http://otel-collector:4317. With http, the scheme disables TLS.
+	// For HTTP, /v1/metrics is used if the URL has no path.
+	Endpoint string
+	// Protocol is the transport used to send metrics. Defaults to gRPC.
+	Protocol Protocol
+	// Interval is the interval at which metrics are sent. Each export reports the median of the samples received since
+	// the previous one, so it can't exceed collector.MaxStatsWindow.
+	Interval time.Duration
+	// Headers are sent with each export, e.g. for authentication.
+	Headers map[string]string
+	// Resource contains attributes added to the resource, e.g. deployment.environment.
+	Resource map[string]string
+}
+
+// ParseProtocol returns the Protocol for s.
+func ParseProtocol(s string) (Protocol, error) {
+	switch protocol := Protocol(s); protocol {
+	case ProtocolGRPC, ProtocolHTTP:
+		return protocol, nil
+	default:
+		return "", fmt.Errorf("invalid protocol %q: must be %s or %s", s, ProtocolGRPC, ProtocolHTTP)
+	}
+}
+
+// Exporter periodically sends the GPU statistics reported by a collector.Source over OTLP.
+type Exporter struct {
+	provider *sdkmetric.MeterProvider
+}
+
+// New starts an Exporter. Failed exports are logged.
+func New(ctx context.Context, cfg Config, source collector.Source, logger *slog.Logger) (*Exporter, error) {
+	if cfg.Interval <= 0 || cfg.Interval > collector.MaxStatsWindow {
+		return nil, fmt.Errorf("otlp: invalid interval %s: must be between 0 and %s", cfg.Interval, collector.MaxStatsWindow)
+	}
+	exporter, err := newMetricExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	attributes := []attribute.KeyValue{attribute.String("service.name", "intel-gpu-exporter")}
+	for key, value := range cfg.Resource {
+		attributes = append(attributes, attribute.String(key, value))
+	}
+	res, err := resource.New(ctx, resource.WithFromEnv(), resource.WithTelemetrySDK(), resource.WithHost(), resource.WithAttributes(attributes...))
+	if err != nil {
+		return nil, fmt.Errorf("otlp: resource: %w", err)
+	}
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warn("failed to export metrics over OTLP", "err", err)
+	}))
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(cfg.Interval))),
+	)
+	if err = register(provider.Meter("github.com/rmarchant/intel-gpu-exporter"), source, cfg.Interval); err != nil {
+		_ = provider.Shutdown(ctx)
+		return nil, err
+	}
+	return &Exporter{provider: provider}, nil
+}
+
+// Shutdown sends the current statistics and stops the Exporter.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	return e.provider.Shutdown(ctx)
+}
+
+func newMetricExporter(ctx context.Context, cfg Config) (sdkmetric.Exporter, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("otlp: invalid endpoint %q: must be an http or https URL", cfg.Endpoint)
+	}
+	switch cfg.Protocol {
+	case ProtocolGRPC, "":
+		return otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpointURL(u.String()), otlpmetricgrpc.WithHeaders(cfg.Headers))
+	case ProtocolHTTP:
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+		}
+		return otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(u.String()), otlpmetrichttp.WithHeaders(cfg.Headers))
+	default:
+		return nil, fmt.Errorf("otlp: invalid protocol %q", cfg.Protocol)
+	}
+}
+
+// instruments are the metrics sent over OTLP.
+type instruments struct {
+	engineBusy       metric.Float64ObservableGauge
+	engineSema       metric.Float64ObservableGauge
+	engineWait       metric.Float64ObservableGauge
+	engineClassBusy  metric.Float64ObservableGauge
+	engineClassSema  metric.Float64ObservableGauge
+	engineClassWait  metric.Float64ObservableGauge
+	power            metric.Float64ObservableGauge
+	packagePower     metric.Float64ObservableGauge
+	frequency        metric.Float64ObservableGauge
+	requestFrequency metric.Float64ObservableGauge
+	clients          metric.Float64ObservableGauge
+	up               metric.Int64ObservableGauge
+}
+
+// register creates the instruments and reports the statistics of source, consolidated over window, on each collection.
+func register(meter metric.Meter, source collector.Source, window time.Duration) error {
+	var i instruments
+	var errs []error
+	gauge := func(name, description, unit string) metric.Float64ObservableGauge {
+		g, err := meter.Float64ObservableGauge(name, metric.WithDescription(description), metric.WithUnit(unit))
+		errs = append(errs, err)
+		return g
+	}
+	i.engineBusy = gauge("hw.gpu.utilization", "Ratio of time the GPU engine was busy", "1")
+	i.engineSema = gauge("gpumon.engine.sema", "Ratio of time the GPU engine waited on a semaphore", "1")
+	i.engineWait = gauge("gpumon.engine.wait", "Ratio of time the GPU engine waited on memory", "1")
+	i.engineClassBusy = gauge("gpumon.engine_class.utilization", "Average ratio of time the GPU engines of a class were busy", "1")
+	i.engineClassSema = gauge("gpumon.engine_class.sema", "Average ratio of time the GPU engines of a class waited on a semaphore", "1")
+	i.engineClassWait = gauge("gpumon.engine_class.wait", "Average ratio of time the GPU engines of a class waited on memory", "1")
+	i.power = gauge("hw.power", "Power consumption of the GPU", "W")
+	i.packagePower = gauge("gpumon.package.power", "Power consumption of the package", "W")
+	i.frequency = gauge("gpumon.frequency.actual", "Actual GPU frequency", "Hz")
+	i.requestFrequency = gauge("gpumon.frequency.requested", "Requested GPU frequency", "Hz")
+	i.clients = gauge("gpumon.clients", "Number of active clients", "{client}")
+	up, err := meter.Int64ObservableGauge("gpumon.source.up", metric.WithDescription("Whether intel_gpu_top is running and sending data"))
+	i.up = up
+	if err = errors.Join(append(errs, err)...); err != nil {
+		return fmt.Errorf("otlp: %w", err)
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		for _, device := range source.Devices(window, collector.AggregationMedian) {
+			i.observe(o, device)
+		}
+		return nil
+	}, i.engineBusy, i.engineSema, i.engineWait, i.engineClassBusy, i.engineClassSema, i.engineClassWait,
+		i.power, i.packagePower, i.frequency, i.requestFrequency, i.clients, i.up)
+	return err
+}
+
+// observe reports the statistics of one device. Its metrics are identified by the hw.id attribute.
+func (i instruments) observe(o metric.Observer, device collector.DeviceStats) {
+	gpu := []attribute.KeyValue{attribute.String("hw.id", device.Name), attribute.String("hw.type", "gpu")}
+	var up int64
+	if device.State == collector.SourceRunning || device.State == collector.SourceIdle {
+		up = 1
+	}
+	o.ObserveInt64(i.up, up, metric.WithAttributes(gpu...))
+	if device.Samples == 0 {
+		return
+	}
+	for name, usage := range device.Engines {
+		attributes := metric.WithAttributes(append(gpu, engineAttributes(name)...)...)
+		o.ObserveFloat64(i.engineBusy, usage.Busy, attributes)
+		o.ObserveFloat64(i.engineSema, usage.Sema, attributes)
+		o.ObserveFloat64(i.engineWait, usage.Wait, attributes)
+	}
+	for class, usage := range device.EngineClasses {
+		attributes := metric.WithAttributes(append(gpu, attribute.String("gpumon.engine.class", string(class)))...)
+		o.ObserveFloat64(i.engineClassBusy, usage.Busy, attributes)
+		o.ObserveFloat64(i.engineClassSema, usage.Sema, attributes)
+		o.ObserveFloat64(i.engineClassWait, usage.Wait, attributes)
+	}
+	attributes := metric.WithAttributes(gpu...)
+	o.ObserveFloat64(i.power, device.Power.GPU, attributes)
+	o.ObserveFloat64(i.packagePower, device.Power.Package, attributes)
+	o.ObserveFloat64(i.frequency, device.Frequency.Actual, attributes)
+	o.ObserveFloat64(i.requestFrequency, device.Frequency.Requested, attributes)
+	o.ObserveFloat64(i.clients, device.Clients.Count, attributes)
+}
+
+// engineAttributes returns the attributes of an engine: its name as reported by intel_gpu_top, its class and instance.
+func engineAttributes(name string) []attribute.KeyValue {
+	attributes := []attribute.KeyValue{attribute.String("gpumon.engine", name)}
+	if engine, err := igt.ParseEngine(name); err == nil {
+		attributes = append(attributes,
+			attribute.String("gpumon.engine.class", string(engine.Class)),
+			attribute.String("gpumon.engine.instance", strconv.Itoa(engine.Instance)),
+		)
+	}
+	return attributes
+}
+
+// ParseAttributes parses a comma-separated list of key=value pairs, as used by the OTEL_EXPORTER_OTLP_HEADERS and
+// OTEL_RESOURCE_ATTRIBUTES environment variables.
+func ParseAttributes(s string) (map[string]string, error) {
+	attributes := make(map[string]string)
+	for entry := range strings.SplitSeq(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		if key = strings.TrimSpace(key); !ok || key == "" {
+			return nil, fmt.Errorf("invalid attribute %q: expected key=value", entry)
+		}
+		attributes[key] = strings.TrimSpace(value)
+	}
+	return attributes, nil
+}
@@ -0,0 +1,204 @@
+package otlp
+
+import (
+	"context"
+	"github.com/rmarchant/intel-gpu-exporter/internal/collector"
+	igt "github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExporter(t *testing.T) {
+	tests := []struct {
+		protocol Protocol
+		start    func(t *testing.T, requests chan<- request) string
+	}{
+		{protocol: ProtocolGRPC, start: startGRPCReceiver},
+		{protocol: ProtocolHTTP, start: startHTTPReceiver},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.protocol), func(t *testing.T) {
+			requests := make(chan request, 10)
+			endpoint := tt.start(t, requests)
+
+			e, err := New(t.Context(), Config{
+				Endpoint: endpoint,
+				Protocol: tt.protocol,
+				Interval: 50 * time.Millisecond,
+				Headers:  map[string]string{"Authorization": "Bearer secret"},
+				Resource: map[string]string{"deployment.environment": "test"},
+			}, fakeSource{}, slog.New(slog.DiscardHandler))
+			require.NoError(t, err)
+			defer func() { assert.NoError(t, e.Shutdown(context.Background())) }()
+
+			var r request
+			select {
+			case r = <-requests:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no metrics received")
+			}
+			assert.Equal(t, "Bearer secret", r.authorization)
+			require.Len(t, r.body.ResourceMetrics, 1)
+			resource := attributes(r.body.ResourceMetrics[0].Resource.Attributes)
+			assert.Equal(t, "intel-gpu-exporter", resource["service.name"])
+			assert.Equal(t, "test", resource["deployment.environment"])
+
+			metrics := make(map[string]*metricpb.Metric)
+			for _, scope := range r.body.ResourceMetrics[0].ScopeMetrics {
+				for _, m := range scope.Metrics {
+					metrics[m.Name] = m
+				}
+			}
+			assert.Len(t, metrics, 12)
+
+			utilization := metrics["hw.gpu.utilization"]
+			require.NotNil(t, utilization)
+			assert.Equal(t, "1", utilization.Unit)
+			require.Len(t, utilization.GetGauge().DataPoints, 1)
+			point := utilization.GetGauge().DataPoints[0]
+			assert.Equal(t, 0.4, point.GetAsDouble())
+			assert.Equal(t, map[string]string{
+				"hw.id":                  "nuc1",
+				"hw.type":                "gpu",
+				"gpumon.engine":          "Video/1",
+				"gpumon.engine.class":    "video",
+				"gpumon.engine.instance": "1",
+			}, attributes(point.Attributes))
+
+			power := metrics["hw.power"]
+			require.NotNil(t, power)
+			assert.Equal(t, "W", power.Unit)
+			assert.Equal(t, 1.5, power.GetGauge().DataPoints[0].GetAsDouble())
+			assert.Equal(t, int64(1), metrics["gpumon.source.up"].GetGauge().DataPoints[0].GetAsInt())
+		})
+	}
+}
+
+func TestNew_invalid(t *testing.T) {
+	for _, endpoint := range []string{"", "localhost:4317", "ftp://localhost"} {
+		_, err := New(t.Context(), Config{Endpoint: endpoint, Interval: time.Second}, fakeSource{}, slog.New(slog.DiscardHandler))
+		assert.ErrorContains(t, err, "invalid endpoint", endpoint)
+	}
+	for _, interval := range []time.Duration{0, -time.Second, time.Hour} {
+		_, err := New(t.Context(), Config{Endpoint: "http://localhost:4317", Interval: interval}, fakeSource{}, slog.New(slog.DiscardHandler))
+		assert.ErrorContains(t, err, "invalid interval", interval)
+	}
+}
+
+func TestParseProtocol(t *testing.T) {
+	protocol, err := ParseProtocol("http/protobuf")
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolHTTP, protocol)
+
+	_, err = ParseProtocol("http/json")
+	assert.EqualError(t, err, `invalid protocol "http/json": must be grpc or http/protobuf`)
+}
+
+func TestParseAttributes(t *testing.T) {
+	attributes, err := ParseAttributes("deployment.environment=prod, host.name = pve1,empty=")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"deployment.environment": "prod", "host.name": "pve1", "empty": ""}, attributes)
+
+	attributes, err = ParseAttributes("")
+	assert.NoError(t, err)
+	assert.Empty(t, attributes)
+
+	_, err = ParseAttributes("foo")
+	assert.EqualError(t, err, `invalid attribute "foo": expected key=value`)
+}
+
+type fakeSource struct{}
+
+func (fakeSource) Devices(time.Duration, collector.Aggregation) []collector.DeviceStats {
+	return []collector.DeviceStats{{
+		Name:          "nuc1",
+		State:         collector.SourceRunning,
+		Samples:       10,
+		Engines:       map[string]collector.EngineUsage{"Video/1": {Busy: 0.4}},
+		EngineClasses: map[igt.EngineClass]collector.EngineUsage{igt.EngineClassVideo: {Busy: 0.4}},
+		Power:         collector.PowerUsage{GPU: 1.5, Package: 6},
+		Frequency:     collector.Frequency{Requested: 6e8, Actual: 5.5e8},
+		Clients:       collector.ClientUsage{Count: 1},
+	}}
+}
+
+// request is an export received by a test receiver.
+type request struct {
+	authorization string
+	body          *colmetricpb.ExportMetricsServiceRequest
+}
+
+func attributes(kvs []*commonpb.KeyValue) map[string]string {
+	m := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value.GetStringValue()
+	}
+	return m
+}
+
+type grpcReceiver struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+	requests chan<- request
+}
+
+func (r grpcReceiver) Export(ctx context.Context, body *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		authorization = md.Get("authorization")[0]
+	}
+	select {
+	case r.requests <- request{authorization: authorization, body: body}:
+	default:
+	}
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+func startGRPCReceiver(t *testing.T, requests chan<- request) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	colmetricpb.RegisterMetricsServiceServer(server, grpcReceiver{requests: requests})
+	go func() { _ = server.Serve(l) }()
+	t.Cleanup(server.Stop)
+	return "http://" + l.Addr().String()
+}
+
+func startHTTPReceiver(t *testing.T, requests chan<- request) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/metrics" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		content, err := io.ReadAll(req.Body)
+		var body colmetricpb.ExportMetricsServiceRequest
+		if err == nil {
+			err = proto.Unmarshal(content, &body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case requests <- request{authorization: req.Header.Get("Authorization"), body: &body}:
+		default:
+		}
+		response, _ := proto.Marshal(&colmetricpb.ExportMetricsServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
@@ -0,0 +1,296 @@
+'use strict';
+
+// The UI shows the samples received from /api/v1/stream. Devices are first loaded from /api/v1/stats, so idle devices
+// are shown before their first sample arrives. If the exporter keeps a history (-history-dir), /api/v1/history is
+// charted below each device. Paths are relative, so the UI also works behind a reverse proxy.
+
+const fields = 'engines,power,frequency,clients';
+const devices = new Map();
+let dropped = 0;
+// historyEnabled is false once the exporter reported that it doesn't keep a history.
+let historyEnabled = true;
+// chartPoints is the number of points requested for a chart.
+const chartPoints = 300;
+const historyRefresh = 30 * 1000;
+
+// ratio converts a value reported in unit to a ratio (0-1).
+function ratio(value, unit) {
+  return unit === '%' ? value / 100 : value;
+}
+
+// engineClasses maps the engine class names reported by intel_gpu_top to the canonical classes used by /api/v1/stats.
+const engineClasses = {
+  'render/3d': 'render', render: 'render', rcs: 'render',
+  blitter: 'copy', copy: 'copy', bcs: 'copy',
+  video: 'video', vcs: 'video',
+  videoenhance: 'video_enhance', vecs: 'video_enhance',
+  compute: 'compute', ccs: 'compute',
+};
+
+// engineClass returns the canonical class of an engine class name, or undefined if it's unknown.
+function engineClass(name) {
+  return engineClasses[name.toLowerCase().replace(/\/?\d+$/, '')];
+}
+
+function formatPercent(value) {
+  return (value * 100).toFixed(1) + '%';
+}
+
+function formatWatts(value) {
+  return value.toFixed(2) + ' W';
+}
+
+function formatHertz(value) {
+  return (value / 1e6).toFixed(0) + ' MHz';
+}
+
+function device(name) {
+  let d = devices.get(name);
+  if (d) {
+    return d;
+  }
+  const template = document.getElementById('device-template');
+  const section = template.content.firstElementChild.cloneNode(true);
+  section.querySelector('.name').textContent = name;
+  document.getElementById('empty').hidden = true;
+
+  const container = document.getElementById('devices');
+  const next = [...devices.keys()].sort().find((other) => other > name);
+  container.insertBefore(section, next ? devices.get(next).section : null);
+
+  d = {section, engines: new Map()};
+  devices.set(name, d);
+  for (const select of section.querySelectorAll('.history select')) {
+    select.addEventListener('change', () => loadHistory(name));
+  }
+  loadHistory(name);
+  return d;
+}
+
+function text(d, selector, value) {
+  d.section.querySelector(selector).textContent = value;
+}
+
+function renderEngines(d, engines) {
+  const container = d.section.querySelector('.engines');
+  for (const name of Object.keys(engines).sort()) {
+    let row = d.engines.get(name);
+    if (!row) {
+      row = document.createElement('div');
+      row.className = 'engine';
+      row.innerHTML = '<span class="engine-name"></span><div class="track"><div class="bar"></div></div><span class="percent"></span>';
+      row.querySelector('.engine-name').textContent = name;
+      container.appendChild(row);
+      d.engines.set(name, row);
+    }
+    const busy = Math.min(Math.max(engines[name], 0), 1);
+    row.querySelector('.bar').style.width = formatPercent(busy);
+    row.querySelector('.percent').textContent = formatPercent(busy);
+  }
+}
+
+function renderClients(d, clients) {
+  const body = d.section.querySelector('.clients tbody');
+  const rows = clients.map((client) => {
+    const row = document.createElement('tr');
+    const usage = Object.keys(client.busy).sort()
+      .filter((engine) => client.busy[engine] > 0)
+      .map((engine) => engine + ' ' + formatPercent(client.busy[engine]))
+      .join(', ');
+    for (const [value, className] of [[client.pid, ''], [client.name, ''], [usage || 'idle', 'classes']]) {
+      const cell = document.createElement('td');
+      cell.textContent = value;
+      cell.className = className;
+      row.appendChild(cell);
+    }
+    return row;
+  });
+  if (rows.length === 0) {
+    const row = document.createElement('tr');
+    row.innerHTML = '<td colspan="3" class="classes">No clients</td>';
+    rows.push(row);
+  }
+  body.replaceChildren(...rows);
+}
+
+// render shows the statistics of a device. All values are in base units: ratios, watts and Hz.
+function render(name, stats, time) {
+  const d = device(name);
+  if (time) {
+    text(d, '.updated', new Date(time).toLocaleTimeString());
+  }
+  renderEngines(d, stats.engines);
+  text(d, '.power-gpu', formatWatts(stats.power.gpu));
+  text(d, '.power-package', formatWatts(stats.power.package));
+  text(d, '.frequency-actual', formatHertz(stats.frequency.actual));
+  text(d, '.frequency-requested', formatHertz(stats.frequency.requested));
+  renderClients(d, stats.clients);
+}
+
+// fromStats converts a device reported by /api/v1/stats.
+function fromStats(device) {
+  const engines = {};
+  for (const [name, usage] of Object.entries(device.engines)) {
+    engines[name] = usage.busy;
+  }
+  return {
+    engines,
+    power: {gpu: device.power.gpu_watts, package: device.power.package_watts},
+    frequency: {requested: device.frequency.requested_hz, actual: device.frequency.actual_hz},
+    clients: device.clients.active,
+  };
+}
+
+// fromSample converts a sample received from /api/v1/stream.
+function fromSample(sample) {
+  const engines = {};
+  for (const [name, usage] of Object.entries(sample.engines || {})) {
+    engines[name] = ratio(usage.busy, usage.unit);
+  }
+  const clients = Object.values(sample.clients || {}).map((client) => {
+    const busy = {};
+    for (const [name, usage] of Object.entries(client['engine-classes'] || {})) {
+      const engine = engineClass(name);
+      if (engine) {
+        busy[engine] = (busy[engine] || 0) + ratio(parseFloat(usage.busy), usage.unit);
+      }
+    }
+    return {pid: client.pid, name: client.name, busy};
+  });
+  clients.sort((a, b) => a.name.localeCompare(b.name) || a.pid.localeCompare(b.pid));
+  const power = sample.power || {};
+  const frequency = sample.frequency || {};
+  return {
+    engines,
+    power: {gpu: power.GPU || 0, package: power.Package || 0},
+    frequency: {requested: frequency.requested || 0, actual: frequency.actual || 0},
+    clients,
+  };
+}
+
+// formatMetric formats a value of a history metric.
+function formatMetric(metric, value) {
+  if (metric.startsWith('engine_busy_') || metric.endsWith('_ratio')) {
+    return formatPercent(value);
+  }
+  if (metric.endsWith('_watts')) {
+    return formatWatts(value);
+  }
+  if (metric.endsWith('_hz')) {
+    return formatHertz(value);
+  }
+  return value.toFixed(0);
+}
+
+async function loadHistory(name) {
+  const d = devices.get(name);
+  if (!historyEnabled || !d) {
+    return;
+  }
+  const history = d.section.querySelector('.history');
+  const metric = history.querySelector('.history-metric').value;
+  const range = Number(history.querySelector('.history-range').value);
+  const to = Date.now() / 1000;
+  const step = Math.max(1, Math.ceil(range / chartPoints));
+  const query = new URLSearchParams({metric, device: name, from: String(to - range), to: String(to), step: step + 's'});
+  try {
+    const response = await fetch('api/v1/history?' + query);
+    if (!(response.headers.get('Content-Type') || '').startsWith('application/json')) {
+      // the exporter doesn't keep a history
+      historyEnabled = false;
+      return;
+    }
+    const body = await response.json();
+    history.hidden = false;
+    const points = response.ok && body.series.length > 0 ? body.series[0].points : [];
+    drawChart(history.querySelector('.chart'), metric, points, (to - range) * 1000, to * 1000);
+  } catch (e) {
+    console.warn('loading history failed', e);
+  }
+}
+
+// drawChart draws the mean of each point as a line, over a band from its minimum to its maximum.
+function drawChart(canvas, metric, points, from, to) {
+  const style = getComputedStyle(document.documentElement);
+  const ratio = window.devicePixelRatio || 1;
+  const width = canvas.clientWidth;
+  const height = canvas.clientHeight;
+  canvas.width = width * ratio;
+  canvas.height = height * ratio;
+  const ctx = canvas.getContext('2d');
+  ctx.scale(ratio, ratio);
+  ctx.font = '11px system-ui, sans-serif';
+  ctx.fillStyle = style.getPropertyValue('--muted');
+
+  if (points.length === 0) {
+    ctx.textAlign = 'center';
+    ctx.fillText('No data', width / 2, height / 2);
+    return;
+  }
+  const isRatio = metric.startsWith('engine_busy_') || metric.endsWith('_ratio');
+  const top = isRatio ? 1 : Math.max(...points.map((p) => p.max)) || 1;
+  const x = (time) => (new Date(time).getTime() - from) / (to - from) * width;
+  const y = (value) => height - 14 - value / top * (height - 24);
+
+  ctx.fillText(formatMetric(metric, top), 2, 10);
+  ctx.fillText(new Date(from).toLocaleString(), 2, height - 2);
+  ctx.textAlign = 'right';
+  ctx.fillText(new Date(to).toLocaleString(), width - 2, height - 2);
+
+  const bar = style.getPropertyValue('--bar');
+  ctx.globalAlpha = 0.25;
+  ctx.fillStyle = bar;
+  ctx.beginPath();
+  points.forEach((p, i) => (i === 0 ? ctx.moveTo : ctx.lineTo).call(ctx, x(p.time), y(p.max)));
+  [...points].reverse().forEach((p) => ctx.lineTo(x(p.time), y(p.min)));
+  ctx.closePath();
+  ctx.fill();
+
+  ctx.globalAlpha = 1;
+  ctx.strokeStyle = bar;
+  ctx.lineWidth = 1.5;
+  ctx.beginPath();
+  points.forEach((p, i) => (i === 0 ? ctx.moveTo : ctx.lineTo).call(ctx, x(p.time), y(p.mean)));
+  ctx.stroke();
+}
+
+function setStatus(connected) {
+  const status = document.getElementById('status');
+  status.textContent = connected ? 'live' : 'disconnected';
+  status.classList.toggle('connected', connected);
+}
+
+async function load() {
+  try {
+    const response = await fetch('api/v1/stats?aggregation=last');
+    if (!response.ok) {
+      return;
+    }
+    const body = await response.json();
+    for (const d of body.devices) {
+      render(d.name, fromStats(d), d.last_update);
+    }
+  } catch (e) {
+    console.warn('loading stats failed', e);
+  }
+}
+
+function connect() {
+  const source = new EventSource('api/v1/stream?fields=' + fields);
+  source.onopen = () => setStatus(true);
+  // EventSource reconnects automatically
+  source.onerror = () => setStatus(false);
+  source.addEventListener('sample', (event) => {
+    const sample = JSON.parse(event.data);
+    render(sample.device, fromSample(sample.stats), sample.time);
+  });
+  source.addEventListener('dropped', (event) => {
+    dropped += JSON.parse(event.data).dropped;
+    const element = document.getElementById('dropped');
+    element.textContent = dropped + ' samples dropped';
+    element.hidden = false;
+  });
+}
+
+load().then(connect);
+setInterval(() => devices.forEach((_, name) => loadHistory(name)), historyRefresh);
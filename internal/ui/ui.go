@@ -0,0 +1,18 @@
+// Package ui embeds a web page showing live GPU statistics, so the exporter can be monitored from a browser without
+// setting up Grafana. The page has no external dependencies: it only uses the exporter's stats and stream APIs.
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the UI: index.html at "/" and its assets (app.js, style.css) next to it.
+func Handler() http.Handler {
+	files, _ := fs.Sub(static, "static")
+	return http.FileServerFS(files)
+}
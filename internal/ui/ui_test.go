@@ -0,0 +1,43 @@
+package ui
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	h := Handler()
+	tests := []struct {
+		path            string
+		wantCode        int
+		wantContentType string
+		wantBody        string
+	}{
+		{path: "/", wantCode: http.StatusOK, wantContentType: "text/html; charset=utf-8", wantBody: `<script src="app.js">`},
+		{path: "/app.js", wantCode: http.StatusOK, wantContentType: "text/javascript; charset=utf-8", wantBody: "api/v1/stream"},
+		{path: "/style.css", wantCode: http.StatusOK, wantContentType: "text/css; charset=utf-8", wantBody: ".engine"},
+		{path: "/missing.js", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, tt.wantContentType, w.Header().Get("Content-Type"))
+				assert.Contains(t, w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandler_offline(t *testing.T) {
+	// the UI must work without internet access, so it can't load anything from a CDN
+	for _, path := range []string{"/", "/app.js", "/style.css"} {
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.NotRegexp(t, `(?i)(https?:)?//[a-z0-9.-]+\.[a-z]{2,}/`, w.Body.String(), path)
+	}
+}
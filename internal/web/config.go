@@ -0,0 +1,275 @@
+package web
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Config is the web configuration file. It uses the format of the Prometheus exporter-toolkit:
+//
+//	tls_server_config:
+//	  cert_file: server.crt
+//	  key_file: server.key
+//	  client_auth_type: RequireAndVerifyClientCert
+//	  client_ca_file: ca.crt
+//	  client_allowed_sans: [prometheus.example.com]
+//	  min_version: TLS12
+//	  cipher_suites: [TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384]
+//	  curve_preferences: [X25519]
+//	http_server_config:
+//	  http2: true
+//	  headers:
+//	    Strict-Transport-Security: max-age=31536000
+//	basic_auth_users:
+//	  prometheus: $2y$10$...
+//
+// Relative paths are relative to the directory of the configuration file.
+type Config struct {
+	TLS   *TLSConfig        `yaml:"tls_server_config"`
+	HTTP  HTTPConfig        `yaml:"http_server_config"`
+	Users map[string]string `yaml:"basic_auth_users"`
+}
+
+// TLSConfig configures TLS. If no certificate is configured, TLS is disabled.
+type TLSConfig struct {
+	// CertFile and KeyFile are the server's certificate and private key.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientAuth is the policy for client certificates, e.g. RequireAndVerifyClientCert. Defaults to NoClientCert.
+	ClientAuth string `yaml:"client_auth_type"`
+	// ClientCAFile contains the CA certificates used to verify client certificates. Requires ClientAuth.
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAllowedSANs restricts the accepted client certificates to those with one of these subject alternative
+	// names (DNS name, IP address, email address or URI). Requires ClientCAFile.
+	ClientAllowedSANs []string `yaml:"client_allowed_sans"`
+	// MinVersion and MaxVersion limit the TLS versions (TLS10, TLS11, TLS12 or TLS13). MinVersion defaults to TLS12.
+	MinVersion string `yaml:"min_version"`
+	MaxVersion string `yaml:"max_version"`
+	// CipherSuites are the cipher suites allowed up to TLS 1.2, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+	// Defaults to Go's default cipher suites.
+	CipherSuites []string `yaml:"cipher_suites"`
+	// CurvePreferences are the elliptic curves used in key exchanges (CurveP256, CurveP384, CurveP521 or X25519), in order
+	// of preference.
+	CurvePreferences []string `yaml:"curve_preferences"`
+	// PreferServerCipherSuites is accepted for compatibility, but ignored: Go selects the cipher suite itself.
+	PreferServerCipherSuites *bool `yaml:"prefer_server_cipher_suites"`
+}
+
+// HTTPConfig configures the HTTP server.
+type HTTPConfig struct {
+	// HTTP2 enables HTTP/2 (only used with TLS). Defaults to true.
+	HTTP2 *bool `yaml:"http2"`
+	// Headers are added to all responses. Only the security headers in allowedHeaders can be set.
+	Headers map[string]string `yaml:"headers"`
+}
+
+// allowedHeaders are the response headers that can be configured, as in the exporter-toolkit.
+var allowedHeaders = []string{
+	"Strict-Transport-Security",
+	"X-Content-Type-Options",
+	"X-Frame-Options",
+	"X-XSS-Protection",
+	"Content-Security-Policy",
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var curves = map[string]tls.CurveID{
+	"CurveP256": tls.CurveP256,
+	"CurveP384": tls.CurveP384,
+	"CurveP521": tls.CurveP521,
+	"X25519":    tls.X25519,
+}
+
+// cipherSuites returns the IDs of the cipher suites by name, including the insecure ones.
+var cipherSuites = sync.OnceValue(func() map[string]uint16 {
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	return suites
+})
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// LoadConfig reads and validates the web configuration file. Unknown fields are rejected.
+func LoadConfig(path string) (Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("web config: %w", err)
+	}
+	var cfg Config
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, fmt.Errorf("web config %s: %w", path, err)
+	}
+	if cfg.TLS != nil {
+		dir := filepath.Dir(path)
+		cfg.TLS.CertFile = resolvePath(dir, cfg.TLS.CertFile)
+		cfg.TLS.KeyFile = resolvePath(dir, cfg.TLS.KeyFile)
+		cfg.TLS.ClientCAFile = resolvePath(dir, cfg.TLS.ClientCAFile)
+	}
+	if err = cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("web config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Validate checks that the configuration is valid. It doesn't load any files.
+func (c Config) Validate() error {
+	var errs []error
+	if c.TLS != nil {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			errs = append(errs, errors.New("tls_server_config: cert_file and key_file are required"))
+		}
+		if _, ok := clientAuthTypes[c.TLS.ClientAuth]; c.TLS.ClientAuth != "" && !ok {
+			errs = append(errs, fmt.Errorf("tls_server_config: invalid client_auth_type %q", c.TLS.ClientAuth))
+		}
+		if c.TLS.ClientAuth == "RequireAndVerifyClientCert" || c.TLS.ClientAuth == "VerifyClientCertIfGiven" {
+			if c.TLS.ClientCAFile == "" {
+				errs = append(errs, fmt.Errorf("tls_server_config: client_auth_type %s requires client_ca_file", c.TLS.ClientAuth))
+			}
+		}
+		if c.TLS.ClientCAFile != "" && c.TLS.ClientAuth == "" {
+			errs = append(errs, errors.New("tls_server_config: client_ca_file requires client_auth_type"))
+		}
+		if len(c.TLS.ClientAllowedSANs) > 0 && c.TLS.ClientCAFile == "" {
+			errs = append(errs, errors.New("tls_server_config: client_allowed_sans requires client_ca_file"))
+		}
+		for _, version := range []string{c.TLS.MinVersion, c.TLS.MaxVersion} {
+			if _, ok := tlsVersions[version]; version != "" && !ok {
+				errs = append(errs, fmt.Errorf("tls_server_config: invalid TLS version %q", version))
+			}
+		}
+		for _, suite := range c.TLS.CipherSuites {
+			if _, ok := cipherSuites()[suite]; !ok {
+				errs = append(errs, fmt.Errorf("tls_server_config: invalid cipher suite %q", suite))
+			}
+		}
+		for _, curve := range c.TLS.CurvePreferences {
+			if _, ok := curves[curve]; !ok {
+				errs = append(errs, fmt.Errorf("tls_server_config: invalid curve %q", curve))
+			}
+		}
+	}
+	for header := range c.HTTP.Headers {
+		if !slices.Contains(allowedHeaders, http.CanonicalHeaderKey(header)) {
+			errs = append(errs, fmt.Errorf("http_server_config: header %q can't be configured", header))
+		}
+	}
+	for user, hash := range c.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			errs = append(errs, fmt.Errorf("basic_auth_users: %s: %w", user, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// http2 returns true if HTTP/2 is enabled.
+func (c Config) http2() bool {
+	return c.HTTP.HTTP2 == nil || *c.HTTP.HTTP2
+}
+
+// files returns the files the configuration uses.
+func (c Config) files() []string {
+	if c.TLS == nil {
+		return nil
+	}
+	return []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ClientCAFile}
+}
+
+// tlsConfig loads the certificates and returns the TLS configuration. Returns nil if TLS is disabled.
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if c.TLS == nil {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	cfg := tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tlsVersions[c.TLS.MaxVersion],
+		ClientAuth:   clientAuthTypes[c.TLS.ClientAuth],
+		NextProtos:   []string{"http/1.1"},
+	}
+	if c.TLS.MinVersion != "" {
+		cfg.MinVersion = tlsVersions[c.TLS.MinVersion]
+	}
+	if c.http2() {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if c.TLS.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.TLS.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: %s: no certificates found", c.TLS.ClientCAFile)
+		}
+	}
+	for _, suite := range c.TLS.CipherSuites {
+		cfg.CipherSuites = append(cfg.CipherSuites, cipherSuites()[suite])
+	}
+	for _, curve := range c.TLS.CurvePreferences {
+		cfg.CurvePreferences = append(cfg.CurvePreferences, curves[curve])
+	}
+	if len(c.TLS.ClientAllowedSANs) > 0 {
+		cfg.VerifyPeerCertificate = c.verifyClientSAN
+	}
+	return &cfg, nil
+}
+
+// verifyClientSAN checks that the verified client certificate has one of the allowed subject alternative names.
+func (c Config) verifyClientSAN(_ [][]byte, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		// no client certificate: client_auth_type decides whether that's allowed
+		return nil
+	}
+	cert := chains[0][0]
+	sans := slices.Concat(cert.DNSNames, cert.EmailAddresses)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if slices.Contains(c.TLS.ClientAllowedSANs, san) {
+			return nil
+		}
+	}
+	return errors.New("client certificate: subject alternative name not allowed")
+}
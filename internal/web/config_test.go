@@ -0,0 +1,80 @@
+package web
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{name: "empty", content: "", wantErr: assert.NoError},
+		{
+			name: "valid",
+			content: `
+tls_server_config:
+  cert_file: server.crt
+  key_file: /etc/gpumon/server.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.crt
+  client_allowed_sans: [prometheus.example.com]
+  min_version: TLS13
+  cipher_suites: [TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_RSA_WITH_AES_128_CBC_SHA]
+  curve_preferences: [X25519, CurveP256]
+  prefer_server_cipher_suites: true
+http_server_config:
+  http2: false
+  headers:
+    Strict-Transport-Security: max-age=31536000
+basic_auth_users:
+  prometheus: ` + string(hash),
+			wantErr: assert.NoError,
+		},
+		{name: "unknown field", content: "tls_server_config:\n  cert: server.crt\n", wantErr: assert.Error},
+		{name: "missing key", content: "tls_server_config:\n  cert_file: server.crt\n", wantErr: assert.Error},
+		{name: "invalid client auth", content: "tls_server_config:\n  cert_file: a\n  key_file: b\n  client_auth_type: Always\n", wantErr: assert.Error},
+		{name: "missing client ca", content: "tls_server_config:\n  cert_file: a\n  key_file: b\n  client_auth_type: RequireAndVerifyClientCert\n", wantErr: assert.Error},
+		{name: "client ca without client auth", content: "tls_server_config:\n  cert_file: a\n  key_file: b\n  client_ca_file: ca.crt\n", wantErr: assert.Error},
+		{name: "allowed sans without client ca", content: "tls_server_config:\n  cert_file: a\n  key_file: b\n  client_allowed_sans: [a]\n", wantErr: assert.Error},
+		{name: "invalid cipher suite", content: "tls_server_config:\n  cert_file: a\n  key_file: b\n  cipher_suites: [TLS_NULL]\n", wantErr: assert.Error},
+		{name: "invalid curve", content: "tls_server_config:\n  cert_file: a\n  key_file: b\n  curve_preferences: [P-256]\n", wantErr: assert.Error},
+		{name: "header not allowed", content: "http_server_config:\n  headers:\n    Server: gpumon\n", wantErr: assert.Error},
+		{name: "invalid version", content: "tls_server_config:\n  cert_file: a\n  key_file: b\n  min_version: SSL3\n", wantErr: assert.Error},
+		{name: "invalid hash", content: "basic_auth_users:\n  prometheus: secret\n", wantErr: assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "web.yml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+			_, err := LoadConfig(path)
+			tt.wantErr(t, err)
+		})
+	}
+}
+
+func TestLoadConfig_Paths(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "web.yml")
+	require.NoError(t, os.WriteFile(path, []byte("tls_server_config:\n  cert_file: server.crt\n  key_file: /etc/gpumon/server.key\n"), 0o600))
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "server.crt"), cfg.TLS.CertFile)
+	assert.Equal(t, "/etc/gpumon/server.key", cfg.TLS.KeyFile)
+	assert.True(t, cfg.http2())
+}
+
+func TestLoadConfig_Missing(t *testing.T) {
+	_, err := LoadConfig(filepath.Join(t.TempDir(), "web.yml"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,29 @@
+package web
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	h := DebugHandler()
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/goroutine", "/debug/vars"} {
+		t.Run(path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDebugAddr(t *testing.T) {
+	assert.Equal(t, "localhost:6060", DebugAddr(":6060"))
+	assert.Equal(t, "0.0.0.0:6060", DebugAddr("0.0.0.0:6060"))
+	assert.Equal(t, "[::1]:6060", DebugAddr("[::1]:6060"))
+}
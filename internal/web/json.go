@@ -0,0 +1,23 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// APIVersion is the version of the API's response format.
+const APIVersion = "v1"
+
+// WriteJSON writes body as a JSON response with the status code.
+func WriteJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// WriteError writes err as a JSON error response with the status code: {"error":"..."}.
+func WriteError(w http.ResponseWriter, code int, err error) {
+	WriteJSON(w, code, struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+}
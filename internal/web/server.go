@@ -0,0 +1,237 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server is an HTTP server configured by a web configuration file. Watch reloads the configuration when the file,
+// or any certificate it refers to, changes. Enabling or disabling TLS, or changing the HTTP/2 setting, requires a restart.
+type Server struct {
+	*http.Server
+	path   string
+	logger *slog.Logger
+	useTLS bool
+	state  atomic.Pointer[state]
+	// cache holds the successful basic auth checks, as bcrypt is slow by design
+	cache sync.Map
+}
+
+// state is a loaded configuration.
+type state struct {
+	config Config
+	tls    *tls.Config
+	stamps map[string]stamp
+}
+
+// stamp identifies the version of a file.
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewServer returns a Server listening on addr and serving handler, configured by the web configuration file at path.
+// If path is empty, the server uses plain HTTP without authentication.
+func NewServer(addr string, handler http.Handler, path string, logger *slog.Logger) (*Server, error) {
+	s := Server{path: path, logger: logger.With("subsystem", "web")}
+	st := state{}
+	if path != "" {
+		loaded, err := s.load()
+		if err != nil {
+			return nil, err
+		}
+		st = *loaded
+	}
+	s.state.Store(&st)
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(st.config.http2())
+	s.Server = &http.Server{
+		Addr:              addr,
+		Handler:           s.addHeaders(s.authenticate(handler)),
+		Protocols:         &protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+		// e.g. TLS handshake errors from clients without a valid certificate
+		ErrorLog: slog.NewLogLogger(s.logger.Handler(), slog.LevelDebug),
+	}
+	if st.tls != nil {
+		s.useTLS = true
+		s.TLSConfig = &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return s.state.Load().tls, nil
+			},
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &s.state.Load().tls.Certificates[0], nil
+			},
+		}
+	}
+	return &s, nil
+}
+
+// ListenAndServe listens on the server's address and serves HTTP, or HTTPS if TLS is configured.
+func (s *Server) ListenAndServe() error {
+	if s.useTLS {
+		return s.Server.ListenAndServeTLS("", "")
+	}
+	return s.Server.ListenAndServe()
+}
+
+// Serve serves HTTP, or HTTPS if TLS is configured, on the listener.
+func (s *Server) Serve(l net.Listener) error {
+	if s.useTLS {
+		return s.Server.ServeTLS(l, "", "")
+	}
+	return s.Server.Serve(l)
+}
+
+// Watch checks the configuration file and its certificates every interval, and reloads the configuration when they change.
+// If the new configuration is invalid, the server keeps using the current one. Watch returns when ctx is done.
+func (s *Server) Watch(ctx context.Context, interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+	seen := s.state.Load().stamps
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := stamps(seen)
+			if maps.Equal(current, seen) {
+				continue
+			}
+			seen = current
+			if err := s.reload(); err != nil {
+				s.logger.Warn("failed to reload web config. keeping current config", "err", err)
+				continue
+			}
+			seen = s.state.Load().stamps
+			s.logger.Info("web config reloaded")
+		}
+	}
+}
+
+// reload loads the configuration and makes it the current one.
+func (s *Server) reload() error {
+	loaded, err := s.load()
+	if err != nil {
+		return err
+	}
+	current := s.state.Load()
+	if (loaded.tls == nil) != (current.tls == nil) {
+		return errors.New("enabling or disabling TLS requires a restart")
+	}
+	if loaded.config.http2() != current.config.http2() {
+		s.logger.Warn("changing http2 requires a restart. ignoring")
+		loaded.config.HTTP.HTTP2 = current.config.HTTP.HTTP2
+		if loaded.tls != nil {
+			loaded.tls.NextProtos = current.tls.NextProtos
+		}
+	}
+	s.state.Store(loaded)
+	s.cache.Clear()
+	return nil
+}
+
+// load reads the configuration file and the certificates it refers to.
+func (s *Server) load() (*state, error) {
+	cfg, err := LoadConfig(s.path)
+	if err != nil {
+		return nil, err
+	}
+	// take the stamps before loading the certificates: if they change while loading, the next check reloads them
+	files := make(map[string]stamp)
+	for _, file := range append(cfg.files(), s.path) {
+		if file != "" {
+			files[file] = stamp{}
+		}
+	}
+	files = stamps(files)
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &state{config: cfg, tls: tlsConfig, stamps: files}, nil
+}
+
+// stamps returns the current stamps of the files in previous. Missing files get a zero stamp.
+func stamps(previous map[string]stamp) map[string]stamp {
+	current := make(map[string]stamp, len(previous))
+	for file := range previous {
+		var st stamp
+		if info, err := os.Stat(file); err == nil {
+			st = stamp{modTime: info.ModTime(), size: info.Size()}
+		}
+		current[file] = st
+	}
+	return current
+}
+
+// addHeaders adds the configured headers to all responses.
+func (s *Server) addHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for header, value := range s.state.Load().config.HTTP.Headers {
+			w.Header().Set(header, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// publicPaths don't require basic auth: liveness probes, e.g. Kubernetes', usually can't authenticate. /readyz isn't
+// public, as its errors reveal the command's output and the SSH targets.
+var publicPaths = []string{"/healthz"}
+
+// authenticate requires basic auth if users are configured, except for the publicPaths.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		users := s.state.Load().config.Users
+		if len(users) == 0 || slices.Contains(publicPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if user, password, ok := r.BasicAuth(); ok && s.checkPassword(users, user, password) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="intel-gpu-exporter", charset="UTF-8"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// dummyHash is compared against for unknown users, so they take as long to reject as wrong passwords.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	return hash
+})
+
+func (s *Server) checkPassword(users map[string]string, user, password string) bool {
+	hash, known := users[user]
+	if !known {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+	if _, ok := s.cache.Load(key); ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	s.cache.Store(key, struct{}{})
+	return true
+}
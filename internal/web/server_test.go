@@ -0,0 +1,320 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_Plain(t *testing.T) {
+	url, _ := startServer(t, "")
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_TLS(t *testing.T) {
+	tests := []struct {
+		name      string
+		http2     string
+		wantProto int
+	}{
+		{name: "default", wantProto: 2},
+		{name: "http2 disabled", http2: "http_server_config:\n  http2: false\n", wantProto: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ca := newCA(t)
+			ca.issue(t, dir, "server")
+			path := writeConfig(t, dir, "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n"+tt.http2)
+			url, _ := startServer(t, path)
+
+			client := ca.client(nil)
+			resp, err := client.Get(url)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tt.wantProto, resp.ProtoMajor)
+		})
+	}
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t)
+	ca.issue(t, dir, "server")
+	ca.writeCert(t, dir, "ca")
+	path := writeConfig(t, dir, "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_ca_file: ca.crt\n  client_auth_type: RequireAndVerifyClientCert\n")
+	url, _ := startServer(t, path)
+
+	// no client certificate
+	_, err := ca.client(nil).Get(url)
+	assert.Error(t, err)
+
+	// certificate signed by another CA
+	other := newCA(t)
+	_, err = ca.client(other.issue(t, t.TempDir(), "client")).Get(url)
+	assert.Error(t, err)
+
+	// valid client certificate
+	resp, err := ca.client(ca.issue(t, t.TempDir(), "client")).Get(url)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_ClientAllowedSANs(t *testing.T) {
+	tests := []struct {
+		name    string
+		san     string
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{name: "allowed", san: "127.0.0.1", wantErr: assert.NoError},
+		{name: "not allowed", san: "client.example.com", wantErr: assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ca := newCA(t)
+			ca.issue(t, dir, "server")
+			ca.writeCert(t, dir, "ca")
+			path := writeConfig(t, dir, "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_ca_file: ca.crt\n"+
+				"  client_auth_type: RequireAndVerifyClientCert\n  client_allowed_sans: ["+tt.san+"]\n")
+			url, _ := startServer(t, path)
+
+			// the client certificates are issued for 127.0.0.1
+			resp, err := ca.client(ca.issue(t, t.TempDir(), "client")).Get(url)
+			if tt.wantErr(t, err) && err == nil {
+				_ = resp.Body.Close()
+			}
+		})
+	}
+}
+
+func TestServer_Headers(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, "http_server_config:\n  headers:\n    X-Frame-Options: deny\n")
+	url, _ := startServer(t, path)
+
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, "deny", resp.Header.Get("X-Frame-Options"))
+}
+
+func TestServer_BasicAuth(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, "basic_auth_users:\n  prometheus: "+hashPassword(t, "secret")+"\n")
+	url, _ := startServer(t, path)
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		want     int
+	}{
+		{name: "no credentials", want: http.StatusUnauthorized},
+		{name: "wrong password", user: "prometheus", password: "wrong", want: http.StatusUnauthorized},
+		{name: "unknown user", user: "admin", password: "secret", want: http.StatusUnauthorized},
+		{name: "valid", user: "prometheus", password: "secret", want: http.StatusOK},
+		{name: "valid (cached)", user: "prometheus", password: "secret", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, get(t, http.DefaultClient, url, tt.user, tt.password))
+		})
+	}
+
+	// liveness checks don't require credentials
+	assert.Equal(t, http.StatusOK, get(t, http.DefaultClient, url+"/healthz", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, get(t, http.DefaultClient, url+"/readyz", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, get(t, http.DefaultClient, url+"/metrics", "", ""))
+}
+
+func TestServer_Watch(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t)
+	ca.issue(t, dir, "server")
+	tlsConfig := "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n"
+	path := writeConfig(t, dir, tlsConfig+"basic_auth_users:\n  prometheus: "+hashPassword(t, "secret")+"\n")
+	url, s := startServer(t, path)
+	go s.Watch(t.Context(), 10*time.Millisecond)
+
+	client := ca.client(nil)
+	require.Equal(t, http.StatusOK, get(t, client, url, "prometheus", "secret"))
+
+	// change the password
+	writeConfig(t, dir, tlsConfig+"basic_auth_users:\n  prometheus: "+hashPassword(t, "new")+"\n")
+	assert.Eventually(t, func() bool {
+		return get(t, client, url, "prometheus", "new") == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusUnauthorized, get(t, client, url, "prometheus", "secret"))
+
+	// an invalid config is ignored
+	writeConfig(t, dir, "tls_server_config:\n  cert_file: server.crt\n")
+	assert.Error(t, s.reload())
+	assert.Equal(t, http.StatusOK, get(t, client, url, "prometheus", "new"))
+
+	// rotate the certificate: the old CA is no longer trusted
+	writeConfig(t, dir, tlsConfig)
+	other := newCA(t)
+	other.issue(t, dir, "server")
+	touch(t, filepath.Join(dir, "server.crt"))
+	touch(t, filepath.Join(dir, "server.key"))
+	assert.Eventually(t, func() bool {
+		resp, err := other.client(nil).Get(url)
+		if err != nil {
+			return false
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+}
+
+// startServer starts a Server on a random port. Returns its URL.
+func startServer(t *testing.T, path string) (string, *Server) {
+	t.Helper()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("ok")) })
+	s, err := NewServer("", handler, path, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	scheme := "http"
+	if s.useTLS {
+		scheme = "https"
+	}
+	go func() {
+		if err := s.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("serve: %v", err)
+		}
+	}()
+	t.Cleanup(func() { _ = s.Close() })
+	return scheme + "://" + l.Addr().String(), s
+}
+
+func get(t *testing.T, client *http.Client, url, user, password string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func writeConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "web.yml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	touch(t, path)
+	return path
+}
+
+var touches atomic.Int64
+
+// touch moves the file's modification time forward, so a change is detected even on file systems with coarse timestamps.
+func touch(t *testing.T, path string) {
+	t.Helper()
+	modTime := time.Now().Add(time.Duration(touches.Add(1)) * time.Second)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func hashPassword(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+// testCA is a self-signed CA that issues certificates for 127.0.0.1.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue writes a certificate and key, usable for both servers and clients, to dir/<name>.crt and dir/<name>.key.
+func (ca *testCA) issue(t *testing.T, dir, name string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return &cert
+}
+
+// writeCert writes the CA's certificate to dir/<name>.crt.
+func (ca *testCA) writeCert(t *testing.T, dir, name string) {
+	t.Helper()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600))
+}
+
+// client returns an HTTP client that trusts the CA, and presents cert if it's not nil.
+func (ca *testCA) client(cert *tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	tlsConfig := tls.Config{RootCAs: roots}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tlsConfig, ForceAttemptHTTP2: true}}
+}
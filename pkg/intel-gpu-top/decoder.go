@@ -0,0 +1,601 @@
+package intel_gpu_top
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// A Decoder reads the output of "intel_gpu_top -J" and decodes it into GPUStats records.
+//
+// Decoder understands both the v1.17 layout (a stream of JSON objects) and the v1.18 layout (a JSON array, with or
+// without commas between the records). It tokenizes the input in a single pass and writes the values straight into
+// GPUStats. It isn't allocation-free: the maps and strings that end up in GPUStats still take about 9 allocations per
+// record (see BenchmarkDecoder), but the input is no longer copied or converted.
+type Decoder struct {
+	r       io.Reader
+	buf     []byte
+	pos     int
+	end     int
+	mark    int
+	err     error
+	scratch []byte
+	key     []byte
+	strings map[string]string
+	units   streamUnits
+}
+
+const decoderBufferSize = 4096
+
+// NewDecoder returns a new Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:       r,
+		buf:     make([]byte, decoderBufferSize),
+		mark:    -1,
+		strings: make(map[string]string),
+		units:   make(streamUnits),
+	}
+}
+
+// Decode reads the next record and stores it in stats. At the end of the input, Decode returns io.EOF.
+//
+// All values are converted to their base unit (see [Unit]). If a section is reported in an unknown or unexpected unit,
+// or changes units midstream, its values are dropped and Decode returns the rest of the record, with an error wrapping
+// ErrFieldsDropped (and ErrUnknownUnit or ErrUnitMismatch). That error is not fatal: the next call to Decode reads the
+// next record.
+func (d *Decoder) Decode(stats *GPUStats) error {
+	_, err := d.decode(stats, false)
+	return err
+}
+
+// DecodeRaw reads the next record and stores it in stats. It also returns the generic representation of the record,
+// including any sections that GPUStats does not model. At the end of the input, DecodeRaw returns io.EOF.
+// As with Decode, an error wrapping ErrFieldsDropped is not fatal.
+func (d *Decoder) DecodeRaw(stats *GPUStats) (RawStats, error) {
+	record, err := d.decode(stats, true)
+	if err != nil && !errors.Is(err, ErrFieldsDropped) {
+		return nil, err
+	}
+	var raw RawStats
+	if rawErr := json.Unmarshal(record, &raw); rawErr != nil {
+		return nil, fmt.Errorf("raw: %w", rawErr)
+	}
+	return raw, err
+}
+
+// decode reads the next record into stats. If keepRecord is true, it returns the record's JSON representation.
+// The returned slice is only valid until the next read.
+func (d *Decoder) decode(stats *GPUStats, keepRecord bool) ([]byte, error) {
+	// v1.18 wraps the records in an array. Skip any array tokens between records.
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return nil, err
+		}
+		if c != '[' && c != ']' && c != ',' {
+			break
+		}
+		d.pos++
+	}
+	*stats = GPUStats{}
+	if keepRecord {
+		// tell fill() to preserve the record as it reads more data
+		d.mark = d.pos
+		defer func() { d.mark = -1 }()
+	}
+	if err := d.decodeStats(stats); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	// dropped fields don't invalidate the rest of the record
+	err := d.units.normalizeStats(stats)
+	if keepRecord {
+		return d.buf[d.mark:d.pos], err
+	}
+	return nil, err
+}
+
+func (d *Decoder) decodeStats(stats *GPUStats) error {
+	return d.decodeObject(func(key []byte) error {
+		switch string(key) {
+		case "engines":
+			return d.decodeEngines(&stats.Engines)
+		case "clients":
+			return d.decodeClients(&stats.Clients)
+		case "period":
+			return d.decodeFields(&stats.Period.Unit, field{"duration", &stats.Period.Duration})
+		case "interrupts":
+			return d.decodeFields(&stats.Interrupts.Unit, field{"count", &stats.Interrupts.Count})
+		case "rc6":
+			return d.decodeFields(&stats.Rc6.Unit, field{"value", &stats.Rc6.Value})
+		case "frequency":
+			return d.decodeFields(&stats.Frequency.Unit, field{"requested", &stats.Frequency.Requested}, field{"actual", &stats.Frequency.Actual})
+		case "power":
+			return d.decodeFields(&stats.Power.Unit, field{"GPU", &stats.Power.GPU}, field{"Package", &stats.Power.Package})
+		case "imc-bandwidth":
+			return d.decodeFields(&stats.ImcBandwidth.Unit, field{"reads", &stats.ImcBandwidth.Reads}, field{"writes", &stats.ImcBandwidth.Writes})
+		default:
+			return d.skipValue()
+		}
+	})
+}
+
+// field maps a JSON key to the GPUStats field it should be decoded into.
+type field struct {
+	name  string
+	value *float64
+}
+
+// decodeFields decodes an object holding a unit and one or more numeric fields.
+func (d *Decoder) decodeFields(unit *Unit, fields ...field) error {
+	return d.decodeObject(func(key []byte) error {
+		if string(key) == "unit" {
+			return d.decodeUnit(unit)
+		}
+		for _, f := range fields {
+			if string(key) == f.name {
+				return d.decodeNumber(f.value)
+			}
+		}
+		return d.skipValue()
+	})
+}
+
+func (d *Decoder) decodeEngines(engines *map[string]EngineStats) error {
+	if *engines == nil {
+		*engines = make(map[string]EngineStats, 4)
+	}
+	return d.decodeObject(func(key []byte) error {
+		name := d.intern(key)
+		var stats EngineStats
+		err := d.decodeObject(func(key []byte) error {
+			switch string(key) {
+			case "unit":
+				return d.decodeUnit(&stats.Unit)
+			case "busy":
+				return d.decodeNumber(&stats.Busy)
+			case "sema":
+				return d.decodeNumber(&stats.Sema)
+			case "wait":
+				return d.decodeNumber(&stats.Wait)
+			default:
+				return d.skipValue()
+			}
+		})
+		(*engines)[name] = stats
+		return err
+	})
+}
+
+func (d *Decoder) decodeClients(clients *map[string]ClientStats) error {
+	if *clients == nil {
+		*clients = make(map[string]ClientStats)
+	}
+	return d.decodeObject(func(key []byte) error {
+		id := string(key)
+		var stats ClientStats
+		err := d.decodeObject(func(key []byte) error {
+			switch string(key) {
+			case "name":
+				return d.decodeString(&stats.Name)
+			case "pid":
+				return d.decodeString(&stats.Pid)
+			case "engine-classes":
+				return d.decodeClientEngines(&stats.EngineClasses)
+			default:
+				return d.skipValue()
+			}
+		})
+		(*clients)[id] = stats
+		return err
+	})
+}
+
+func (d *Decoder) decodeClientEngines(engines *map[string]ClientEngineStats) error {
+	if *engines == nil {
+		*engines = make(map[string]ClientEngineStats, 4)
+	}
+	return d.decodeObject(func(key []byte) error {
+		name := d.intern(key)
+		var stats ClientEngineStats
+		err := d.decodeObject(func(key []byte) error {
+			switch string(key) {
+			case "busy":
+				return d.decodeQuotedNumber(&stats.Busy)
+			case "unit":
+				return d.decodeUnit(&stats.Unit)
+			default:
+				return d.skipValue()
+			}
+		})
+		(*engines)[name] = stats
+		return err
+	})
+}
+
+// decodeObject reads a JSON object and calls f for each key. f must consume the key's value.
+// The key is only valid until f reads from the Decoder.
+func (d *Decoder) decodeObject(f func(key []byte) error) error {
+	if err := d.expect('{'); err != nil {
+		return err
+	}
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c == '}' {
+		d.pos++
+		return nil
+	}
+	for {
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		// reading the colon may refill the buffer. keep a copy of the key.
+		d.key = append(d.key[:0], key...)
+		if err = d.expect(':'); err != nil {
+			return err
+		}
+		if err = f(d.key); err != nil {
+			return err
+		}
+		if c, err = d.peek(); err != nil {
+			return err
+		}
+		d.pos++
+		switch c {
+		case ',':
+		case '}':
+			return nil
+		default:
+			return d.syntaxError(c, "after object value")
+		}
+	}
+}
+
+func (d *Decoder) decodeString(s *string) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c != '"' {
+		return d.skipValue()
+	}
+	value, err := d.readString()
+	if err == nil {
+		*s = d.intern(value)
+	}
+	return err
+}
+
+func (d *Decoder) decodeUnit(u *Unit) error {
+	var s string
+	err := d.decodeString(&s)
+	*u = Unit(s)
+	return err
+}
+
+func (d *Decoder) decodeNumber(f *float64) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c != '-' && (c < '0' || c > '9') {
+		return d.skipValue()
+	}
+	value, err := d.readNumber()
+	if err != nil {
+		return err
+	}
+	if *f, err = strconv.ParseFloat(string(value), 64); err != nil {
+		return fmt.Errorf("invalid number %q: %w", value, err)
+	}
+	return nil
+}
+
+// decodeQuotedNumber decodes a number, which may be encoded as a string.
+func (d *Decoder) decodeQuotedNumber(f *float64) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c != '"' {
+		return d.decodeNumber(f)
+	}
+	value, err := d.readString()
+	if err != nil {
+		return err
+	}
+	if *f, err = strconv.ParseFloat(string(value), 64); err != nil {
+		return fmt.Errorf("invalid number %q: %w", value, err)
+	}
+	return nil
+}
+
+// intern returns b as a string, reusing a previous allocation for recurring values (engine names, units, etc.).
+func (d *Decoder) intern(b []byte) string {
+	if s, ok := d.strings[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	// don't let random values (e.g. client names) grow the table forever.
+	if len(d.strings) < 1024 {
+		d.strings[s] = s
+	}
+	return s
+}
+
+// skipValue reads and discards the next JSON value.
+func (d *Decoder) skipValue() error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == '{':
+		return d.decodeObject(func([]byte) error { return d.skipValue() })
+	case c == '[':
+		return d.skipArray()
+	case c == '"':
+		_, err = d.readString()
+		return err
+	case c == '-' || (c >= '0' && c <= '9'):
+		_, err = d.readNumber()
+		return err
+	case c == 't':
+		return d.expectLiteral("true")
+	case c == 'f':
+		return d.expectLiteral("false")
+	case c == 'n':
+		return d.expectLiteral("null")
+	default:
+		return d.syntaxError(c, "looking for beginning of value")
+	}
+}
+
+func (d *Decoder) skipArray() error {
+	d.pos++
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c == ']' {
+		d.pos++
+		return nil
+	}
+	for {
+		if err = d.skipValue(); err != nil {
+			return err
+		}
+		if c, err = d.peek(); err != nil {
+			return err
+		}
+		d.pos++
+		switch c {
+		case ',':
+		case ']':
+			return nil
+		default:
+			return d.syntaxError(c, "after array element")
+		}
+	}
+}
+
+// readString reads a JSON string and returns its unescaped value. The returned slice is only valid until the next read.
+func (d *Decoder) readString() ([]byte, error) {
+	if err := d.expect('"'); err != nil {
+		return nil, err
+	}
+	escaped := false
+	for i := 0; ; i++ {
+		if d.pos+i == d.end {
+			if err := d.fill(); err != nil {
+				return nil, err
+			}
+		}
+		switch d.buf[d.pos+i] {
+		case '\\':
+			escaped = true
+			i++
+			if d.pos+i == d.end {
+				if err := d.fill(); err != nil {
+					return nil, err
+				}
+			}
+		case '"':
+			value := d.buf[d.pos : d.pos+i]
+			d.pos += i + 1
+			if escaped {
+				return d.unescape(value)
+			}
+			return value, nil
+		}
+	}
+}
+
+func (d *Decoder) unescape(value []byte) ([]byte, error) {
+	out := d.scratch[:0]
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			out = append(out, value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case '"', '\\', '/':
+			out = append(out, value[i])
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			r, n := decodeRune(value[i+1:])
+			if n == 0 {
+				return nil, fmt.Errorf("invalid escape sequence in string %q", value)
+			}
+			out = utf8.AppendRune(out, r)
+			i += n
+		default:
+			return nil, fmt.Errorf("invalid escape sequence in string %q", value)
+		}
+	}
+	d.scratch = out
+	return out, nil
+}
+
+// decodeRune decodes the hex digits of a \u escape (including a surrogate pair) and returns the rune and the number of bytes consumed.
+func decodeRune(b []byte) (rune, int) {
+	r1, ok := parseHex4(b)
+	if !ok {
+		return 0, 0
+	}
+	if !utf16.IsSurrogate(r1) {
+		return r1, 4
+	}
+	if len(b) >= 10 && b[4] == '\\' && b[5] == 'u' {
+		if r2, ok := parseHex4(b[6:]); ok {
+			if r := utf16.DecodeRune(r1, r2); r != utf8.RuneError {
+				return r, 10
+			}
+		}
+	}
+	return utf8.RuneError, 4
+}
+
+func parseHex4(b []byte) (rune, bool) {
+	if len(b) < 4 {
+		return 0, false
+	}
+	var r rune
+	for _, c := range b[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			c = c - 'A' + 10
+		default:
+			return 0, false
+		}
+		r = r*16 + rune(c)
+	}
+	return r, true
+}
+
+// readNumber returns the bytes making up the next JSON number. The returned slice is only valid until the next read.
+func (d *Decoder) readNumber() ([]byte, error) {
+	for i := 0; ; i++ {
+		if d.pos+i == d.end {
+			if err := d.fill(); err != nil {
+				if errors.Is(err, io.EOF) && i > 0 {
+					// number at the very end of the input
+					value := d.buf[d.pos : d.pos+i]
+					d.pos += i
+					return value, nil
+				}
+				return nil, err
+			}
+		}
+		switch c := d.buf[d.pos+i]; {
+		case c >= '0' && c <= '9', c == '-', c == '+', c == '.', c == 'e', c == 'E':
+		default:
+			value := d.buf[d.pos : d.pos+i]
+			d.pos += i
+			return value, nil
+		}
+	}
+}
+
+func (d *Decoder) expectLiteral(literal string) error {
+	for d.end-d.pos < len(literal) {
+		if err := d.fill(); err != nil {
+			return err
+		}
+	}
+	if string(d.buf[d.pos:d.pos+len(literal)]) != literal {
+		return d.syntaxError(d.buf[d.pos], "in literal "+literal)
+	}
+	d.pos += len(literal)
+	return nil
+}
+
+func (d *Decoder) expect(want byte) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c != want {
+		return d.syntaxError(c, fmt.Sprintf("looking for %q", want))
+	}
+	d.pos++
+	return nil
+}
+
+// peek skips any whitespace and returns the next byte, without consuming it.
+func (d *Decoder) peek() (byte, error) {
+	for {
+		for ; d.pos < d.end; d.pos++ {
+			switch c := d.buf[d.pos]; c {
+			case ' ', '\t', '\r', '\n':
+			default:
+				return c, nil
+			}
+		}
+		if err := d.fill(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// fill reads more data from the source. Any unread data is moved to the front of the buffer, so offsets relative to d.pos remain valid.
+// If a record is being kept (d.mark is set), fill preserves the data from the start of the record.
+func (d *Decoder) fill() error {
+	if d.err != nil {
+		return d.err
+	}
+	start := d.pos
+	if d.mark >= 0 {
+		start = d.mark
+		d.mark = 0
+	}
+	if start > 0 {
+		d.end = copy(d.buf, d.buf[start:d.end])
+		d.pos -= start
+	}
+	if d.end == len(d.buf) {
+		// a single token fills the buffer: grow it
+		d.buf = append(d.buf, make([]byte, len(d.buf))...)
+	}
+	for {
+		n, err := d.r.Read(d.buf[d.end:])
+		d.end += n
+		if err != nil {
+			d.err = err
+		}
+		if n > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Decoder) syntaxError(c byte, context string) error {
+	return fmt.Errorf("invalid character %q %s", c, context)
+}
@@ -0,0 +1,183 @@
+package intel_gpu_top
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestDecoder(t *testing.T) {
+	// encoding/json is the reference implementation
+	var want GPUStats
+	require.NoError(t, json.Unmarshal([]byte(testutil.SinglePayload), &want))
+	require.NoError(t, make(streamUnits).normalizeStats(&want))
+
+	tests := []struct {
+		name   string
+		array  bool
+		commas bool
+	}{
+		{"v1.17", false, false},
+		{"v1.18 with commas", true, true},
+		{"v1.18 without commas", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testutil.FakeServer(t.Context(), []byte(testutil.SinglePayload), 3, tt.array, tt.commas, 0)
+			// feed the decoder one byte at a time, so every token is split across reads
+			dec := NewDecoder(iotest.OneByteReader(r))
+			for range 3 {
+				var got GPUStats
+				require.NoError(t, dec.Decode(&got))
+				assert.Equal(t, want, got)
+			}
+			var got GPUStats
+			assert.ErrorIs(t, dec.Decode(&got), io.EOF)
+		})
+	}
+}
+
+func TestDecoder_Values(t *testing.T) {
+	const input = `{
+	"unknown": { "nested": [ 1, "two", { "three": null }, [], true, false ], "empty": {} },
+	"power": { "GPU": -1.5e1, "Package": 2E-1, "unit": "W", "extra": "ignored" },
+	"engines": { "Render\/3D": { "busy": 12.5, "unit": "%" } },
+	"clients": { "1": { "name": "\"quoted\"\ttab 😀", "pid": "1", "engine-classes": {} } }
+}`
+	dec := NewDecoder(strings.NewReader(input))
+	var stats GPUStats
+	require.NoError(t, dec.Decode(&stats))
+	assert.Equal(t, -15.0, stats.Power.GPU)
+	assert.Equal(t, 0.2, stats.Power.Package)
+	assert.Equal(t, UnitWatt, stats.Power.Unit)
+	assert.Equal(t, EngineStats{Busy: 0.125, Unit: UnitRatio}, stats.Engines["Render/3D"])
+	assert.Equal(t, "\"quoted\"\ttab 😀", stats.Clients["1"].Name)
+	assert.ErrorIs(t, dec.Decode(&stats), io.EOF)
+}
+
+func TestDecoder_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"truncated", `{ "power": { "GPU": 1`, io.ErrUnexpectedEOF},
+		{"truncated string", `{ "power": { "un`, io.ErrUnexpectedEOF},
+		{"not an object", `"foo"`, nil},
+		{"missing colon", `{ "power" { } }`, nil},
+		{"missing comma", `{ "power": {} "rc6": {} }`, nil},
+		{"invalid literal", `{ "power": nil }`, nil},
+		{"invalid number", `{ "power": { "GPU": 1-2 } }`, nil},
+		{"invalid escape", `{ "power": { "unit": "\x" } }`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stats GPUStats
+			err := NewDecoder(strings.NewReader(tt.input)).Decode(&stats)
+			require.Error(t, err)
+			assert.False(t, errors.Is(err, io.EOF))
+			if tt.want != nil {
+				assert.ErrorIs(t, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecoder_LargeToken(t *testing.T) {
+	name := strings.Repeat("x", 3*decoderBufferSize)
+	dec := NewDecoder(strings.NewReader(`{ "clients": { "1": { "name": "` + name + `" } } }`))
+	var stats GPUStats
+	require.NoError(t, dec.Decode(&stats))
+	assert.Equal(t, name, stats.Clients["1"].Name)
+}
+
+func TestDecoder_Streaming(t *testing.T) {
+	// Decode must return as soon as a record is complete, without waiting for more data.
+	r, w := io.Pipe()
+	t.Cleanup(func() { _ = w.Close() })
+	go func() { _, _ = w.Write([]byte("[\n" + testutil.SinglePayload)) }()
+
+	done := make(chan error)
+	go func() {
+		var stats GPUStats
+		done <- NewDecoder(r).Decode(&stats)
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Decode blocked after a complete record")
+	}
+}
+
+// Decodes 10 records. Remaining allocations are the maps & strings in GPUStats.
+//
+// Before (V118toV117 + encoding/json):
+// BenchmarkDecoder/v118tov117         	    3975	    314620 ns/op	   33461 B/op	     150 allocs/op
+//
+// Now:
+// BenchmarkDecoder/decoder            	   14763	     84565 ns/op	   20552 B/op	      90 allocs/op
+func BenchmarkDecoder(b *testing.B) {
+	// generate input outside the benchmark
+	var payload bytes.Buffer
+	r := testutil.FakeServer(context.Background(), []byte(testutil.SinglePayload), 10, true, true, 0)
+	if _, err := payload.ReadFrom(r); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("v118tov117", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			var count int
+			for _, err := range readGPUStatsV117(&V118toV117{Source: bytes.NewReader(payload.Bytes())}) {
+				if err != nil {
+					b.Fatal(err)
+				}
+				count++
+			}
+			if count != 10 {
+				b.Fatalf("expected 10 records, got %d", count)
+			}
+		}
+	})
+	b.Run("decoder", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			var count int
+			for _, err := range ReadGPUStats(bytes.NewReader(payload.Bytes())) {
+				if err != nil {
+					b.Fatal(err)
+				}
+				count++
+			}
+			if count != 10 {
+				b.Fatalf("expected 10 records, got %d", count)
+			}
+		}
+	})
+}
+
+// readGPUStatsV117 is the original, encoding/json-based implementation of ReadGPUStats.
+func readGPUStatsV117(r io.Reader) func(func(GPUStats, error) bool) {
+	return func(yield func(GPUStats, error) bool) {
+		dec := json.NewDecoder(r)
+		for dec.More() {
+			var stats GPUStats
+			if err := dec.Decode(&stats); err != nil {
+				yield(GPUStats{}, err)
+				return
+			}
+			if !yield(stats, nil) {
+				return
+			}
+		}
+	}
+}
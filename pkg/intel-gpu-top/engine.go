@@ -0,0 +1,74 @@
+package intel_gpu_top
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EngineClass is the canonical name of a class of GPU engines.
+type EngineClass string
+
+const (
+	EngineClassRender       EngineClass = "render"
+	EngineClassCopy         EngineClass = "copy"
+	EngineClassVideo        EngineClass = "video"
+	EngineClassVideoEnhance EngineClass = "video_enhance"
+	EngineClassCompute      EngineClass = "compute"
+)
+
+// ErrUnknownEngine indicates that an engine name could not be parsed.
+var ErrUnknownEngine = errors.New("unknown engine")
+
+// Engine identifies one GPU engine.
+type Engine struct {
+	Class    EngineClass
+	Instance int
+}
+
+// engineClasses maps the different names used by intel_gpu_top (i915 and xe) to the canonical engine class.
+var engineClasses = map[string]EngineClass{
+	"render/3d":    EngineClassRender,
+	"render":       EngineClassRender,
+	"rcs":          EngineClassRender,
+	"blitter":      EngineClassCopy,
+	"copy":         EngineClassCopy,
+	"bcs":          EngineClassCopy,
+	"video":        EngineClassVideo,
+	"vcs":          EngineClassVideo,
+	"videoenhance": EngineClassVideoEnhance,
+	"vecs":         EngineClassVideoEnhance,
+	"compute":      EngineClassCompute,
+	"ccs":          EngineClassCompute,
+}
+
+// ParseEngine maps an engine name, as reported by intel_gpu_top, to its engine class and instance.
+//
+// ParseEngine understands class names ("Render/3D", "Video"), class names with an instance ("Video/1", "Compute/0")
+// and the xe-style names ("rcs0", "ccs1"). If no instance is given, the instance is 0.
+func ParseEngine(name string) (Engine, error) {
+	className, instance := splitEngineName(strings.ToLower(name))
+	class, ok := engineClasses[className]
+	if !ok {
+		return Engine{}, fmt.Errorf("%w: %q", ErrUnknownEngine, name)
+	}
+	return Engine{Class: class, Instance: instance}, nil
+}
+
+// splitEngineName splits the engine name in its class name and its instance number.
+func splitEngineName(name string) (string, int) {
+	// "Video/1"
+	if i := strings.LastIndexByte(name, '/'); i != -1 {
+		if instance, err := strconv.Atoi(name[i+1:]); err == nil {
+			return name[:i], instance
+		}
+	}
+	// "vcs1"
+	if i := strings.LastIndexFunc(name, func(r rune) bool { return r < '0' || r > '9' }); i != -1 && i < len(name)-1 {
+		if instance, err := strconv.Atoi(name[i+1:]); err == nil {
+			return name[:i+1], instance
+		}
+	}
+	return name, 0
+}
@@ -0,0 +1,40 @@
+package intel_gpu_top
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseEngine(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Engine
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{"Render/3D", Engine{Class: EngineClassRender}, assert.NoError},
+		{"Render/3D/0", Engine{Class: EngineClassRender}, assert.NoError},
+		{"Blitter", Engine{Class: EngineClassCopy}, assert.NoError},
+		{"Video", Engine{Class: EngineClassVideo}, assert.NoError},
+		{"Video/0", Engine{Class: EngineClassVideo}, assert.NoError},
+		{"Video/1", Engine{Class: EngineClassVideo, Instance: 1}, assert.NoError},
+		{"VideoEnhance", Engine{Class: EngineClassVideoEnhance}, assert.NoError},
+		{"VideoEnhance/1", Engine{Class: EngineClassVideoEnhance, Instance: 1}, assert.NoError},
+		{"Compute/0", Engine{Class: EngineClassCompute}, assert.NoError},
+		{"Compute/3", Engine{Class: EngineClassCompute, Instance: 3}, assert.NoError},
+		{"rcs0", Engine{Class: EngineClassRender}, assert.NoError},
+		{"bcs0", Engine{Class: EngineClassCopy}, assert.NoError},
+		{"vcs1", Engine{Class: EngineClassVideo, Instance: 1}, assert.NoError},
+		{"vecs0", Engine{Class: EngineClassVideoEnhance}, assert.NoError},
+		{"ccs12", Engine{Class: EngineClassCompute, Instance: 12}, assert.NoError},
+		{"Foo", Engine{}, assert.Error},
+		{"Foo/1", Engine{}, assert.Error},
+		{"", Engine{}, assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseEngine(tt.name)
+			tt.wantErr(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
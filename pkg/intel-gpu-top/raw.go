@@ -0,0 +1,59 @@
+package intel_gpu_top
+
+import (
+	"slices"
+	"strings"
+)
+
+// RawStats is the generic representation of one intel_gpu_top record, as decoded by [Decoder.DecodeRaw].
+type RawStats map[string]any
+
+// RawValue is one numeric value found in a RawStats record.
+type RawValue struct {
+	// Path is the location of the value in the record, with the keys separated by dots (e.g. "power.GPU").
+	Path string
+	// Unit is the unit reported next to the value, if any.
+	Unit  Unit
+	Value float64
+}
+
+// knownSections are the top-level sections modeled by GPUStats.
+var knownSections = []string{"period", "frequency", "interrupts", "rc6", "power", "imc-bandwidth", "engines", "clients"}
+
+// Values flattens the record and returns all numeric values, sorted by path. Each value takes the unit found
+// in the same object (i.e. its "unit" sibling). Values in a known unit are converted to their base unit.
+func (r RawStats) Values() []RawValue {
+	var values []RawValue
+	flatten(&values, "", r)
+	slices.SortFunc(values, func(a, b RawValue) int { return strings.Compare(a.Path, b.Path) })
+	return values
+}
+
+func flatten(values *[]RawValue, prefix string, node map[string]any) {
+	unitName, _ := node["unit"].(string)
+	unit := Unit(unitName)
+	for key, value := range node {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		switch value := value.(type) {
+		case float64:
+			*values = append(*values, RawValue{Path: path, Unit: unit.Base(), Value: unit.ToBase(value)})
+		case map[string]any:
+			flatten(values, path, value)
+		}
+	}
+}
+
+// UnknownSections returns the top-level sections of the record that are not modeled by GPUStats, sorted by name.
+func (r RawStats) UnknownSections() []string {
+	var unknown []string
+	for key := range r {
+		if !slices.Contains(knownSections, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
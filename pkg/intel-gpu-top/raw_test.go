@@ -0,0 +1,46 @@
+package intel_gpu_top
+
+import (
+	"github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecoder_DecodeRaw(t *testing.T) {
+	const extra = `{ "new-section": { "value": 12.5, "unit": "mW", "label": "foo" }, "other": { "value": 1, "unit": "foo" } }`
+	r := io.MultiReader(
+		strings.NewReader("[\n"+testutil.SinglePayload+",\n"),
+		strings.NewReader(extra+"\n]"),
+	)
+	// feed the decoder one byte at a time, so the record must be preserved across reads
+	dec := NewDecoder(iotest.OneByteReader(r))
+
+	var stats GPUStats
+	raw, err := dec.DecodeRaw(&stats)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, stats.Power.GPU)
+	assert.Empty(t, raw.UnknownSections())
+
+	values := raw.Values()
+	assert.Contains(t, values, RawValue{Path: "power.GPU", Unit: UnitWatt, Value: 1})
+	assert.Contains(t, values, RawValue{Path: "engines.Video.busy", Unit: UnitRatio, Value: 0.03})
+	// client busy values are strings: they are not reported
+	for _, value := range values {
+		assert.False(t, strings.HasPrefix(value.Path, "clients."), value.Path)
+	}
+
+	raw, err = dec.DecodeRaw(&stats)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new-section", "other"}, raw.UnknownSections())
+	assert.Equal(t, []RawValue{
+		{Path: "new-section.value", Unit: UnitWatt, Value: 0.0125},
+		{Path: "other.value", Unit: "foo", Value: 1},
+	}, raw.Values())
+
+	_, err = dec.DecodeRaw(&stats)
+	assert.ErrorIs(t, err, io.EOF)
+}
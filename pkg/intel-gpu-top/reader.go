@@ -2,7 +2,6 @@ package intel_gpu_top
 
 import (
 	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -15,29 +14,29 @@ type GPUStats struct {
 	Engines map[string]EngineStats `json:"engines"`
 	Clients map[string]ClientStats `json:"clients"`
 	Period  struct {
-		Unit     string  `json:"unit"`
+		Unit     Unit    `json:"unit"`
 		Duration float64 `json:"duration"`
 	} `json:"period"`
 	Interrupts struct {
-		Unit  string  `json:"unit"`
+		Unit  Unit    `json:"unit"`
 		Count float64 `json:"count"`
 	} `json:"interrupts"`
 	Rc6 struct {
-		Unit  string  `json:"unit"`
+		Unit  Unit    `json:"unit"`
 		Value float64 `json:"value"`
 	} `json:"rc6"`
 	Frequency struct {
-		Unit      string  `json:"unit"`
+		Unit      Unit    `json:"unit"`
 		Requested float64 `json:"requested"`
 		Actual    float64 `json:"actual"`
 	} `json:"frequency"`
 	Power struct {
-		Unit    string  `json:"unit"`
+		Unit    Unit    `json:"unit"`
 		GPU     float64 `json:"GPU"`
 		Package float64 `json:"Package"`
 	} `json:"power"`
 	ImcBandwidth struct {
-		Unit   string  `json:"unit"`
+		Unit   Unit    `json:"unit"`
 		Reads  float64 `json:"reads"`
 		Writes float64 `json:"writes"`
 	} `json:"imc-bandwidth"`
@@ -45,7 +44,7 @@ type GPUStats struct {
 
 // EngineStats contains the utilization of one GPU engine.
 type EngineStats struct {
-	Unit string  `json:"unit"`
+	Unit Unit    `json:"unit"`
 	Busy float64 `json:"busy"`
 	Sema float64 `json:"sema"`
 	Wait float64 `json:"wait"`
@@ -53,34 +52,47 @@ type EngineStats struct {
 
 // ClientStats contains statistics for one client, currently using the GPU.
 type ClientStats struct {
-	EngineClasses map[string]struct {
-		Busy string `json:"busy"`
-		Unit string `json:"unit"`
-	} `json:"engine-classes"`
-	Name string `json:"name"`
-	Pid  string `json:"pid"`
+	EngineClasses map[string]ClientEngineStats `json:"engine-classes"`
+	Name          string                       `json:"name"`
+	Pid           string                       `json:"pid"`
+}
+
+// ClientEngineStats contains the utilization of one GPU engine class by a client.
+//
+// Note: intel_gpu_top reports the value as a string.
+type ClientEngineStats struct {
+	Busy float64 `json:"busy,string"`
+	Unit Unit    `json:"unit"`
 }
 
 // ReadGPUStats decodes the output of "intel-gpu-top -J" and iterates through the GPUStats records.
 //
-// Works with intel-gpu-top v1.17.  If you want to use v1.18 (which uses a different layout), see [V118toV117].
-// This middleware converts the output back to v1.17 layout, so it can be processed by ReadGPUStats
+// Works with both intel-gpu-top v1.17 and v1.18 (which wraps the records in a JSON array). See [Decoder].
+//
+// If a record contains values in an unknown or unexpected unit, ReadGPUStats yields the rest of the record with an
+// error wrapping ErrFieldsDropped, and continues with the next record. Any other error ends the iteration.
 func ReadGPUStats(r io.Reader) iter.Seq2[GPUStats, error] {
 	return func(yield func(GPUStats, error) bool) {
-		dec := json.NewDecoder(r)
-		var err error
-		for dec.More() {
+		dec := NewDecoder(r)
+		for {
 			var stats GPUStats
-			if err = dec.Decode(&stats); err != nil {
-				break
+			err := dec.Decode(&stats)
+			switch {
+			case errors.Is(err, ErrFieldsDropped):
+				if !yield(stats, fmt.Errorf("GetGPUStats: %w", err)) {
+					return
+				}
+				continue
+			case errors.Is(err, io.EOF):
+				return
+			case err != nil:
+				yield(GPUStats{}, fmt.Errorf("GetGPUStats: %w", err))
+				return
 			}
 			if !yield(stats, nil) {
 				return
 			}
 		}
-		if err != nil && !errors.Is(err, io.EOF) {
-			yield(GPUStats{}, fmt.Errorf("GetGPUStats: %w", err))
-		}
 	}
 }
 
@@ -93,6 +105,8 @@ var _ io.Reader = &V118toV117{}
 //
 // This means json.Decoder will try to read in the full array, where we want to stream the individual records.
 // V118toV117 solves this by removed the array & comma tokens, turning the data back to V1.17 layout.
+//
+// Deprecated: ReadGPUStats reads the v1.18 layout directly, without the need for conversion.
 type V118toV117 struct {
 	Source io.Reader
 	output bytes.Buffer
@@ -4,10 +4,11 @@ import (
 	"bytes"
 	"context"
 	"errors"
-	"github.com/clambin/intel-gpu-exporter/pkg/intel-gpu-top/testutil"
+	"github.com/rmarchant/intel-gpu-exporter/pkg/intel-gpu-top/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io"
+	"strings"
 	"testing"
 	"time"
 )
@@ -25,7 +26,9 @@ func TestReadGPUStats(t *testing.T) {
 		{"v1.17", false, false, true, 5, 5, assert.NoError},
 		{"v1.18a", true, true, true, 5, 5, assert.NoError},
 		{"v1.18b", true, false, true, 5, 5, assert.NoError},
-		{"fail", true, true, false, 1, 0, assert.Error},
+		// the decoder reads v1.18 output as is
+		{"v1.18a unconverted", true, true, false, 5, 5, assert.NoError},
+		{"v1.18b unconverted", true, false, false, 5, 5, assert.NoError},
 	}
 
 	for _, tt := range tests {
@@ -52,6 +55,20 @@ func TestReadGPUStats(t *testing.T) {
 	}
 }
 
+func TestReadGPUStats_malformed(t *testing.T) {
+	r := strings.NewReader(testutil.SinglePayload + `{ "period": { "duration": [ } }` + testutil.SinglePayload)
+	var got int
+	var err error
+	for _, err = range ReadGPUStats(r) {
+		if err != nil {
+			break
+		}
+		got++
+	}
+	assert.Error(t, err)
+	assert.Equal(t, 1, got)
+}
+
 func TestJsonTracker(t *testing.T) {
 	tests := []struct {
 		input    string
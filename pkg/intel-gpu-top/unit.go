@@ -0,0 +1,183 @@
+package intel_gpu_top
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Unit is a unit of measurement, as reported by intel_gpu_top.
+//
+// When decoding, all values are converted to their base unit, i.e. the unit Prometheus expects for that quantity.
+type Unit string
+
+const (
+	UnitRatio          Unit = "ratio"
+	UnitPercent        Unit = "%"
+	UnitHertz          Unit = "Hz"
+	UnitMegaHertz      Unit = "MHz"
+	UnitWatt           Unit = "W"
+	UnitMilliWatt      Unit = "mW"
+	UnitBytesPerSecond Unit = "B/s"
+	UnitMiBPerSecond   Unit = "MiB/s"
+	UnitIRQPerSecond   Unit = "irq/s"
+	UnitSeconds        Unit = "s"
+	UnitMilliseconds   Unit = "ms"
+)
+
+// ErrUnknownUnit indicates that a unit is not supported.
+var ErrUnknownUnit = errors.New("unknown unit")
+
+// ErrUnitMismatch indicates that a value is reported in a unit that doesn't match the expected quantity,
+// or that doesn't match the unit used earlier in the stream.
+var ErrUnitMismatch = errors.New("unit mismatch")
+
+// ErrFieldsDropped indicates that a record contained values in an unknown or unexpected unit. Those values were dropped,
+// but the rest of the record was decoded: the error is not fatal and decoding can continue with the next record.
+var ErrFieldsDropped = errors.New("fields dropped")
+
+// unitDefinition defines how to convert a unit to its base unit: base = value * mul / div.
+// Using a separate multiplier and divisor keeps conversions like 1% -> 0.01 exact.
+type unitDefinition struct {
+	base Unit
+	mul  float64
+	div  float64
+}
+
+var unitDefinitions = map[Unit]unitDefinition{
+	UnitRatio:          {base: UnitRatio, mul: 1, div: 1},
+	UnitPercent:        {base: UnitRatio, mul: 1, div: 100},
+	UnitHertz:          {base: UnitHertz, mul: 1, div: 1},
+	UnitMegaHertz:      {base: UnitHertz, mul: 1e6, div: 1},
+	UnitWatt:           {base: UnitWatt, mul: 1, div: 1},
+	UnitMilliWatt:      {base: UnitWatt, mul: 1, div: 1e3},
+	UnitBytesPerSecond: {base: UnitBytesPerSecond, mul: 1, div: 1},
+	UnitMiBPerSecond:   {base: UnitBytesPerSecond, mul: 1 << 20, div: 1},
+	UnitIRQPerSecond:   {base: UnitIRQPerSecond, mul: 1, div: 1},
+	UnitSeconds:        {base: UnitSeconds, mul: 1, div: 1},
+	UnitMilliseconds:   {base: UnitSeconds, mul: 1, div: 1e3},
+}
+
+// ParseUnit returns the Unit for s. Returns ErrUnknownUnit if the unit is not supported.
+func ParseUnit(s string) (Unit, error) {
+	if _, ok := unitDefinitions[Unit(s)]; !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownUnit, s)
+	}
+	return Unit(s), nil
+}
+
+// Base returns the base unit of u. For an unknown unit, Base returns u.
+func (u Unit) Base() Unit {
+	if def, ok := unitDefinitions[u]; ok {
+		return def.base
+	}
+	return u
+}
+
+// ToBase converts value, expressed in u, to u's base unit. For an unknown unit, ToBase returns value.
+func (u Unit) ToBase(value float64) float64 {
+	if def, ok := unitDefinitions[u]; ok {
+		return value * def.mul / def.div
+	}
+	return value
+}
+
+// Convert converts value, expressed in u, to unit to. Both units must measure the same quantity.
+func (u Unit) Convert(value float64, to Unit) (float64, error) {
+	from, ok := unitDefinitions[u]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownUnit, u)
+	}
+	target, ok := unitDefinitions[to]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownUnit, to)
+	}
+	if from.base != target.base {
+		return 0, fmt.Errorf("%w: cannot convert %s to %s", ErrUnitMismatch, u, to)
+	}
+	return value * from.mul / from.div * target.div / target.mul, nil
+}
+
+// streamUnits tracks the units used by each section of a stream, so we can reject records that change units midstream.
+type streamUnits map[string]Unit
+
+// normalize converts the value(s) of a section to the section's base unit, which must be want.
+// A section without a unit (i.e. it wasn't reported) is left alone. If the unit is unknown or doesn't match,
+// the section's values are dropped: they are zeroed and the unit is cleared, as if the section wasn't reported.
+func (s streamUnits) normalize(section string, unit *Unit, want Unit, values ...*float64) error {
+	if *unit == "" {
+		return nil
+	}
+	err := s.check(section, *unit, want)
+	if err != nil {
+		for _, value := range values {
+			*value = 0
+		}
+		*unit = ""
+		return err
+	}
+	for _, value := range values {
+		*value = unit.ToBase(*value)
+	}
+	*unit = want
+	return nil
+}
+
+// check returns an error if unit is unknown, doesn't measure the expected quantity, or differs from the unit used
+// earlier in the stream.
+func (s streamUnits) check(section string, unit Unit, want Unit) error {
+	if _, err := ParseUnit(string(unit)); err != nil {
+		return fmt.Errorf("%s: %w", section, err)
+	}
+	if unit.Base() != want {
+		return fmt.Errorf("%w: %s reported in %s", ErrUnitMismatch, section, unit)
+	}
+	if previous, ok := s[section]; !ok {
+		s[section] = unit
+	} else if previous != unit {
+		return fmt.Errorf("%w: %s changed from %s to %s", ErrUnitMismatch, section, previous, unit)
+	}
+	return nil
+}
+
+// normalizeStats converts all values in stats to their base units. Values in an unknown or unexpected unit are dropped:
+// the returned error lists them.
+func (s streamUnits) normalizeStats(stats *GPUStats) error {
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	add(s.normalize("period", &stats.Period.Unit, UnitSeconds, &stats.Period.Duration))
+	add(s.normalize("interrupts", &stats.Interrupts.Unit, UnitIRQPerSecond, &stats.Interrupts.Count))
+	add(s.normalize("rc6", &stats.Rc6.Unit, UnitRatio, &stats.Rc6.Value))
+	add(s.normalize("frequency", &stats.Frequency.Unit, UnitHertz, &stats.Frequency.Requested, &stats.Frequency.Actual))
+	add(s.normalize("power", &stats.Power.Unit, UnitWatt, &stats.Power.GPU, &stats.Power.Package))
+	add(s.normalize("imc-bandwidth", &stats.ImcBandwidth.Unit, UnitBytesPerSecond, &stats.ImcBandwidth.Reads, &stats.ImcBandwidth.Writes))
+	for name, engine := range stats.Engines {
+		if err := s.normalize("engines", &engine.Unit, UnitRatio, &engine.Busy, &engine.Sema, &engine.Wait); err != nil {
+			add(fmt.Errorf("%s: %w", name, err))
+			delete(stats.Engines, name)
+			continue
+		}
+		stats.Engines[name] = engine
+	}
+	for _, client := range stats.Clients {
+		for name, engine := range client.EngineClasses {
+			if err := s.normalize("clients", &engine.Unit, UnitRatio, &engine.Busy); err != nil {
+				add(fmt.Errorf("client %s: %w", name, err))
+				delete(client.EngineClasses, name)
+				continue
+			}
+			client.EngineClasses[name] = engine
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	// map iteration is random: sort the errors, so the same problem always gives the same error
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return fmt.Errorf("%w: %w", ErrFieldsDropped, errors.Join(errs...))
+}
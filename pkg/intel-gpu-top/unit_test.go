@@ -0,0 +1,109 @@
+package intel_gpu_top
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestParseUnit(t *testing.T) {
+	for _, unit := range []string{"%", "MHz", "W", "mW", "MiB/s", "irq/s", "ms"} {
+		got, err := ParseUnit(unit)
+		require.NoError(t, err)
+		assert.Equal(t, Unit(unit), got)
+	}
+	_, err := ParseUnit("furlongs")
+	assert.ErrorIs(t, err, ErrUnknownUnit)
+}
+
+func TestUnit_ToBase(t *testing.T) {
+	tests := []struct {
+		unit     Unit
+		value    float64
+		wantUnit Unit
+		want     float64
+	}{
+		{UnitPercent, 3, UnitRatio, 0.03},
+		{UnitMegaHertz, 1300, UnitHertz, 1.3e9},
+		{UnitWatt, 1.5, UnitWatt, 1.5},
+		{UnitMilliWatt, 1500, UnitWatt, 1.5},
+		{UnitMiBPerSecond, 2, UnitBytesPerSecond, 2 * 1024 * 1024},
+		{UnitIRQPerSecond, 10, UnitIRQPerSecond, 10},
+		{UnitMilliseconds, 1000, UnitSeconds, 1},
+		{"foo", 10, "foo", 10},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.unit), func(t *testing.T) {
+			assert.Equal(t, tt.wantUnit, tt.unit.Base())
+			assert.Equal(t, tt.want, tt.unit.ToBase(tt.value))
+		})
+	}
+}
+
+func TestUnit_Convert(t *testing.T) {
+	got, err := UnitWatt.Convert(1.5, UnitMilliWatt)
+	require.NoError(t, err)
+	assert.Equal(t, 1500.0, got)
+
+	got, err = UnitRatio.Convert(0.25, UnitPercent)
+	require.NoError(t, err)
+	assert.Equal(t, 25.0, got)
+
+	_, err = UnitWatt.Convert(1, UnitMegaHertz)
+	assert.ErrorIs(t, err, ErrUnitMismatch)
+	_, err = Unit("foo").Convert(1, UnitWatt)
+	assert.ErrorIs(t, err, ErrUnknownUnit)
+	_, err = UnitWatt.Convert(1, "foo")
+	assert.ErrorIs(t, err, ErrUnknownUnit)
+}
+
+func TestDecoder_Units(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr error
+	}{
+		{"milliwatt", `{ "power": { "GPU": 1500, "unit": "mW" } }`, nil},
+		{"unknown unit", `{ "power": { "GPU": 1, "unit": "hp" } }`, ErrUnknownUnit},
+		{"wrong quantity", `{ "power": { "GPU": 1, "unit": "MHz" } }`, ErrUnitMismatch},
+		{"engine in wrong unit", `{ "engines": { "Video": { "busy": 1, "unit": "ms" } } }`, ErrUnitMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the invalid section is dropped, but the rest of the record and the stream are still decoded
+			input := strings.TrimSuffix(tt.input, " }") + `, "rc6": { "value": 50, "unit": "%" } } { "rc6": { "value": 25, "unit": "%" } }`
+			var records []GPUStats
+			var errs []error
+			for stats, err := range ReadGPUStats(strings.NewReader(input)) {
+				records = append(records, stats)
+				errs = append(errs, err)
+			}
+			require.Len(t, records, 2)
+			assert.Equal(t, 0.5, records[0].Rc6.Value)
+			assert.Equal(t, 0.25, records[1].Rc6.Value)
+			assert.NoError(t, errs[1])
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, errs[0], ErrFieldsDropped)
+				assert.ErrorIs(t, errs[0], tt.wantErr)
+				assert.Empty(t, records[0].Engines)
+				assert.Zero(t, records[0].Power.GPU)
+				assert.Empty(t, records[0].Power.Unit)
+				return
+			}
+			require.NoError(t, errs[0])
+			assert.Equal(t, UnitWatt, records[0].Power.Unit)
+			assert.Equal(t, 1.5, records[0].Power.GPU)
+		})
+	}
+}
+
+func TestDecoder_Units_changeMidstream(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(`{ "power": { "GPU": 1, "unit": "W" } } { "power": { "GPU": 1, "unit": "mW" } } { "power": { "GPU": 2, "unit": "W" } }`))
+	var stats GPUStats
+	require.NoError(t, dec.Decode(&stats))
+	assert.ErrorIs(t, dec.Decode(&stats), ErrUnitMismatch)
+	assert.Zero(t, stats.Power.GPU)
+	require.NoError(t, dec.Decode(&stats))
+	assert.Equal(t, 2.0, stats.Power.GPU)
+}